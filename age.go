@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// AgeClient encrypts backups to age recipients and decrypts them with the
+// matching identities, in process. Recipients are X25519 public keys
+// (age1...) or SSH public keys; identities are age key files or unencrypted
+// SSH private keys.
+type AgeClient struct {
+	recipients       []string
+	recipientsFiles  []string
+	identitiesFiles  []string
+	identitiesSecret string
+
+	// keys is shared by the copies WithPrefix returns, so keys are only
+	// loaded once per run.
+	keys *ageKeys
+
+	logger *log.Entry
+}
+
+type ageKeys struct {
+	recipientsOnce sync.Once
+	recipients     []age.Recipient
+	recipientNames []string
+	recipientsErr  error
+	identitiesOnce sync.Once
+	identities     []age.Identity
+	identitiesErr  error
+}
+
+func NewAgeClient() *AgeClient {
+	return &AgeClient{
+		recipients:       viper.GetStringSlice("age.recipients"),
+		recipientsFiles:  viper.GetStringSlice("age.recipients_files"),
+		identitiesFiles:  viper.GetStringSlice("age.identities_files"),
+		identitiesSecret: viper.GetString("age.identities_secret"),
+		keys:             &ageKeys{},
+		logger:           log.NewEntry(log.StandardLogger()),
+	}
+}
+
+// WithPrefix returns a copy of the client whose log messages are prefixed
+// with prefix.
+func (a *AgeClient) WithPrefix(prefix string) Encryptor {
+	prefixed := *a
+	prefixed.logger = log.WithField(logPrefixField, prefix)
+	return &prefixed
+}
+
+// Name returns the provider name recorded with backups.
+func (a *AgeClient) Name() string {
+	return encryptionProviderAge
+}
+
+// Suffix returns the file and object suffix of age files.
+func (a *AgeClient) Suffix() string {
+	return ageSuffix
+}
+
+// EncryptFile encrypts inputPath into a file named with Suffix.
+func (a *AgeClient) EncryptFile(inputPath string) (string, error) {
+	return encryptFile(a, a.logger, inputPath)
+}
+
+// EncryptStream returns a writer encrypting its input to the recipients and
+// writing the binary age file to w. Close finishes the file; it does not
+// close w.
+func (a *AgeClient) EncryptStream(ctx context.Context, w io.Writer) (io.WriteCloser, error) {
+	a.logger.Debug("Starting streaming age encryption")
+
+	recipients, _, err := a.recipientKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := age.Encrypt(w, recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start age encryption: %w", err)
+	}
+	return plaintext, nil
+}
+
+// DecryptFile decrypts inputPath into a file named without its encryption
+// suffix.
+func (a *AgeClient) DecryptFile(inputPath string) (string, error) {
+	return decryptFile(a, a.logger, inputPath)
+}
+
+// DecryptStream decrypts the age file read from r and returns its
+// plaintext. Every chunk is authenticated as it is read and Close reads
+// whatever the caller left unread, so a truncated file is reported.
+func (a *AgeClient) DecryptStream(ctx context.Context, r io.Reader) (io.ReadCloser, error) {
+	a.logger.Debug("Starting streaming age decryption")
+
+	identities, err := a.identityKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	source := bufio.NewReader(r)
+	plaintext, err := age.Decrypt(source, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("age decryption failed: %w", err)
+	}
+
+	return &decryptReader{Reader: plaintext, source: source, name: "age"}, nil
+}
+
+// Validate checks that the configured recipients can be parsed.
+func (a *AgeClient) Validate() error {
+	_, names, err := a.recipientKeys()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		a.logger.Debugf("age recipient %s", name)
+	}
+	return nil
+}
+
+// Recipients returns the recipients backups are encrypted to, without the
+// comments of SSH keys, as recorded in backup manifests.
+func (a *AgeClient) Recipients() ([]string, error) {
+	_, names, err := a.recipientKeys()
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// recipientKeys returns the parsed recipients of age.recipients and the
+// recipients files, and the names they are recorded under.
+func (a *AgeClient) recipientKeys() ([]age.Recipient, []string, error) {
+	a.keys.recipientsOnce.Do(func() {
+		a.keys.recipients, a.keys.recipientNames, a.keys.recipientsErr = a.loadRecipients()
+	})
+	if a.keys.recipientsErr != nil {
+		return nil, nil, fmt.Errorf("failed to load age recipients: %w", a.keys.recipientsErr)
+	}
+	if len(a.keys.recipients) == 0 {
+		return nil, nil, fmt.Errorf("no age recipients configured, set age.recipients or age.recipients_files")
+	}
+	return a.keys.recipients, a.keys.recipientNames, nil
+}
+
+func (a *AgeClient) loadRecipients() ([]age.Recipient, []string, error) {
+	lines := append([]string{}, a.recipients...)
+
+	for _, path := range a.recipientsFiles {
+		files, err := keyFiles(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to read recipients file: %w", err)
+			}
+			lines = append(lines, strings.Split(string(data), "\n")...)
+		}
+	}
+
+	var recipients []age.Recipient
+	var names []string
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		recipient, name, err := parseAgeRecipient(line)
+		if err != nil {
+			return nil, nil, err
+		}
+		recipients = append(recipients, recipient)
+		names = append(names, name)
+	}
+	return recipients, names, nil
+}
+
+// parseAgeRecipient parses an X25519 or SSH recipient and returns it with
+// the name it is recorded under.
+func parseAgeRecipient(value string) (age.Recipient, string, error) {
+	if strings.HasPrefix(value, "age1") {
+		recipient, err := age.ParseX25519Recipient(value)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid age recipient: %w", err)
+		}
+		return recipient, recipient.String(), nil
+	}
+
+	if strings.HasPrefix(value, "ssh-") {
+		recipient, err := agessh.ParseRecipient(value)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid age recipient: %w", err)
+		}
+		fields := strings.Fields(value)
+		return recipient, fields[0] + " " + fields[1], nil
+	}
+
+	return nil, "", fmt.Errorf("unsupported age recipient %q, expected an age1... or SSH public key", value)
+}
+
+// identityKeys returns the identities for decryption.
+func (a *AgeClient) identityKeys() ([]age.Identity, error) {
+	a.keys.identitiesOnce.Do(func() {
+		a.keys.identities, a.keys.identitiesErr = a.loadIdentities()
+	})
+	if a.keys.identitiesErr != nil {
+		return nil, fmt.Errorf("failed to load age identities: %w", a.keys.identitiesErr)
+	}
+	if len(a.keys.identities) == 0 {
+		return nil, fmt.Errorf("no age identities configured, set age.identities_files or age.identities_secret")
+	}
+	return a.keys.identities, nil
+}
+
+func (a *AgeClient) loadIdentities() ([]age.Identity, error) {
+	var identities []age.Identity
+
+	for _, path := range a.identitiesFiles {
+		files, err := keyFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read identity file: %w", err)
+			}
+			parsed, err := parseAgeIdentities(data)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse identity file %s: %w", file, err)
+			}
+			identities = append(identities, parsed...)
+		}
+	}
+
+	if a.identitiesSecret != "" {
+		data, err := readKeySecret(a.identitiesSecret)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range data {
+			parsed, err := parseAgeIdentities(value)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse identity %s of secret %s: %w", key, a.identitiesSecret, err)
+			}
+			identities = append(identities, parsed...)
+		}
+	}
+
+	return identities, nil
+}
+
+// parseAgeIdentities parses an age key file, or a PEM encoded SSH private
+// key.
+func parseAgeIdentities(data []byte) ([]age.Identity, error) {
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		identity, err := agessh.ParseIdentity(data)
+		if err != nil {
+			return nil, err
+		}
+		return []age.Identity{identity}, nil
+	}
+	return age.ParseIdentities(bytes.NewReader(data))
+}
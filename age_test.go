@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/ssh"
+)
+
+// ageKeyPair returns a recipient and the matching identity file content.
+type ageKeyPair func(t *testing.T) (string, []byte)
+
+func x25519KeyPair(t *testing.T) (string, []byte) {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity.Recipient().String(), []byte(identity.String() + "\n")
+}
+
+func sshEd25519KeyPair(t *testing.T) (string, []byte) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPublic, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(private, "backup@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPublic))) + " backup@example.com"
+	return recipient, pem.EncodeToMemory(block)
+}
+
+// newTestAgeClient configures a client encrypting to recipient and
+// decrypting with identity.
+func newTestAgeClient(t *testing.T, recipient string, identity []byte) *AgeClient {
+	t.Helper()
+	setConfig(t, map[string]interface{}{
+		"age.recipients":       []string{recipient},
+		"age.identities_files": []string{writeFile(t, filepath.Join(t.TempDir(), "identity"), identity)},
+	})
+	return NewAgeClient()
+}
+
+func ageDecrypt(a Encryptor, ciphertext []byte) ([]byte, error) {
+	r, err := a.DecryptStream(context.Background(), bytes.NewReader(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := io.ReadAll(r)
+	if closeErr := r.Close(); err == nil {
+		err = closeErr
+	}
+	return plaintext, err
+}
+
+func ageEncrypt(t *testing.T, a Encryptor, plaintext []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := a.EncryptStream(context.Background(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestAgeRoundTripAndWrongIdentity(t *testing.T) {
+	plaintext := make([]byte, 200000)
+	rand.Read(plaintext)
+
+	for name, generate := range map[string]ageKeyPair{"x25519": x25519KeyPair, "ssh-ed25519": sshEd25519KeyPair} {
+		t.Run(name, func(t *testing.T) {
+			recipient, identity := generate(t)
+			a := newTestAgeClient(t, recipient, identity)
+
+			recipients, err := a.Recipients()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(recipients) != 1 || strings.Contains(recipients[0], "backup@example.com") {
+				t.Fatalf("recorded recipients %v", recipients)
+			}
+
+			ciphertext := ageEncrypt(t, a, plaintext)
+			decrypted, err := ageDecrypt(a, ciphertext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Fatal("decrypted data differs")
+			}
+
+			otherRecipient, otherIdentity := generate(t)
+			if _, err := ageDecrypt(newTestAgeClient(t, otherRecipient, otherIdentity), ciphertext); err == nil {
+				t.Fatal("decrypted with another identity")
+			}
+
+			if _, err := ageDecrypt(a, ciphertext[:len(ciphertext)-1]); err == nil {
+				t.Fatal("truncated file decrypted without error")
+			}
+		})
+	}
+}
+
+func TestRestoreSelectsAgeFromMetadata(t *testing.T) {
+	recipient, identity := x25519KeyPair(t)
+	ciphertext := ageEncrypt(t, newTestAgeClient(t, recipient, identity), []byte("backup data"))
+
+	// The configured provider and the object name do not point to age,
+	// only the metadata recorded with the backup does.
+	setConfig(t, map[string]interface{}{"encryption.provider": encryptionProviderGPG})
+	rs := &RestoreService{decryptors: make(map[string]Encryptor)}
+	link := BackupChainLink{
+		ObjectName: "production/data-2026-10-01T02-00-00Z.rbd.gz",
+		Metadata:   BackupMetadata{Encryption: encryptionProviderAge},
+	}
+
+	decryptor, err := rs.decryptor(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := decryptor.(*AgeClient); !ok {
+		t.Fatalf("selected %T", decryptor)
+	}
+	plaintext, err := ageDecrypt(decryptor, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "backup data" {
+		t.Fatalf("got %q", plaintext)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// PVC annotations that let application teams control their backups without
+// touching the tool's configuration.
+const (
+	annotationPrefix    = "backup.ethdevops.io/"
+	annotationEnabled   = annotationPrefix + "enabled"
+	annotationSchedule  = annotationPrefix + "schedule"
+	annotationRetention = annotationPrefix + "retention"
+
+	// Backup hooks, set on the PVC or on a pod mounting it. Annotations of
+	// the pod take precedence over those of the PVC.
+	annotationPreHook       = annotationPrefix + "pre-hook"
+	annotationPostHook      = annotationPrefix + "post-hook"
+	annotationHookContainer = annotationPrefix + "hook-container"
+	annotationHookTimeout   = annotationPrefix + "hook-timeout"
+	annotationHookOnError   = annotationPrefix + "hook-on-error"
+
+	// annotationRestoredFrom is set by restore on PVCs it creates.
+	annotationRestoredFrom = annotationPrefix + "restored-from"
+
+	// annotationRestoreReplicas records the replicas of a workload scaled
+	// down by an in-place restore, so it can be scaled up by hand should the
+	// restore be interrupted.
+	annotationRestoreReplicas = annotationPrefix + "restore-replicas"
+)
+
+// backupEnabled reports whether pvc should be backed up. PVCs are included
+// unless annotated with enabled "false", or, when requireOptIn is set, only
+// if annotated with enabled "true".
+func backupEnabled(pvc corev1.PersistentVolumeClaim, requireOptIn bool) (bool, error) {
+	value, ok := pvc.Annotations[annotationEnabled]
+	if !ok {
+		return !requireOptIn, nil
+	}
+
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s annotation %q: %w", annotationEnabled, value, err)
+	}
+	return enabled, nil
+}
+
+// parseSchedule turns a schedule annotation into the minimum interval
+// between two backups of the PVC. It accepts @hourly, @daily, @weekly,
+// @monthly or a Go duration such as "12h".
+func parseSchedule(value string) (time.Duration, error) {
+	switch strings.TrimSpace(value) {
+	case "@hourly":
+		return time.Hour, nil
+	case "@daily":
+		return 24 * time.Hour, nil
+	case "@weekly":
+		return 7 * 24 * time.Hour, nil
+	case "@monthly":
+		return 30 * 24 * time.Hour, nil
+	}
+
+	interval, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s annotation %q: expected @hourly, @daily, @weekly, @monthly or a duration", annotationSchedule, value)
+	}
+	if interval <= 0 {
+		return 0, fmt.Errorf("invalid %s annotation %q: interval must be positive", annotationSchedule, value)
+	}
+	return interval, nil
+}
+
+// RetentionPolicy describes how many backups of a PVC to keep per period.
+// Zero values leave that rule unset.
+type RetentionPolicy struct {
+	KeepLast    int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	KeepYearly  int
+}
+
+func (p RetentionPolicy) IsZero() bool {
+	return p == RetentionPolicy{}
+}
+
+// String formats the policy in the same form parseRetentionPolicy accepts.
+func (p RetentionPolicy) String() string {
+	var parts []string
+	for _, rule := range []struct {
+		key   string
+		value int
+	}{
+		{"keep-last", p.KeepLast},
+		{"keep-daily", p.KeepDaily},
+		{"keep-weekly", p.KeepWeekly},
+		{"keep-monthly", p.KeepMonthly},
+		{"keep-yearly", p.KeepYearly},
+	} {
+		if rule.value > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", rule.key, rule.value))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseRetentionPolicy parses a comma separated list of rules such as
+// "keep-last=3,keep-daily=7,keep-weekly=4".
+func parseRetentionPolicy(value string) (RetentionPolicy, error) {
+	var policy RetentionPolicy
+
+	for _, rule := range strings.Split(value, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		key, rawCount, ok := strings.Cut(rule, "=")
+		if !ok {
+			return RetentionPolicy{}, fmt.Errorf("invalid retention rule %q: expected key=count", rule)
+		}
+
+		count, err := strconv.Atoi(strings.TrimSpace(rawCount))
+		if err != nil || count < 0 {
+			return RetentionPolicy{}, fmt.Errorf("invalid retention rule %q: count must be a non-negative integer", rule)
+		}
+
+		switch strings.TrimSpace(key) {
+		case "keep-last":
+			policy.KeepLast = count
+		case "keep-daily":
+			policy.KeepDaily = count
+		case "keep-weekly":
+			policy.KeepWeekly = count
+		case "keep-monthly":
+			policy.KeepMonthly = count
+		case "keep-yearly":
+			policy.KeepYearly = count
+		default:
+			return RetentionPolicy{}, fmt.Errorf("unknown retention rule %q", key)
+		}
+	}
+
+	return policy, nil
+}
@@ -2,56 +2,279 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
 )
 
+// CephImage is a volume to back up. For CephFS volumes Pool holds the
+// filesystem name and ImageName the subvolume.
 type CephImage struct {
 	Pool      string
 	ImageName string
+	Namespace string
 	PVCName   string
 	PVName    string
+
+	// VolumeType is volumeTypeRBD or volumeTypeCephFS. SubvolumeGroup and
+	// SubvolumePath are only set for CephFS.
+	VolumeType     string
+	SubvolumeGroup string
+	SubvolumePath  string
+
+	// RadosNamespace is the RADOS namespace of an RBD image, if any.
+	// In-tree RBD volumes connect to the cluster named by Connection.
+	RadosNamespace string
+	InTree         bool
+	Connection     cephConnection
+
+	StorageClass string
+	ClusterID    string
+
+	// Capacity, AccessModes and VolumeMode describe the PVC so restores can
+	// recreate an equivalent one.
+	Capacity    string
+	AccessModes []string
+	VolumeMode  string
+
+	// pvc and pv are the objects the volume was found through. Their
+	// sanitized copies are stored with the backup, see captureResources.
+	pvc *corev1.PersistentVolumeClaim
+	pv  *corev1.PersistentVolume
+
+	// Schedule, Retention and Hooks come from the PVC's backup annotations.
+	Schedule  time.Duration
+	Retention RetentionPolicy
+	Hooks     backupHooks
+}
+
+// Stages of a backup, used to attribute failures. stageSetup is the stage of
+// runs that fail before backing up any PVC.
+const (
+	stageSetup    = "setup"
+	stageHook     = "hook"
+	stageSnapshot = "snapshot"
+	stageExport   = "export"
+	stageCompress = "compress"
+	stageEncrypt  = "encrypt"
+	stageUpload   = "upload"
+)
+
+// stageError marks the stage of a backup that an error originated in.
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+func stageFailed(stage string, err error) error {
+	return &stageError{stage: stage, err: err}
+}
+
+// failedStage returns the stage err originated in, or "other".
+func failedStage(err error) string {
+	var se *stageError
+	if errors.As(err, &se) {
+		return se.stage
+	}
+	return "other"
 }
 
 type BackupService struct {
-	k8sClient   kubernetes.Interface
-	cephClient  *CephClient
-	minioClient *MinioClient
-	gpgClient   *GPGClient
+	restConfig    *rest.Config
+	k8sClient     kubernetes.Interface
+	dynamicClient dynamic.Interface
+	selector      string
+	requireOptIn  bool
+
+	// rbdDrivers and cephFSDrivers are the CSI driver names of ceph-csi.
+	rbdDrivers    []string
+	cephFSDrivers []string
+
+	allNamespaces   bool
+	namespaceFilter namespaceFilter
+	cephClient      *CephClient
+	minioClient     *MinioClient
+	encryptor       Encryptor
+	streaming       bool
+
+	// signer signs every backup object when signing.private_key is set.
+	signer *Signer
+
+	snapshots             bool
+	snapshotMethod        string
+	keepSnapshots         int
+	volumeSnapshotClass   string
+	volumeSnapshotTimeout time.Duration
+
+	incremental    bool
+	fullInterval   time.Duration
+	maxChainLength int
+
+	// hookDefaults holds the hook timeout and failure policy used unless
+	// annotations set them.
+	hookDefaults backupHooks
+
+	// pruner applies retention after each successful backup when
+	// backup.prune is set.
+	pruner *Pruner
+
+	// storageClasses caches the StorageClasses read during a run.
+	storageClasses *storageClassCache
+
+	concurrency int
+	limiter     *stageLimiter
+	logger      *log.Entry
 }
 
-func NewBackupService() *BackupService {
+// NewBackupService creates a service from the configuration. Errors are
+// returned rather than fatal, so the daemon survives a broken configuration
+// until it is fixed.
+func NewBackupService() (*BackupService, error) {
+	restConfig, err := createK8sConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+
 	k8sClient, err := createK8sClient()
 	if err != nil {
-		log.Fatal("Failed to create Kubernetes client:", err)
+		return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+
+	dynamicClient, err := createDynamicClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kubernetes dynamic client: %w", err)
+	}
+
+	snapshotMethod := viper.GetString("backup.snapshots.method")
+	if snapshotMethod == "" {
+		snapshotMethod = snapshotMethodRBD
+	}
+	if snapshotMethod != snapshotMethodRBD && snapshotMethod != snapshotMethodVolumeSnapshot {
+		return nil, fmt.Errorf("unknown backup.snapshots.method %q (expected %q or %q)", snapshotMethod, snapshotMethodRBD, snapshotMethodVolumeSnapshot)
 	}
 
-	return &BackupService{
-		k8sClient:   k8sClient,
+	hookTimeout := viper.GetDuration("backup.hooks.timeout")
+	if hookTimeout <= 0 {
+		hookTimeout = time.Minute
+	}
+	hookOnError := viper.GetString("backup.hooks.on_error")
+	if hookOnError == "" {
+		hookOnError = hookOnErrorAbort
+	}
+	if hookOnError != hookOnErrorAbort && hookOnError != hookOnErrorContinue {
+		return nil, fmt.Errorf("unknown backup.hooks.on_error %q (expected %q or %q)", hookOnError, hookOnErrorAbort, hookOnErrorContinue)
+	}
+
+	keepSnapshots := viper.GetInt("backup.snapshots.keep")
+	if keepSnapshots < 0 {
+		return nil, fmt.Errorf("invalid backup.snapshots.keep %d, it must not be negative", keepSnapshots)
+	}
+
+	encryptor, err := NewEncryptor("")
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption.provider: %w", err)
+	}
+
+	var signer *Signer
+	if viper.GetString("signing.private_key") != "" {
+		if signer, err = NewSigner(); err != nil {
+			return nil, fmt.Errorf("invalid signing key: %w", err)
+		}
+	}
+
+	minioClient, err := newMinioClient()
+	if err != nil {
+		return nil, err
+	}
+
+	bs := &BackupService{
+		restConfig:    restConfig,
+		k8sClient:     k8sClient,
+		dynamicClient: dynamicClient,
+		selector:      viper.GetString("selector"),
+		requireOptIn:  viper.GetBool("backup.require_opt_in"),
+
+		rbdDrivers:    csiDrivers("ceph.rbd_drivers", "rbd.csi.ceph.com"),
+		cephFSDrivers: csiDrivers("ceph.cephfs_drivers", "cephfs.csi.ceph.com"),
+
+		allNamespaces: viper.GetBool("all_namespaces"),
+		namespaceFilter: namespaceFilter{
+			include: viper.GetStringSlice("namespaces.include"),
+			exclude: viper.GetStringSlice("namespaces.exclude"),
+		},
 		cephClient:  NewCephClient(),
-		minioClient: NewMinioClient(),
-		gpgClient:   NewGPGClient(),
+		minioClient: minioClient,
+		encryptor:   encryptor,
+		streaming:   viper.GetBool("backup.streaming"),
+		signer:      signer,
+
+		snapshots:             !viper.IsSet("backup.snapshots.enabled") || viper.GetBool("backup.snapshots.enabled"),
+		snapshotMethod:        snapshotMethod,
+		keepSnapshots:         keepSnapshots,
+		volumeSnapshotClass:   viper.GetString("backup.snapshots.volume_snapshot_class"),
+		volumeSnapshotTimeout: viper.GetDuration("backup.snapshots.ready_timeout"),
+
+		incremental:    viper.GetBool("backup.incremental.enabled"),
+		fullInterval:   viper.GetDuration("backup.incremental.full_interval"),
+		maxChainLength: viper.GetInt("backup.incremental.max_chain_length"),
+
+		hookDefaults: backupHooks{timeout: hookTimeout, onError: hookOnError},
+
+		concurrency: viper.GetInt("backup.concurrency"),
+		limiter: newStageLimiter(
+			viper.GetInt("backup.limits.exports"),
+			viper.GetInt("backup.limits.compressions"),
+			viper.GetInt("backup.limits.uploads"),
+			viper.GetInt("backup.limits.per_pool"),
+		),
+		logger: log.NewEntry(log.StandardLogger()),
 	}
-}
 
-func createK8sClient() (kubernetes.Interface, error) {
-	var config *rest.Config
-	var err error
+	if viper.GetBool("backup.prune") {
+		pruner, err := NewPruner(bs.minioClient, false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention policy: %w", err)
+		}
+		bs.pruner = pruner
+	}
 
-	config, err = rest.InClusterConfig()
+	if bs.incremental && (!bs.snapshots || bs.snapshotMethod != snapshotMethodRBD) {
+		log.Warn("Incremental backups need RBD snapshots, taking full backups only")
+	}
+
+	return bs, nil
+}
+
+func createK8sConfig() (*rest.Config, error) {
+	config, err := rest.InClusterConfig()
 	if err != nil {
 		log.Debug("Not running in cluster, trying kubeconfig")
-		
+
 		kubeconfig := filepath.Join(homedir.HomeDir(), ".kube", "config")
 		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
 		if err != nil {
@@ -59,6 +282,15 @@ func createK8sClient() (kubernetes.Interface, error) {
 		}
 	}
 
+	return config, nil
+}
+
+func createK8sClient() (kubernetes.Interface, error) {
+	config, err := createK8sConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create k8s client: %w", err)
@@ -67,31 +299,74 @@ func createK8sClient() (kubernetes.Interface, error) {
 	return clientset, nil
 }
 
-func (bs *BackupService) Run(namespace string) error {
-	log.Infof("Starting backup for namespace: %s", namespace)
+// createDynamicClient returns a client for resources without typed clients
+// in client-go, such as snapshot.storage.k8s.io VolumeSnapshots.
+func createDynamicClient() (dynamic.Interface, error) {
+	config, err := createK8sConfig()
+	if err != nil {
+		return nil, err
+	}
 
-	pvcs, err := bs.listPVCs(namespace)
+	client, err := dynamic.NewForConfig(config)
 	if err != nil {
-		return fmt.Errorf("failed to list PVCs: %w", err)
+		return nil, fmt.Errorf("failed to create k8s dynamic client: %w", err)
 	}
 
-	log.Infof("Found %d PVCs in namespace %s", len(pvcs.Items), namespace)
+	return client, nil
+}
+
+// Run backs up all selected PVCs and returns a summary with one result per
+// PVC considered. The error is a *BackupFailedError if any backup failed,
+// or a plain error if the run could not start at all.
+func (bs *BackupService) Run(namespaces []string) (*RunSummary, error) {
+	summary := &RunSummary{Started: time.Now().UTC()}
+	defer func() {
+		summary.Finished = time.Now().UTC()
+	}()
+	bs.storageClasses = newStorageClassCache(bs.k8sClient)
+
+	pvcs, err := bs.collectPVCs(namespaces)
+	if err != nil {
+		return summary, fmt.Errorf("failed to list PVCs: %w", err)
+	}
 
 	var cephImages []CephImage
-	for _, pvc := range pvcs.Items {
+	for _, pvc := range pvcs {
 		if pvc.Status.Phase != corev1.ClaimBound {
-			log.Warnf("Skipping PVC %s: not bound", pvc.Name)
+			log.Warnf("Skipping PVC %s/%s: not bound", pvc.Namespace, pvc.Name)
 			continue
 		}
 
 		if pvc.Spec.VolumeName == "" {
-			log.Warnf("Skipping PVC %s: no volume name", pvc.Name)
+			log.Warnf("Skipping PVC %s/%s: no volume name", pvc.Namespace, pvc.Name)
+			continue
+		}
+
+		enabled, err := backupEnabled(pvc, bs.requireOptIn)
+		if err != nil {
+			log.Errorf("Skipping PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+			summary.Results = append(summary.Results, BackupResult{
+				Namespace: pvc.Namespace,
+				PVC:       pvc.Name,
+				Status:    resultFailed,
+				Error:     err.Error(),
+			})
+			continue
+		}
+		if !enabled {
+			log.Infof("Skipping PVC %s/%s: backups disabled by annotation", pvc.Namespace, pvc.Name)
 			continue
 		}
 
 		cephImage, err := bs.extractCephInfo(pvc)
 		if err != nil {
-			log.Errorf("Failed to extract CEPH info for PVC %s: %v", pvc.Name, err)
+			log.Errorf("Failed to extract CEPH info for PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+			summary.Results = append(summary.Results, BackupResult{
+				Namespace: pvc.Namespace,
+				PVC:       pvc.Name,
+				Status:    resultFailed,
+				Error:     fmt.Sprintf("failed to extract CEPH info: %v", err),
+			})
 			continue
 		}
 
@@ -102,23 +377,147 @@ func (bs *BackupService) Run(namespace string) error {
 
 	log.Infof("Found %d CEPH-backed PVCs to backup", len(cephImages))
 
-	for _, image := range cephImages {
-		if err := bs.backupImage(image); err != nil {
-			log.Errorf("Failed to backup image %s/%s: %v", image.Pool, image.ImageName, err)
-			continue
+	workers := bs.concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > 1 {
+		log.Infof("Backing up with %d parallel workers", workers)
+	}
+
+	// Each worker writes only its own slots, so results keep the order of
+	// cephImages regardless of which backup finishes first.
+	results := make([]BackupResult, len(cephImages))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = bs.forImage(cephImages[i]).runImage(cephImages[i])
+			}
+		}()
+	}
+
+	for i := range cephImages {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	summary.Results = append(summary.Results, results...)
+
+	return summary, summary.Err()
+}
+
+// collectPVCs lists the PVCs of all namespaces selected for this run. With
+// --all-namespaces a single cluster-wide list is filtered by the namespace
+// globs; otherwise each given namespace is listed on its own.
+func (bs *BackupService) collectPVCs(namespaces []string) ([]corev1.PersistentVolumeClaim, error) {
+	if bs.selector != "" {
+		log.Infof("Selecting PVCs matching %q", bs.selector)
+	}
+
+	if bs.allNamespaces {
+		log.Info("Starting backup for all namespaces")
+		namespaces = []string{metav1.NamespaceAll}
+	} else {
+		log.Infof("Starting backup for namespaces: %s", strings.Join(namespaces, ", "))
+	}
+
+	var pvcs []corev1.PersistentVolumeClaim
+	for _, namespace := range namespaces {
+		list, err := bs.listPVCs(namespace)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pvc := range list.Items {
+			if !bs.namespaceFilter.matches(pvc.Namespace) {
+				log.Debugf("Skipping PVC %s/%s: namespace excluded", pvc.Namespace, pvc.Name)
+				continue
+			}
+			pvcs = append(pvcs, pvc)
 		}
 	}
 
-	return nil
+	log.Infof("Found %d PVCs", len(pvcs))
+	return pvcs, nil
 }
 
 func (bs *BackupService) listPVCs(namespace string) (*corev1.PersistentVolumeClaimList, error) {
 	return bs.k8sClient.CoreV1().PersistentVolumeClaims(namespace).List(
-		context.TODO(), 
-		metav1.ListOptions{},
+		context.TODO(),
+		metav1.ListOptions{LabelSelector: bs.selector},
 	)
 }
 
+// podsUsingPVC returns the pods of namespace that mount the PVC and have not
+// terminated.
+func podsUsingPVC(ctx context.Context, k8sClient kubernetes.Interface, namespace, pvcName string) ([]corev1.Pod, error) {
+	pods, err := k8sClient.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods in namespace %s: %w", namespace, err)
+	}
+
+	var using []corev1.Pod
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == pvcName {
+				using = append(using, pod)
+				break
+			}
+		}
+	}
+
+	return using, nil
+}
+
+// backupDue reports whether the newest backup of image is older than the
+// interval from its schedule annotation. Lookup failures count as due, so a
+// broken listing never silently stops backups.
+func (bs *BackupService) backupDue(image CephImage) bool {
+	last, err := bs.lastBackupTime(image)
+	if err != nil {
+		bs.logger.Warnf("Failed to look up previous backups of PVC %s, backing up anyway: %v", image.PVCName, err)
+		return true
+	}
+
+	if next := last.Add(image.Schedule); !last.IsZero() && time.Now().Before(next) {
+		bs.logger.Infof("Skipping PVC %s: last backup at %s, next due at %s", image.PVCName,
+			last.Format(time.RFC3339), next.Format(time.RFC3339))
+		return false
+	}
+
+	return true
+}
+
+// lastBackupTime returns the time of the newest backup object of the PVC, or
+// the zero time if there is none.
+func (bs *BackupService) lastBackupTime(image CephImage) (time.Time, error) {
+	var last time.Time
+	for _, keyNamespace := range backupKeyNamespaces(image.Namespace) {
+		objects, err := bs.minioClient.ListObjects(backupObjectPrefix(keyNamespace, image.PVCName))
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		for _, object := range objects {
+			parsed, ok := parseBackupObjectName(object)
+			if ok && parsed.Namespace == keyNamespace && parsed.PVCName == image.PVCName && parsed.Time.After(last) {
+				last = parsed.Time
+			}
+		}
+	}
+
+	return last, nil
+}
+
 func (bs *BackupService) extractCephInfo(pvc corev1.PersistentVolumeClaim) (*CephImage, error) {
 	pv, err := bs.k8sClient.CoreV1().PersistentVolumes().Get(
 		context.TODO(), 
@@ -129,77 +528,544 @@ func (bs *BackupService) extractCephInfo(pvc corev1.PersistentVolumeClaim) (*Cep
 		return nil, fmt.Errorf("failed to get PV %s: %w", pvc.Spec.VolumeName, err)
 	}
 
-	if pv.Spec.CSI == nil {
-		log.Debugf("PVC %s: not a CSI volume", pvc.Name)
+	if pv.Spec.CSI == nil && pv.Spec.RBD == nil {
+		log.Debugf("PVC %s: not a CSI or RBD volume", pvc.Name)
 		return nil, nil
 	}
 
-	if !strings.Contains(pv.Spec.CSI.Driver, "ceph") {
+	image := &CephImage{
+		Namespace: pvc.Namespace,
+		PVCName:   pvc.Name,
+		PVName:    pv.Name,
+	}
+
+	switch {
+	case pv.Spec.RBD != nil || containsString(bs.rbdDrivers, pv.Spec.CSI.Driver):
+		volume, err := rbdVolumeOfPV(pv, bs.cephClient.PoolName)
+		if err != nil {
+			return nil, err
+		}
+		image.VolumeType = volumeTypeRBD
+		image.ClusterID = volume.ClusterID
+		image.Pool = volume.Pool
+		image.RadosNamespace = volume.RadosNamespace
+		image.ImageName = volume.Image
+		image.InTree = volume.InTree
+		image.Connection = volume.Connection
+	case containsString(bs.cephFSDrivers, pv.Spec.CSI.Driver):
+		volume, err := cephFSVolumeOfPV(pv)
+		if err != nil {
+			return nil, err
+		}
+		image.VolumeType = volumeTypeCephFS
+		image.ClusterID = pv.Spec.CSI.VolumeAttributes["clusterID"]
+		image.Pool = volume.FSName
+		image.ImageName = volume.Subvolume
+		image.SubvolumeGroup = volume.Group
+		image.SubvolumePath = volume.SubvolumePath
+	default:
 		log.Debugf("PVC %s: not a CEPH CSI volume (driver: %s)", pvc.Name, pv.Spec.CSI.Driver)
 		return nil, nil
 	}
 
-	volumeAttributes := pv.Spec.CSI.VolumeAttributes
-	if volumeAttributes == nil {
-		return nil, fmt.Errorf("no volume attributes found in PV %s", pv.Name)
+	var schedule time.Duration
+	if value, ok := pvc.Annotations[annotationSchedule]; ok {
+		schedule, err = parseSchedule(value)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	pool, ok := volumeAttributes["pool"]
-	if !ok {
-		return nil, fmt.Errorf("pool not found in volume attributes for PV %s", pv.Name)
+	var retention RetentionPolicy
+	if value, ok := pvc.Annotations[annotationRetention]; ok {
+		retention, err = parseRetentionPolicy(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %w", annotationRetention, err)
+		}
 	}
 
-	imageName, ok := volumeAttributes["imageName"]
-	if !ok {
-		return nil, fmt.Errorf("imageName not found in volume attributes for PV %s", pv.Name)
+	hooks, err := parseBackupHooks(pvc.Annotations, bs.hookDefaults)
+	if err != nil {
+		return nil, err
 	}
 
-	log.Infof("Found CEPH image: pool=%s, image=%s for PVC %s", pool, imageName, pvc.Name)
+	if image.VolumeType == volumeTypeCephFS {
+		log.Infof("Found CephFS subvolume: fs=%s, subvolume=%s/%s for PVC %s", image.Pool, image.SubvolumeGroup, image.ImageName, pvc.Name)
+	} else {
+		log.Infof("Found CEPH image: pool=%s, image=%s for PVC %s", image.rbdPool(), image.ImageName, pvc.Name)
+	}
 
-	return &CephImage{
-		Pool:      pool,
-		ImageName: imageName,
-		PVCName:   pvc.Name,
-		PVName:    pv.Name,
-	}, nil
+	image.StorageClass = pv.Spec.StorageClassName
+
+	image.Capacity = pvcCapacity(pvc, pv)
+	image.AccessModes = pvcAccessModes(pvc)
+	image.VolumeMode = pvcVolumeMode(pvc)
+
+	image.pvc = pvc.DeepCopy()
+	image.pv = pv
+
+	image.Schedule = schedule
+	image.Retention = retention
+	image.Hooks = hooks
+
+	return image, nil
+}
+
+// describe names the image for log and error messages.
+func (i CephImage) describe() string {
+	if i.VolumeType == volumeTypeCephFS {
+		return fmt.Sprintf("CephFS subvolume %s/%s/%s", i.Pool, i.SubvolumeGroup, i.ImageName)
+	}
+	return "RBD image " + imageSpec(i.rbdPool(), i.ImageName, "")
+}
+
+// rbdPool returns the pool of an RBD image as passed to rbd, including its
+// RADOS namespace.
+func (i CephImage) rbdPool() string {
+	return poolSpec(i.Pool, i.RadosNamespace)
+}
+
+// cephFSVolume returns the subvolume of a CephFS image.
+func (i CephImage) cephFSVolume() CephFSVolume {
+	return CephFSVolume{
+		FSName:        i.Pool,
+		Group:         i.SubvolumeGroup,
+		Subvolume:     i.ImageName,
+		SubvolumePath: i.SubvolumePath,
+	}
+}
+
+// pvcCapacity returns the provisioned size of the volume, or the requested
+// size if the PV does not report one.
+func pvcCapacity(pvc corev1.PersistentVolumeClaim, pv *corev1.PersistentVolume) string {
+	if capacity, ok := pv.Spec.Capacity[corev1.ResourceStorage]; ok {
+		return capacity.String()
+	}
+	if request, ok := pvc.Spec.Resources.Requests[corev1.ResourceStorage]; ok {
+		return request.String()
+	}
+	return ""
+}
+
+func pvcAccessModes(pvc corev1.PersistentVolumeClaim) []string {
+	var modes []string
+	for _, mode := range pvc.Spec.AccessModes {
+		modes = append(modes, string(mode))
+	}
+	return modes
+}
+
+func pvcVolumeMode(pvc corev1.PersistentVolumeClaim) string {
+	if pvc.Spec.VolumeMode == nil {
+		return ""
+	}
+	return string(*pvc.Spec.VolumeMode)
+}
+
+// forImage returns a copy of the service whose log output and clients are
+// prefixed with the image's namespace and PVC, for use by one worker.
+func (bs *BackupService) forImage(image CephImage) *BackupService {
+	prefix := image.Namespace + "/" + image.PVCName
+
+	worker := *bs
+	worker.logger = log.WithField(logPrefixField, prefix)
+	worker.cephClient = bs.cephClient.WithPrefix(prefix)
+	worker.minioClient = bs.minioClient.WithPrefix(prefix)
+	worker.encryptor = bs.encryptor.WithPrefix(prefix)
+	return &worker
+}
+
+// runImage backs up image unless its schedule says it is not due yet.
+func (bs *BackupService) runImage(image CephImage) BackupResult {
+	result := BackupResult{
+		Namespace: image.Namespace,
+		PVC:       image.PVCName,
+		Pool:      image.Pool,
+		Image:     image.ImageName,
+	}
+
+	if image.Schedule > 0 && !bs.backupDue(image) {
+		result.Status = resultSkipped
+		result.LastSuccess = bs.previousSuccess(image)
+		return result
+	}
+
+	started := time.Now()
+	err := bs.backupImage(image, &result)
+	result.Duration = time.Since(started)
+
+	if err != nil {
+		bs.logger.Errorf("Failed to backup image %s/%s: %v", image.Pool, image.ImageName, err)
+		result.Status = resultFailed
+		result.Stage = failedStage(err)
+		result.Error = err.Error()
+		result.LastSuccess = bs.previousSuccess(image)
+	} else {
+		result.Status = resultSucceeded
+		result.LastSuccess = started
+
+		if bs.pruner != nil {
+			bs.pruneBackups(image)
+		}
+	}
+
+	return result
+}
+
+// previousSuccess returns the time of the newest existing backup of the PVC
+// so that metrics keep reporting it when this run did not back the PVC up.
+func (bs *BackupService) previousSuccess(image CephImage) time.Time {
+	last, err := bs.lastBackupTime(image)
+	if err != nil {
+		bs.logger.Warnf("Failed to look up previous backups of PVC %s: %v", image.PVCName, err)
+	}
+	return last
+}
+
+// backupImage backs up a single image and records the object name, backup
+// type and transferred sizes in result. A manifest describing the backup is
+// uploaded next to the data.
+func (bs *BackupService) backupImage(image CephImage, result *BackupResult) error {
+	bs.logger.Infof("Starting backup for image %s/%s (PVC: %s)", image.Pool, image.ImageName, image.PVCName)
+
+	if image.InTree {
+		disconnect, err := bs.connect(image)
+		if err != nil {
+			return stageFailed(stageSnapshot, err)
+		}
+		defer disconnect()
+	}
+
+	now := time.Now().UTC()
+	isoDate := now.Format("2006-01-02T15-04-05Z")
+
+	// CephFS volumes are always snapshotted as subvolumes and in-tree RBD
+	// volumes as RBD images, whatever the snapshot method for CSI volumes.
+	var snapshot string
+	if bs.snapshots && (bs.snapshotMethod == snapshotMethodRBD || image.VolumeType == volumeTypeCephFS || image.InTree) {
+		snapshot = backupSnapshotName(isoDate)
+	}
+
+	// The parent has to be looked up before the new snapshot exists,
+	// otherwise it would be found as the newest backup snapshot.
+	metadata := bs.planBackup(image, snapshot, now)
+	metadata.Retention = image.Retention.String()
+	metadata.Encryption = bs.encryptor.Name()
+	objectName := backupObjectName(image.Namespace, image.PVCName, isoDate, image.VolumeType, metadata.Type, bs.encryptor.Suffix())
+	result.Type = metadata.Type
+	manifest := bs.newManifest(image, metadata, objectName, now)
+
+	// Providers with a data key per backup record it wrapped in the
+	// manifest, which is therefore required to restore the backup.
+	encryptor, err := encryptorForBackup(context.TODO(), bs.encryptor, manifest)
+	if err != nil {
+		return stageFailed(stageEncrypt, fmt.Errorf("failed to prepare encryption: %w", err))
+	}
+
+	// Pre hooks run right before the point-in-time copy is taken and post
+	// hooks right after it, or after the export when there is no snapshot.
+	// A VolumeSnapshot releases them once it is taken, not only once it is
+	// ready. The deferred call runs the post hooks should anything fail
+	// earlier.
+	postHooks, err := bs.runPreHooks(image)
+	if err != nil {
+		return err
+	}
+	defer postHooks()
+
+	// source is the image actually exported. It differs from image when a
+	// VolumeSnapshot provides the point-in-time copy.
+	source := image
+	switch {
+	case snapshot != "" && image.VolumeType == volumeTypeCephFS:
+		if err := bs.cephClient.CreateSubvolumeSnapshot(image.cephFSVolume(), snapshot); err != nil {
+			return stageFailed(stageSnapshot, fmt.Errorf("failed to snapshot CephFS subvolume: %w", err))
+		}
+	case snapshot != "":
+		if err := bs.cephClient.CreateSnapshot(image.rbdPool(), image.ImageName, snapshot); err != nil {
+			return stageFailed(stageSnapshot, fmt.Errorf("failed to snapshot RBD image: %w", err))
+		}
+	case bs.snapshots:
+		var hookErr error
+		snapshotPool, snapshotImage, release, err := bs.createVolumeSnapshot(image, now, func() error {
+			hookErr = postHooks()
+			return hookErr
+		})
+		if hookErr != nil {
+			return hookErr
+		}
+		if err != nil {
+			return stageFailed(stageSnapshot, fmt.Errorf("failed to snapshot PVC: %w", err))
+		}
+		defer release()
+		source.Pool = snapshotPool
+		source.ImageName = snapshotImage
+	}
+
+	if bs.snapshots {
+		if err := postHooks(); err != nil {
+			if snapshot != "" {
+				bs.pruneBackupSnapshots(image, snapshot, false)
+			}
+			return err
+		}
+	}
+
+	var signature []byte
+	var exportErr error
+	if bs.streaming {
+		signature, exportErr = bs.streamBackup(source, manifest, encryptor)
+	} else {
+		signature, exportErr = bs.fileBackup(source, manifest, encryptor)
+	}
+	result.ExportedBytes = manifest.RawSize
+	result.CompressedBytes = manifest.CompressedSize
+	result.Size = manifest.Size
+
+	err = exportErr
+	if err == nil {
+		err = postHooks()
+	}
+	if err == nil {
+		if err = bs.writeSignature(manifest, signature); err != nil {
+			err = stageFailed(stageUpload, err)
+		}
+	}
+	if err == nil {
+		if err = bs.writeResources(image, manifest); err != nil {
+			err = stageFailed(stageUpload, err)
+		}
+	}
+	if err == nil {
+		if err = bs.writeManifest(manifest); err != nil {
+			err = stageFailed(stageUpload, err)
+		}
+	}
+	if err != nil && exportErr == nil {
+		// list, restore and prune rely on the manifest, so do not leave the
+		// data behind looking like a successful backup.
+		for _, name := range []string{objectName, signatureObjectName(objectName), resourcesObjectName(objectName), signatureObjectName(manifestObjectName(objectName))} {
+			if removeErr := bs.minioClient.DeleteObject(name); removeErr != nil {
+				bs.logger.Warnf("Failed to remove %s: %v", name, removeErr)
+			}
+		}
+	}
+
+	if snapshot != "" {
+		bs.pruneBackupSnapshots(image, snapshot, err == nil)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	result.Object = objectName
+
+	bs.logger.Infof("Successfully backed up image %s/%s to %s (%s)", image.Pool, image.ImageName, objectName, metadata.Type)
+	return nil
 }
 
-func (bs *BackupService) backupImage(image CephImage) error {
-	log.Infof("Starting backup for image %s/%s (PVC: %s)", image.Pool, image.ImageName, image.PVCName)
+// fileBackup exports, compresses and encrypts the image through files in
+// backup.temp_dir before uploading the result, encrypting with encryptor.
+// It returns the signature of the uploaded object if backups are signed.
+func (bs *BackupService) fileBackup(image CephImage, manifest *BackupManifest, encryptor Encryptor) ([]byte, error) {
+	metadata := manifest.Metadata()
 
-	exportPath, err := bs.cephClient.ExportImage(image.Pool, image.ImageName)
+	var exportPath string
+	var err error
+	releaseExport := bs.limiter.acquireExport(image.Pool)
+	switch {
+	case image.VolumeType == volumeTypeCephFS:
+		exportPath, err = bs.cephClient.ArchiveSubvolume(image.cephFSVolume(), metadata.Snapshot)
+	case metadata.IsIncremental():
+		exportPath, err = bs.cephClient.ExportDiff(image.rbdPool(), image.ImageName, metadata.FromSnapshot, metadata.Snapshot)
+	default:
+		exportPath, err = bs.cephClient.ExportImage(image.rbdPool(), image.ImageName, metadata.Snapshot)
+	}
+	releaseExport()
 	if err != nil {
-		return fmt.Errorf("failed to export RBD image: %w", err)
+		return nil, stageFailed(stageExport, fmt.Errorf("failed to export %s: %w", image.describe(), err))
 	}
 	defer bs.cephClient.Cleanup(exportPath)
+	manifest.RawSize = fileSize(exportPath)
+	if manifest.RawSHA256, err = fileSHA256(exportPath); err != nil {
+		return nil, stageFailed(stageExport, fmt.Errorf("failed to checksum export: %w", err))
+	}
 
+	// Encryption is CPU bound like compression and shares its limit.
+	releaseCompress := bs.limiter.acquireCompress()
 	compressedPath, err := bs.compressFile(exportPath)
 	if err != nil {
-		return fmt.Errorf("failed to compress file: %w", err)
+		releaseCompress()
+		return nil, stageFailed(stageCompress, fmt.Errorf("failed to compress file: %w", err))
 	}
 	defer bs.cleanup(compressedPath)
+	manifest.CompressedSize = fileSize(compressedPath)
 
-	encryptedPath, err := bs.gpgClient.EncryptFile(compressedPath)
+	encryptedPath, err := encryptor.EncryptFile(compressedPath)
+	releaseCompress()
 	if err != nil {
-		return fmt.Errorf("failed to encrypt file: %w", err)
+		return nil, stageFailed(stageEncrypt, fmt.Errorf("failed to encrypt file: %w", err))
 	}
 	defer bs.cleanup(encryptedPath)
 
-	isoDate := time.Now().UTC().Format("2006-01-02T15-04-05Z")
-	objectName := fmt.Sprintf("%s-%s.rbd.gz.gpg", image.PVCName, isoDate)
-	if err := bs.minioClient.UploadFile(encryptedPath, objectName); err != nil {
-		return fmt.Errorf("failed to upload to MinIO: %w", err)
+	if manifest.SHA256, err = fileSHA256(encryptedPath); err != nil {
+		return nil, stageFailed(stageEncrypt, fmt.Errorf("failed to checksum encrypted file: %w", err))
 	}
 
-	log.Infof("Successfully backed up image %s/%s to %s", image.Pool, image.ImageName, objectName)
-	return nil
+	var signature []byte
+	if bs.signer != nil {
+		if signature, err = bs.signer.SignFile(encryptedPath, manifest.Object); err != nil {
+			return nil, stageFailed(stageEncrypt, fmt.Errorf("failed to sign encrypted file: %w", err))
+		}
+	}
+
+	releaseUpload := bs.limiter.acquireUpload()
+	size, err := bs.minioClient.UploadFile(encryptedPath, manifest.Object, metadata.UserMetadata())
+	releaseUpload()
+	if err != nil {
+		return nil, stageFailed(stageUpload, fmt.Errorf("failed to upload to MinIO: %w", err))
+	}
+	manifest.Size = size
+
+	return signature, nil
+}
+
+// streamBackup pipes rbd export through gzip and encryption straight into a
+// multipart upload, so no plaintext or intermediate file touches the disk.
+// The first failing stage cancels all others and its error is returned,
+// otherwise the signature of the upload if backups are signed.
+func (bs *BackupService) streamBackup(image CephImage, manifest *BackupManifest, encryptor Encryptor) ([]byte, error) {
+	release := bs.limiter.acquireAll(image.Pool)
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var failure firstError
+	var signature []byte
+	pr, pw := io.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var err error
+		signature, err = bs.writeBackupStream(ctx, image, manifest, encryptor, pw)
+		if err != nil {
+			failure.set(err)
+			cancel()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	size, err := bs.minioClient.UploadStream(ctx, pr, manifest.Object, manifest.Metadata().UserMetadata())
+	if err != nil {
+		failure.set(stageFailed(stageUpload, fmt.Errorf("failed to upload to MinIO: %w", err)))
+		cancel()
+		pr.CloseWithError(err)
+	}
+
+	<-done
+	if err := failure.get(); err != nil {
+		return nil, err
+	}
+	manifest.Size = size
+	return signature, nil
+}
+
+// writeBackupStream writes the compressed and encrypted export of image, or
+// the diff since the parent snapshot for incremental backups, to w,
+// encrypting with encryptor. Sizes and checksums of the raw and the written
+// stream are recorded in manifest; the signature of the written stream is
+// returned if backups are signed.
+func (bs *BackupService) writeBackupStream(ctx context.Context, image CephImage, manifest *BackupManifest, encryptor Encryptor, w io.Writer) ([]byte, error) {
+	metadata := manifest.Metadata()
+
+	var export io.ReadCloser
+	var err error
+	switch {
+	case image.VolumeType == volumeTypeCephFS:
+		export, err = bs.cephClient.ArchiveSubvolumeStream(ctx, image.cephFSVolume(), metadata.Snapshot)
+	case metadata.IsIncremental():
+		export, err = bs.cephClient.ExportDiffStream(ctx, image.rbdPool(), image.ImageName, metadata.FromSnapshot, metadata.Snapshot)
+	default:
+		export, err = bs.cephClient.ExportImageStream(ctx, image.rbdPool(), image.ImageName, metadata.Snapshot)
+	}
+	if err != nil {
+		return nil, stageFailed(stageExport, fmt.Errorf("failed to export %s: %w", image.describe(), err))
+	}
+	defer export.Close()
+
+	uploadHash := sha256.New()
+	written := io.MultiWriter(w, uploadHash)
+	var signing *signatureWriter
+	if bs.signer != nil {
+		signing = bs.signer.Start(manifest.Object)
+		defer signing.Close()
+		written = io.MultiWriter(w, uploadHash, signing)
+	}
+	encrypted, err := encryptor.EncryptStream(ctx, written)
+	if err != nil {
+		return nil, stageFailed(stageEncrypt, fmt.Errorf("failed to encrypt stream: %w", err))
+	}
+	defer encrypted.Close()
+
+	compressed := &countingWriter{w: encrypted}
+	compressor := NewCompressWriter(compressed)
+	rawHash := sha256.New()
+	source := &errorRecordingReader{r: io.TeeReader(export, rawHash)}
+
+	exported, err := io.Copy(compressor, source)
+	if err != nil {
+		// A read error comes from the export; a write error from encryption or the upload.
+		stage := stageEncrypt
+		if source.err != nil {
+			stage = stageExport
+		}
+		return nil, stageFailed(stage, fmt.Errorf("failed to stream export: %w", err))
+	}
+	manifest.RawSize = exported
+	manifest.RawSHA256 = hex.EncodeToString(rawHash.Sum(nil))
+
+	if err := export.Close(); err != nil {
+		return nil, stageFailed(stageExport, fmt.Errorf("failed to export %s: %w", image.describe(), err))
+	}
+
+	if err := compressor.Close(); err != nil {
+		return nil, stageFailed(stageCompress, fmt.Errorf("failed to compress stream: %w", err))
+	}
+	manifest.CompressedSize = compressed.n
+
+	if err := encrypted.Close(); err != nil {
+		return nil, stageFailed(stageEncrypt, fmt.Errorf("failed to encrypt stream: %w", err))
+	}
+	manifest.SHA256 = hex.EncodeToString(uploadHash.Sum(nil))
+
+	var signature []byte
+	if signing != nil {
+		if signature, err = signing.Sign(); err != nil {
+			return nil, stageFailed(stageEncrypt, fmt.Errorf("failed to sign stream: %w", err))
+		}
+	}
+
+	bs.logger.Infof("Streamed %d bytes from %s", exported, image.describe())
+	return signature, nil
 }
 
 func (bs *BackupService) compressFile(inputPath string) (string, error) {
-	log.Debug("Compressing file:", inputPath)
+	bs.logger.Debug("Compressing file:", inputPath)
 	return CompressFile(inputPath)
 }
 
+// fileSize returns the size of path, or 0 if it cannot be determined.
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
 func (bs *BackupService) cleanup(path string) {
 	if err := RemoveFile(path); err != nil {
 		log.Warnf("Failed to cleanup file %s: %v", path, err)
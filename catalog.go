@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BackupEntry describes one backup in the bucket, as shown by list and
+// searched by restore.
+type BackupEntry struct {
+	Object    string    `json:"object"`
+	Namespace string    `json:"namespace"`
+	PVC       string    `json:"pvc"`
+	Pool      string    `json:"pool,omitempty"`
+	Image     string    `json:"image,omitempty"`
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Size      int64     `json:"size_bytes"`
+	Parent    string    `json:"parent,omitempty"`
+
+	Manifest *BackupManifest `json:"-"`
+}
+
+// backupFilter narrows the backups returned by listBackups. Empty fields
+// match everything.
+type backupFilter struct {
+	namespaces []string
+	pvcs       []string
+	since      time.Time
+	before     time.Time
+}
+
+func (f backupFilter) matchesTime(t time.Time) bool {
+	if !f.since.IsZero() && t.Before(f.since) {
+		return false
+	}
+	if !f.before.IsZero() && !t.Before(f.before) {
+		return false
+	}
+	return true
+}
+
+// matchesName applies the filter to what an object name tells about the
+// source of a backup. Flat keys carry no namespace, so those are only
+// matched by namespace once the manifest is read.
+func (f backupFilter) matchesName(name BackupObjectName) bool {
+	if len(f.pvcs) > 0 && !matchAnyGlob(f.pvcs, name.PVCName) {
+		return false
+	}
+	if name.Namespace != "" && len(f.namespaces) > 0 && !matchAnyGlob(f.namespaces, name.Namespace) {
+		return false
+	}
+	return true
+}
+
+func (f backupFilter) matchesSource(namespace, pvc string) bool {
+	if len(f.namespaces) > 0 && !matchAnyGlob(f.namespaces, namespace) {
+		return false
+	}
+	if len(f.pvcs) > 0 && !matchAnyGlob(f.pvcs, pvc) {
+		return false
+	}
+	return true
+}
+
+// listBackups returns the backups under prefix that match filter, oldest
+// first. Namespace, pool and image come from the manifest; backups written
+// before manifests existed fall back to their object name and metadata.
+func listBackups(minioClient *MinioClient, prefix string, filter backupFilter) ([]BackupEntry, error) {
+	objects, err := minioClient.ListObjectsInfo(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	var entries []BackupEntry
+	for _, object := range objects {
+		name, ok := parseBackupObjectName(object.Key)
+		if !ok {
+			if !isManifestObject(object.Key) && !isResourcesObject(object.Key) && !isSignatureObject(object.Key) {
+				log.Debugf("Ignoring object %s: not a backup", object.Key)
+			}
+			continue
+		}
+
+		// Time and PVC are part of the object name, and so is the namespace
+		// of namespaced keys. Filter on them before fetching the manifest.
+		if !filter.matchesTime(name.Time) || !filter.matchesName(name) {
+			continue
+		}
+
+		entry := BackupEntry{
+			Object:    object.Key,
+			Namespace: name.Namespace,
+			PVC:       name.PVCName,
+			Time:      name.Time,
+			Type:      name.Type,
+			Size:      object.Size,
+		}
+
+		metadata, manifest, err := readBackupMetadata(minioClient, object.Key)
+		if err != nil {
+			log.Warnf("Failed to read metadata of %s: %v", object.Key, err)
+		} else {
+			entry.Type = metadata.Type
+			entry.Parent = metadata.Parent
+		}
+		if manifest != nil {
+			entry.Namespace = manifest.Namespace
+			entry.PVC = manifest.PVC
+			entry.Pool = manifest.Pool
+			entry.Image = manifest.Image
+			entry.Manifest = manifest
+		}
+
+		if !filter.matchesSource(entry.Namespace, entry.PVC) {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if !entries[i].Time.Equal(entries[j].Time) {
+			return entries[i].Time.Before(entries[j].Time)
+		}
+		return entries[i].Object < entries[j].Object
+	})
+
+	return entries, nil
+}
+
+// findBackup returns the newest backup of the PVC taken at or before at, or
+// the newest backup of all if at is zero.
+func findBackup(minioClient *MinioClient, namespace, pvcName string, at time.Time) (BackupEntry, error) {
+	filter := backupFilter{
+		namespaces: []string{namespace},
+		pvcs:       []string{pvcName},
+	}
+	if !at.IsZero() {
+		// before is exclusive, at is not.
+		filter.before = at.Add(time.Nanosecond)
+	}
+
+	entries, err := listBackups(minioClient, "", filter)
+	if err != nil {
+		return BackupEntry{}, err
+	}
+
+	if len(entries) == 0 {
+		if at.IsZero() {
+			return BackupEntry{}, fmt.Errorf("no backup of PVC %s/%s found", namespace, pvcName)
+		}
+		return BackupEntry{}, fmt.Errorf("no backup of PVC %s/%s found at or before %s", namespace, pvcName, at.Format(time.RFC3339))
+	}
+
+	return entries[len(entries)-1], nil
+}
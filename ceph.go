@@ -1,32 +1,110 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+// RBDSnapshot is one entry of "rbd snap ls --format json".
+type RBDSnapshot struct {
+	ID        uint64 `json:"id"`
+	Name      string `json:"name"`
+	Size      uint64 `json:"size"`
+	Timestamp string `json:"timestamp"`
+}
+
+// RBDImageInfo is the subset of "rbd info --format json" recorded in backup
+// manifests.
+type RBDImageInfo struct {
+	Name     string   `json:"name"`
+	Size     uint64   `json:"size"`
+	Format   int      `json:"format"`
+	Features []string `json:"features"`
+}
+
 type CephClient struct {
 	rbdPath    string
+	cephPath   string
 	configPath string
 	keyringPath string
+
+	// monitors, user and keyFile override the cluster and credentials of
+	// the config file for in-tree volumes that name their own.
+	monitors []string
+	user     string
+	keyFile  string
+
+	logger *log.Entry
+	output io.Writer
 }
 
 func NewCephClient() *CephClient {
 	return &CephClient{
 		rbdPath:     viper.GetString("ceph.rbd_path"),
+		cephPath:    viper.GetString("ceph.ceph_path"),
 		configPath:  viper.GetString("ceph.config_path"),
 		keyringPath: viper.GetString("ceph.keyring_path"),
+		logger:      log.NewEntry(log.StandardLogger()),
+		output:      os.Stderr,
+	}
+}
+
+// WithPrefix returns a copy of the client whose log messages and rbd output
+// are prefixed with prefix.
+func (c *CephClient) WithPrefix(prefix string) *CephClient {
+	prefixed := *c
+	prefixed.logger = log.WithField(logPrefixField, prefix)
+	prefixed.output = newPrefixWriter(os.Stderr, prefix)
+	return &prefixed
+}
+
+// WithConnection returns a copy of the client that connects to the monitors
+// of conn as its user, authenticating with the key in keyFile if given.
+func (c *CephClient) WithConnection(conn cephConnection, keyFile string) *CephClient {
+	connected := *c
+	connected.monitors = conn.Monitors
+	connected.user = conn.User
+	connected.keyFile = keyFile
+	return &connected
+}
+
+// connectionArgs returns the options selecting the cluster and credentials,
+// shared by all rbd and ceph commands.
+func (c *CephClient) connectionArgs() []string {
+	var args []string
+	if c.configPath != "" {
+		args = append(args, "--conf", c.configPath)
+	}
+	if c.keyringPath != "" && c.keyFile == "" {
+		args = append(args, "--keyring", c.keyringPath)
+	}
+	if len(c.monitors) > 0 {
+		args = append(args, "--mon_host", strings.Join(c.monitors, ","))
 	}
+	if c.user != "" {
+		args = append(args, "--id", c.user)
+	}
+	if c.keyFile != "" {
+		args = append(args, "--keyfile", c.keyFile)
+	}
+	return args
 }
 
-func (c *CephClient) ExportImage(pool, imageName string) (string, error) {
-	log.Infof("Exporting RBD image %s/%s", pool, imageName)
+// ExportImage exports pool/imageName, or its snapshot if snapshot is not
+// empty, to a file in backup.temp_dir and returns the file path.
+func (c *CephClient) ExportImage(pool, imageName, snapshot string) (string, error) {
+	spec := imageSpec(pool, imageName, snapshot)
+	c.logger.Infof("Exporting RBD image %s", spec)
 
 	if c.rbdPath == "" {
 		c.rbdPath = "rbd"
@@ -42,26 +120,20 @@ func (c *CephClient) ExportImage(pool, imageName string) (string, error) {
 	}
 
 	timestamp := time.Now().Format("20060102-150405")
-	exportFile := filepath.Join(exportDir, fmt.Sprintf("%s-%s-%s.rbd", pool, imageName, timestamp))
+	exportFile := filepath.Join(exportDir, fmt.Sprintf("%s-%s-%s.rbd", strings.ReplaceAll(pool, "/", "-"), imageName, timestamp))
 
 	args := []string{"export"}
 	
-	if c.configPath != "" {
-		args = append(args, "--conf", c.configPath)
-	}
-	
-	if c.keyringPath != "" {
-		args = append(args, "--keyring", c.keyringPath)
-	}
+	args = append(args, c.connectionArgs()...)
 
-	args = append(args, fmt.Sprintf("%s/%s", pool, imageName), exportFile)
+	args = append(args, spec, exportFile)
 
-	log.Debugf("Running rbd command: %s %v", c.rbdPath, args)
+	c.logger.Debugf("Running rbd command: %s %v", c.rbdPath, args)
 
 	cmd := exec.Command(c.rbdPath, args...)
 	
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = c.output
+	cmd.Stderr = c.output
 
 	if err := cmd.Run(); err != nil {
 		return "", fmt.Errorf("rbd export failed: %w", err)
@@ -72,22 +144,124 @@ func (c *CephClient) ExportImage(pool, imageName string) (string, error) {
 		return "", fmt.Errorf("failed to stat exported file: %w", err)
 	}
 
-	log.Infof("Successfully exported RBD image to %s (size: %d bytes)", exportFile, info.Size())
+	c.logger.Infof("Successfully exported RBD image to %s (size: %d bytes)", exportFile, info.Size())
+	return exportFile, nil
+}
+
+// ExportImageStream runs "rbd export <pool>/<image>[@snapshot] -" and returns
+// its stdout. Closing the returned reader waits for rbd and reports its exit
+// status.
+func (c *CephClient) ExportImageStream(ctx context.Context, pool, imageName, snapshot string) (io.ReadCloser, error) {
+	spec := imageSpec(pool, imageName, snapshot)
+	c.logger.Infof("Streaming export of RBD image %s", spec)
+
+	if c.rbdPath == "" {
+		c.rbdPath = "rbd"
+	}
+
+	args := []string{"export"}
+
+	args = append(args, c.connectionArgs()...)
+
+	args = append(args, "--no-progress", spec, "-")
+
+	c.logger.Debugf("Running rbd command: %s %v", c.rbdPath, args)
+
+	cmd := exec.CommandContext(ctx, c.rbdPath, args...)
+	cmd.Stderr = c.output
+
+	export, err := startCommandReader(cmd, "rbd export")
+	if err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
+
+// ExportDiff writes the changes between fromSnapshot and snapshot of
+// pool/imageName to a file in backup.temp_dir and returns the file path.
+func (c *CephClient) ExportDiff(pool, imageName, fromSnapshot, snapshot string) (string, error) {
+	spec := imageSpec(pool, imageName, snapshot)
+	c.logger.Infof("Exporting RBD diff of %s since %s", spec, fromSnapshot)
+
+	if c.rbdPath == "" {
+		c.rbdPath = "rbd"
+	}
+
+	exportDir := viper.GetString("backup.temp_dir")
+	if exportDir == "" {
+		exportDir = "/tmp/k8s-ceph-backup"
+	}
+
+	if err := os.MkdirAll(exportDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create export directory: %w", err)
+	}
+
+	timestamp := time.Now().Format("20060102-150405")
+	exportFile := filepath.Join(exportDir, fmt.Sprintf("%s-%s-%s.rbd-diff", strings.ReplaceAll(pool, "/", "-"), imageName, timestamp))
+
+	args := []string{"export-diff"}
+
+	args = append(args, c.connectionArgs()...)
+
+	args = append(args, "--from-snap", fromSnapshot, spec, exportFile)
+
+	c.logger.Debugf("Running rbd command: %s %v", c.rbdPath, args)
+
+	cmd := exec.Command(c.rbdPath, args...)
+
+	cmd.Stdout = c.output
+	cmd.Stderr = c.output
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("rbd export-diff failed: %w", err)
+	}
+
+	info, err := os.Stat(exportFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat exported diff: %w", err)
+	}
+
+	c.logger.Infof("Successfully exported RBD diff to %s (size: %d bytes)", exportFile, info.Size())
 	return exportFile, nil
 }
 
+// ExportDiffStream runs "rbd export-diff --from-snap <from> <spec> -" and
+// returns its stdout. Closing the returned reader waits for rbd and reports
+// its exit status.
+func (c *CephClient) ExportDiffStream(ctx context.Context, pool, imageName, fromSnapshot, snapshot string) (io.ReadCloser, error) {
+	spec := imageSpec(pool, imageName, snapshot)
+	c.logger.Infof("Streaming RBD diff of %s since %s", spec, fromSnapshot)
+
+	if c.rbdPath == "" {
+		c.rbdPath = "rbd"
+	}
+
+	args := []string{"export-diff"}
+
+	args = append(args, c.connectionArgs()...)
+
+	args = append(args, "--no-progress", "--from-snap", fromSnapshot, spec, "-")
+
+	c.logger.Debugf("Running rbd command: %s %v", c.rbdPath, args)
+
+	cmd := exec.CommandContext(ctx, c.rbdPath, args...)
+	cmd.Stderr = c.output
+
+	export, err := startCommandReader(cmd, "rbd export-diff")
+	if err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
+
 func (c *CephClient) ListImages(pool string) ([]string, error) {
-	log.Debugf("Listing images in pool %s", pool)
+	c.logger.Debugf("Listing images in pool %s", pool)
 
 	args := []string{"ls", pool}
 	
-	if c.configPath != "" {
-		args = append(args, "--conf", c.configPath)
-	}
-	
-	if c.keyringPath != "" {
-		args = append(args, "--keyring", c.keyringPath)
-	}
+	args = append(args, c.connectionArgs()...)
 
 	cmd := exec.Command(c.rbdPath, args...)
 	
@@ -96,22 +270,39 @@ func (c *CephClient) ListImages(pool string) ([]string, error) {
 		return nil, fmt.Errorf("failed to list images in pool %s: %w", pool, err)
 	}
 
-	log.Debugf("Images in pool %s: %s", pool, string(output))
+	c.logger.Debugf("Images in pool %s: %s", pool, string(output))
 	return []string{string(output)}, nil
 }
 
+// PoolName returns the name of the pool with the given ID.
+func (c *CephClient) PoolName(id int64) (string, error) {
+	output, err := c.runCephCommand("osd", "lspools", "--format", "json")
+	if err != nil {
+		return "", fmt.Errorf("failed to list pools: %w", err)
+	}
+
+	var pools []struct {
+		ID   int64  `json:"poolnum"`
+		Name string `json:"poolname"`
+	}
+	if err := json.Unmarshal(output, &pools); err != nil {
+		return "", fmt.Errorf("failed to parse pool list: %w", err)
+	}
+
+	for _, pool := range pools {
+		if pool.ID == id {
+			return pool.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no pool with ID %d", id)
+}
+
 func (c *CephClient) ImageExists(pool, imageName string) (bool, error) {
-	log.Debugf("Checking if image %s/%s exists", pool, imageName)
+	c.logger.Debugf("Checking if image %s/%s exists", pool, imageName)
 
 	args := []string{"info"}
 	
-	if c.configPath != "" {
-		args = append(args, "--conf", c.configPath)
-	}
-	
-	if c.keyringPath != "" {
-		args = append(args, "--keyring", c.keyringPath)
-	}
+	args = append(args, c.connectionArgs()...)
 
 	args = append(args, fmt.Sprintf("%s/%s", pool, imageName))
 
@@ -130,8 +321,35 @@ func (c *CephClient) ImageExists(pool, imageName string) (bool, error) {
 	return true, nil
 }
 
-func (c *CephClient) ImportImage(pool, imageName, importPath string) error {
-	log.Infof("Importing RBD image %s/%s from %s", pool, imageName, importPath)
+// creatableFeatures are the RBD image features rbd import can enable. rbd
+// info also lists features such as operations or migrating that only
+// describe the state of an image.
+var creatableFeatures = map[string]bool{
+	"layering":       true,
+	"striping":       true,
+	"exclusive-lock": true,
+	"object-map":     true,
+	"fast-diff":      true,
+	"deep-flatten":   true,
+	"journaling":     true,
+}
+
+// imageFeatureArgs returns the rbd arguments creating an image with
+// features, or none to use the cluster's defaults.
+func imageFeatureArgs(features []string) []string {
+	var args []string
+	for _, feature := range features {
+		if creatableFeatures[feature] {
+			args = append(args, "--image-feature", feature)
+		}
+	}
+	return args
+}
+
+// ImportImage imports the export at importPath as pool/imageName, created
+// with features unless there are none.
+func (c *CephClient) ImportImage(pool, imageName, importPath string, features []string) error {
+	c.logger.Infof("Importing RBD image %s/%s from %s", pool, imageName, importPath)
 
 	if c.rbdPath == "" {
 		c.rbdPath = "rbd"
@@ -139,34 +357,306 @@ func (c *CephClient) ImportImage(pool, imageName, importPath string) error {
 
 	args := []string{"import"}
 	
-	if c.configPath != "" {
-		args = append(args, "--conf", c.configPath)
-	}
-	
-	if c.keyringPath != "" {
-		args = append(args, "--keyring", c.keyringPath)
-	}
+	args = append(args, c.connectionArgs()...)
+
+	args = append(args, imageFeatureArgs(features)...)
 
 	args = append(args, importPath, fmt.Sprintf("%s/%s", pool, imageName))
 
-	log.Debugf("Running rbd import command: %s %v", c.rbdPath, args)
+	c.logger.Debugf("Running rbd import command: %s %v", c.rbdPath, args)
 
 	cmd := exec.Command(c.rbdPath, args...)
 	
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = c.output
+	cmd.Stderr = c.output
 
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("rbd import failed: %w", err)
 	}
 
-	log.Infof("Successfully imported RBD image %s/%s", pool, imageName)
+	c.logger.Infof("Successfully imported RBD image %s/%s", pool, imageName)
 	return nil
 }
 
+// ImportImageStream runs "rbd import - <pool>/<image>" and returns its stdin.
+// The image is created with features unless there are none. Closing the
+// returned writer ends the import and waits for rbd to finish.
+func (c *CephClient) ImportImageStream(ctx context.Context, pool, imageName string, features []string) (io.WriteCloser, error) {
+	c.logger.Infof("Streaming import into RBD image %s/%s", pool, imageName)
+
+	if c.rbdPath == "" {
+		c.rbdPath = "rbd"
+	}
+
+	args := []string{"import"}
+
+	args = append(args, c.connectionArgs()...)
+
+	args = append(args, imageFeatureArgs(features)...)
+
+	args = append(args, "--no-progress", "-", fmt.Sprintf("%s/%s", pool, imageName))
+
+	c.logger.Debugf("Running rbd import command: %s %v", c.rbdPath, args)
+
+	cmd := exec.CommandContext(ctx, c.rbdPath, args...)
+	cmd.Stdout = c.output
+	cmd.Stderr = c.output
+
+	importer, err := startCommandWriter(cmd, "rbd import")
+	if err != nil {
+		return nil, err
+	}
+
+	return importer, nil
+}
+
+// ImportDiff applies a diff produced by ExportDiff to pool/imageName. The
+// image must already have the diff's starting snapshot; the end snapshot is
+// created by rbd.
+func (c *CephClient) ImportDiff(pool, imageName, importPath string) error {
+	c.logger.Infof("Importing RBD diff into %s/%s from %s", pool, imageName, importPath)
+
+	if c.rbdPath == "" {
+		c.rbdPath = "rbd"
+	}
+
+	args := []string{"import-diff"}
+
+	args = append(args, c.connectionArgs()...)
+
+	args = append(args, importPath, fmt.Sprintf("%s/%s", pool, imageName))
+
+	c.logger.Debugf("Running rbd import-diff command: %s %v", c.rbdPath, args)
+
+	cmd := exec.Command(c.rbdPath, args...)
+
+	cmd.Stdout = c.output
+	cmd.Stderr = c.output
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("rbd import-diff failed: %w", err)
+	}
+
+	c.logger.Infof("Successfully imported RBD diff into %s/%s", pool, imageName)
+	return nil
+}
+
+// ImportDiffStream runs "rbd import-diff - <pool>/<image>" and returns its
+// stdin. Closing the returned writer waits for rbd to finish.
+func (c *CephClient) ImportDiffStream(ctx context.Context, pool, imageName string) (io.WriteCloser, error) {
+	c.logger.Infof("Streaming RBD diff into %s/%s", pool, imageName)
+
+	if c.rbdPath == "" {
+		c.rbdPath = "rbd"
+	}
+
+	args := []string{"import-diff"}
+
+	args = append(args, c.connectionArgs()...)
+
+	args = append(args, "--no-progress", "-", fmt.Sprintf("%s/%s", pool, imageName))
+
+	c.logger.Debugf("Running rbd import-diff command: %s %v", c.rbdPath, args)
+
+	cmd := exec.CommandContext(ctx, c.rbdPath, args...)
+	cmd.Stdout = c.output
+	cmd.Stderr = c.output
+
+	importer, err := startCommandWriter(cmd, "rbd import-diff")
+	if err != nil {
+		return nil, err
+	}
+
+	return importer, nil
+}
+
+func (c *CephClient) CreateSnapshot(pool, imageName, snapshot string) error {
+	spec := imageSpec(pool, imageName, snapshot)
+	c.logger.Infof("Creating RBD snapshot %s", spec)
+
+	if err := c.runSnapCommand("create", spec); err != nil {
+		return fmt.Errorf("rbd snap create failed: %w", err)
+	}
+
+	return nil
+}
+
+func (c *CephClient) RemoveSnapshot(pool, imageName, snapshot string) error {
+	spec := imageSpec(pool, imageName, snapshot)
+	c.logger.Infof("Removing RBD snapshot %s", spec)
+
+	if err := c.runSnapCommand("rm", "--no-progress", spec); err != nil {
+		return fmt.Errorf("rbd snap rm failed: %w", err)
+	}
+
+	return nil
+}
+
+func (c *CephClient) ListSnapshots(pool, imageName string) ([]RBDSnapshot, error) {
+	c.logger.Debugf("Listing snapshots of RBD image %s/%s", pool, imageName)
+
+	if c.rbdPath == "" {
+		c.rbdPath = "rbd"
+	}
+
+	args := []string{"snap", "ls", "--format", "json"}
+
+	args = append(args, c.connectionArgs()...)
+
+	args = append(args, imageSpec(pool, imageName, ""))
+
+	cmd := exec.Command(c.rbdPath, args...)
+	cmd.Stderr = c.output
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots of %s/%s: %w", pool, imageName, err)
+	}
+
+	var snapshots []RBDSnapshot
+	if err := json.Unmarshal(output, &snapshots); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot list of %s/%s: %w", pool, imageName, err)
+	}
+
+	return snapshots, nil
+}
+
+// RemoveImage deletes an RBD image. The image must not have snapshots.
+func (c *CephClient) RemoveImage(pool, imageName string) error {
+	c.logger.Infof("Removing RBD image %s/%s", pool, imageName)
+
+	if c.rbdPath == "" {
+		c.rbdPath = "rbd"
+	}
+
+	args := []string{"rm", "--no-progress"}
+
+	args = append(args, c.connectionArgs()...)
+
+	args = append(args, imageSpec(pool, imageName, ""))
+
+	cmd := exec.Command(c.rbdPath, args...)
+	cmd.Stdout = c.output
+	cmd.Stderr = c.output
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to remove RBD image %s/%s: %w", pool, imageName, err)
+	}
+
+	return nil
+}
+
+// RenameImage renames an RBD image within its pool.
+func (c *CephClient) RenameImage(pool, imageName, newName string) error {
+	c.logger.Infof("Renaming RBD image %s/%s to %s", pool, imageName, newName)
+
+	if c.rbdPath == "" {
+		c.rbdPath = "rbd"
+	}
+
+	args := []string{"mv"}
+
+	args = append(args, c.connectionArgs()...)
+
+	args = append(args, imageSpec(pool, imageName, ""), imageSpec(pool, newName, ""))
+
+	cmd := exec.Command(c.rbdPath, args...)
+	cmd.Stdout = c.output
+	cmd.Stderr = c.output
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to rename RBD image %s/%s to %s: %w", pool, imageName, newName, err)
+	}
+
+	return nil
+}
+
+// ResizeImage grows an RBD image to size bytes.
+func (c *CephClient) ResizeImage(pool, imageName string, size uint64) error {
+	c.logger.Infof("Resizing RBD image %s/%s to %d bytes", pool, imageName, size)
+
+	if c.rbdPath == "" {
+		c.rbdPath = "rbd"
+	}
+
+	args := []string{"resize", "--no-progress", "--size", fmt.Sprintf("%dB", size)}
+
+	args = append(args, c.connectionArgs()...)
+
+	args = append(args, imageSpec(pool, imageName, ""))
+
+	cmd := exec.Command(c.rbdPath, args...)
+	cmd.Stdout = c.output
+	cmd.Stderr = c.output
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to resize RBD image %s/%s: %w", pool, imageName, err)
+	}
+
+	return nil
+}
+
+func (c *CephClient) ImageInfo(pool, imageName string) (*RBDImageInfo, error) {
+	c.logger.Debugf("Reading info of RBD image %s/%s", pool, imageName)
+
+	if c.rbdPath == "" {
+		c.rbdPath = "rbd"
+	}
+
+	args := []string{"info", "--format", "json"}
+
+	args = append(args, c.connectionArgs()...)
+
+	args = append(args, imageSpec(pool, imageName, ""))
+
+	cmd := exec.Command(c.rbdPath, args...)
+	cmd.Stderr = c.output
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read info of %s/%s: %w", pool, imageName, err)
+	}
+
+	var info RBDImageInfo
+	if err := json.Unmarshal(output, &info); err != nil {
+		return nil, fmt.Errorf("failed to parse info of %s/%s: %w", pool, imageName, err)
+	}
+
+	return &info, nil
+}
+
+func (c *CephClient) runSnapCommand(subcommand string, extraArgs ...string) error {
+	if c.rbdPath == "" {
+		c.rbdPath = "rbd"
+	}
+
+	args := []string{"snap", subcommand}
+
+	args = append(args, c.connectionArgs()...)
+
+	args = append(args, extraArgs...)
+
+	c.logger.Debugf("Running rbd command: %s %v", c.rbdPath, args)
+
+	cmd := exec.Command(c.rbdPath, args...)
+	cmd.Stdout = c.output
+	cmd.Stderr = c.output
+
+	return cmd.Run()
+}
+
+// imageSpec formats pool/image or pool/image@snapshot as understood by rbd.
+// pool may include a RADOS namespace as <pool>/<namespace>.
+func imageSpec(pool, imageName, snapshot string) string {
+	if snapshot == "" {
+		return fmt.Sprintf("%s/%s", pool, imageName)
+	}
+	return fmt.Sprintf("%s/%s@%s", pool, imageName, snapshot)
+}
+
 func (c *CephClient) Cleanup(exportPath string) {
-	log.Debugf("Cleaning up export file: %s", exportPath)
+	c.logger.Debugf("Cleaning up export file: %s", exportPath)
 	if err := os.Remove(exportPath); err != nil {
-		log.Warnf("Failed to remove export file %s: %v", exportPath, err)
+		c.logger.Warnf("Failed to remove export file %s: %v", exportPath, err)
 	}
 }
\ No newline at end of file
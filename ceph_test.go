@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestImageFeatureArgs(t *testing.T) {
+	features := []string{"layering", "exclusive-lock", "object-map", "fast-diff", "deep-flatten", "operations", "migrating"}
+	expected := []string{
+		"--image-feature", "layering",
+		"--image-feature", "exclusive-lock",
+		"--image-feature", "object-map",
+		"--image-feature", "fast-diff",
+		"--image-feature", "deep-flatten",
+	}
+	if args := imageFeatureArgs(features); !reflect.DeepEqual(args, expected) {
+		t.Fatalf("got %v, expected %v", args, expected)
+	}
+	if args := imageFeatureArgs(nil); args != nil {
+		t.Fatalf("got %v without features", args)
+	}
+}
+
+func TestImportFeaturesPreferRecorded(t *testing.T) {
+	// The replaced image is only looked up when nothing is recorded, which
+	// would fail here without an rbd binary.
+	rs := &RestoreService{cephClient: &CephClient{rbdPath: "/nonexistent/rbd", logger: log.NewEntry(log.StandardLogger()), output: io.Discard}}
+	chain := []BackupChainLink{{Manifest: &BackupManifest{ImageFeatures: []string{"layering"}}}}
+
+	if features := rs.importFeatures(chain, "replicapool", "csi-vol-1"); !reflect.DeepEqual(features, []string{"layering"}) {
+		t.Fatalf("got %v", features)
+	}
+	if features := rs.importFeatures([]BackupChainLink{{}}, "replicapool", "csi-vol-1"); features != nil {
+		t.Fatalf("got %v for an unreadable replaced image", features)
+	}
+}
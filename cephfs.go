@@ -0,0 +1,552 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Volume types a backup can be taken from.
+const (
+	volumeTypeRBD    = "rbd"
+	volumeTypeCephFS = "cephfs"
+)
+
+// defaultSubvolumeGroup is the subvolume group ceph-csi provisions into.
+const defaultSubvolumeGroup = "csi"
+
+// csiDrivers returns the CSI driver names configured under key, or def.
+// Drivers are matched exactly, since e.g. Rook prefixes them with its
+// namespace and names containing "ceph" need not be RBD.
+func csiDrivers(key string, def ...string) []string {
+	if drivers := viper.GetStringSlice(key); len(drivers) > 0 {
+		return drivers
+	}
+	return def
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// CephFSVolume locates a ceph-csi CephFS subvolume.
+type CephFSVolume struct {
+	FSName        string
+	Group         string
+	Subvolume     string
+	SubvolumePath string
+}
+
+// cephFSVolumeOfPV returns the subvolume backing a ceph-csi CephFS PV.
+func cephFSVolumeOfPV(pv *corev1.PersistentVolume) (CephFSVolume, error) {
+	if pv.Spec.CSI == nil || pv.Spec.CSI.VolumeAttributes == nil {
+		return CephFSVolume{}, fmt.Errorf("PV %s has no CSI volume attributes", pv.Name)
+	}
+
+	attributes := pv.Spec.CSI.VolumeAttributes
+	volume := CephFSVolume{
+		FSName:        attributes["fsName"],
+		Subvolume:     attributes["subvolumeName"],
+		SubvolumePath: attributes["subvolumePath"],
+	}
+	if volume.FSName == "" || volume.Subvolume == "" || volume.SubvolumePath == "" {
+		return CephFSVolume{}, fmt.Errorf("PV %s is missing fsName, subvolumeName or subvolumePath", pv.Name)
+	}
+
+	// The path is /volumes/<group>/<subvolume>/<uuid>.
+	volume.Group = defaultSubvolumeGroup
+	if parts := strings.Split(strings.Trim(volume.SubvolumePath, "/"), "/"); len(parts) >= 3 && parts[0] == "volumes" {
+		volume.Group = parts[1]
+	}
+
+	return volume, nil
+}
+
+// isCephFSPV reports whether pv is a ceph-csi CephFS volume, judged by its
+// volume attributes.
+func isCephFSPV(pv *corev1.PersistentVolume) bool {
+	return pv.Spec.CSI != nil && pv.Spec.CSI.VolumeAttributes["subvolumeName"] != ""
+}
+
+// cephFSMountRoot is the directory each CephFS filesystem is mounted under,
+// as <root>/<fsName>.
+func cephFSMountRoot() string {
+	if root := viper.GetString("cephfs.mount_root"); root != "" {
+		return root
+	}
+	return "/mnt/cephfs"
+}
+
+// cephFSDir returns where path of filesystem fsName is found locally.
+func cephFSDir(fsName, path string) (string, error) {
+	dir := filepath.Join(cephFSMountRoot(), fsName, path)
+	if _, err := os.Stat(dir); err != nil {
+		return "", fmt.Errorf("CephFS %s is not mounted at %s: %w", fsName, filepath.Join(cephFSMountRoot(), fsName), err)
+	}
+	return dir, nil
+}
+
+// subvolumeSnapshotDir returns the directory holding the contents of a
+// subvolume snapshot. Version 2 subvolumes are snapshotted at their base
+// directory, version 1 subvolumes at the data directory itself.
+func subvolumeSnapshotDir(volume CephFSVolume, snapshot string) (string, error) {
+	dataDir, err := cephFSDir(volume.FSName, volume.SubvolumePath)
+	if err != nil {
+		return "", err
+	}
+
+	candidates := []string{
+		filepath.Join(filepath.Dir(dataDir), ".snap", snapshot, filepath.Base(dataDir)),
+		filepath.Join(dataDir, ".snap", snapshot),
+	}
+	for _, dir := range candidates {
+		if _, err := os.Stat(dir); err == nil {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("snapshot %s of subvolume %s not found under %s", snapshot, volume.Subvolume, dataDir)
+}
+
+// runCephCommand runs the ceph CLI and returns its stdout.
+func (c *CephClient) runCephCommand(args ...string) ([]byte, error) {
+	if c.cephPath == "" {
+		c.cephPath = "ceph"
+	}
+
+	args = append(args, c.connectionArgs()...)
+
+	c.logger.Debugf("Running ceph command: %s %v", c.cephPath, args)
+
+	cmd := exec.Command(c.cephPath, args...)
+	cmd.Stderr = c.output
+
+	return cmd.Output()
+}
+
+func (c *CephClient) CreateSubvolumeSnapshot(volume CephFSVolume, snapshot string) error {
+	c.logger.Infof("Creating CephFS snapshot %s/%s/%s@%s", volume.FSName, volume.Group, volume.Subvolume, snapshot)
+
+	if _, err := c.runCephCommand("fs", "subvolume", "snapshot", "create", volume.FSName, volume.Subvolume, snapshot, "--group_name", volume.Group); err != nil {
+		return fmt.Errorf("ceph fs subvolume snapshot create failed: %w", err)
+	}
+
+	return nil
+}
+
+func (c *CephClient) RemoveSubvolumeSnapshot(volume CephFSVolume, snapshot string) error {
+	c.logger.Infof("Removing CephFS snapshot %s/%s/%s@%s", volume.FSName, volume.Group, volume.Subvolume, snapshot)
+
+	if _, err := c.runCephCommand("fs", "subvolume", "snapshot", "rm", volume.FSName, volume.Subvolume, snapshot, "--group_name", volume.Group); err != nil {
+		return fmt.Errorf("ceph fs subvolume snapshot rm failed: %w", err)
+	}
+
+	return nil
+}
+
+func (c *CephClient) ListSubvolumeSnapshots(volume CephFSVolume) ([]string, error) {
+	c.logger.Debugf("Listing snapshots of CephFS subvolume %s/%s/%s", volume.FSName, volume.Group, volume.Subvolume)
+
+	output, err := c.runCephCommand("fs", "subvolume", "snapshot", "ls", volume.FSName, volume.Subvolume, "--group_name", volume.Group, "--format", "json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots of subvolume %s: %w", volume.Subvolume, err)
+	}
+
+	var snapshots []struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(output, &snapshots); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot list of subvolume %s: %w", volume.Subvolume, err)
+	}
+
+	names := make([]string, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		names = append(names, snapshot.Name)
+	}
+	return names, nil
+}
+
+// SubvolumePath returns the path of a subvolume within its filesystem, or
+// an empty path if the subvolume does not exist.
+func (c *CephClient) SubvolumePath(fsName, group, subvolume string) (string, error) {
+	output, err := c.runCephCommand("fs", "subvolume", "getpath", fsName, subvolume, "--group_name", group)
+	if err != nil {
+		var exitErr *exec.ExitError
+		// ENOENT
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to get path of subvolume %s: %w", subvolume, err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func (c *CephClient) CreateSubvolume(fsName, group, subvolume string) error {
+	c.logger.Infof("Creating CephFS subvolume %s/%s/%s", fsName, group, subvolume)
+
+	if _, err := c.runCephCommand("fs", "subvolume", "create", fsName, subvolume, "--group_name", group); err != nil {
+		return fmt.Errorf("ceph fs subvolume create failed: %w", err)
+	}
+
+	return nil
+}
+
+// subvolumeSourceDir returns the directory to archive: the snapshot if one
+// is given, the live subvolume otherwise.
+func subvolumeSourceDir(volume CephFSVolume, snapshot string) (string, error) {
+	if snapshot != "" {
+		return subvolumeSnapshotDir(volume, snapshot)
+	}
+	return cephFSDir(volume.FSName, volume.SubvolumePath)
+}
+
+// ArchiveSubvolume writes a tar archive of the subvolume, or its snapshot
+// if snapshot is not empty, to a file in backup.temp_dir and returns the
+// file path.
+func (c *CephClient) ArchiveSubvolume(volume CephFSVolume, snapshot string) (string, error) {
+	dir, err := subvolumeSourceDir(volume, snapshot)
+	if err != nil {
+		return "", err
+	}
+	c.logger.Infof("Archiving CephFS directory %s", dir)
+
+	exportDir := viper.GetString("backup.temp_dir")
+	if exportDir == "" {
+		exportDir = "/tmp/k8s-ceph-backup"
+	}
+
+	if err := os.MkdirAll(exportDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create export directory: %w", err)
+	}
+
+	timestamp := time.Now().Format("20060102-150405")
+	exportFile := filepath.Join(exportDir, fmt.Sprintf("%s-%s-%s.tar", volume.FSName, volume.Subvolume, timestamp))
+
+	file, err := os.Create(exportFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to create archive: %w", err)
+	}
+
+	err = writeTar(context.Background(), dir, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(exportFile)
+		return "", fmt.Errorf("failed to archive %s: %w", dir, err)
+	}
+
+	c.logger.Infof("Successfully archived CephFS subvolume to %s", exportFile)
+	return exportFile, nil
+}
+
+// ArchiveSubvolumeStream returns a tar archive of the subvolume, or its
+// snapshot if snapshot is not empty, as a stream. Archiving stops when ctx
+// is cancelled or the reader is closed.
+func (c *CephClient) ArchiveSubvolumeStream(ctx context.Context, volume CephFSVolume, snapshot string) (io.ReadCloser, error) {
+	dir, err := subvolumeSourceDir(volume, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	c.logger.Infof("Streaming archive of CephFS directory %s", dir)
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeTar(ctx, dir, pw))
+	}()
+	return pr, nil
+}
+
+// writeTar archives the contents of dir to w. Regular files, directories
+// and symlinks are archived with their owner, mode and modification time;
+// devices, FIFOs and sockets are skipped.
+func writeTar(ctx context.Context, dir string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() && info.Mode()&fs.ModeSymlink == 0 {
+			return nil
+		}
+
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return fmt.Errorf("failed to archive %s: %w", name, err)
+		}
+		header.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// extractTar unpacks a tar stream written by writeTar into dir. Entries
+// may not leave dir, also not through symlinks extracted earlier: existing
+// files and symlinks are replaced rather than written through, and
+// directories that are symlinks are refused. Owners are only restored when
+// running as root.
+func extractTar(r io.Reader, dir string) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", dir, err)
+	}
+
+	type dirTimes struct {
+		path    string
+		modTime time.Time
+	}
+	var dirs []dirTimes
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("archive entry %q leaves the target directory", header.Name)
+		}
+		target := filepath.Join(root, name)
+
+		parent, err := filepath.EvalSymlinks(filepath.Dir(target))
+		if err != nil {
+			return fmt.Errorf("failed to resolve parent of %s: %w", name, err)
+		}
+		if parent != root && !strings.HasPrefix(parent, root+string(filepath.Separator)) {
+			return fmt.Errorf("archive entry %q leaves the target directory", header.Name)
+		}
+
+		// What is already there, from the subvolume or an earlier entry,
+		// must not redirect the entry.
+		existing, err := os.Lstat(target)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if existing != nil && existing.Mode()&os.ModeSymlink != 0 && header.Typeflag == tar.TypeDir {
+			if info, statErr := os.Stat(target); statErr == nil && info.IsDir() {
+				return fmt.Errorf("archive entry %q is a symlink to a directory in the target", header.Name)
+			}
+		}
+		if existing != nil && !existing.IsDir() {
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+			existing = nil
+		}
+		if existing != nil && header.Typeflag != tar.TypeDir {
+			return fmt.Errorf("archive entry %q would replace a directory", header.Name)
+		}
+
+		mode := os.FileMode(header.Mode).Perm() | os.FileMode(header.Mode)&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if existing == nil {
+				if err := os.Mkdir(target, 0700); err != nil {
+					return err
+				}
+			}
+			if err := os.Chmod(target, mode); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirTimes{path: target, modTime: header.ModTime})
+		case tar.TypeReg:
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY|oNoFollow, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, tr)
+			if err == nil {
+				err = file.Chmod(mode)
+			}
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return fmt.Errorf("failed to write %s: %w", name, err)
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		default:
+			log.Warnf("Skipping %s: unsupported archive entry type %c", name, header.Typeflag)
+			continue
+		}
+
+		if os.Geteuid() == 0 {
+			if err := os.Lchown(target, header.Uid, header.Gid); err != nil {
+				return fmt.Errorf("failed to chown %s: %w", name, err)
+			}
+		}
+		if header.Typeflag == tar.TypeReg {
+			if err := os.Chtimes(target, header.ModTime, header.ModTime); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Creating entries updates the modification time of their directory,
+	// so directories are set last, deepest first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chtimes(dirs[i].path, dirs[i].modTime, dirs[i].modTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tarExtractor is an io.WriteCloser unpacking the tar stream written to it
+// into a directory. Close returns the result of the extraction.
+type tarExtractor struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	err  error
+}
+
+func newTarExtractor(dir string) *tarExtractor {
+	pr, pw := io.Pipe()
+	e := &tarExtractor{pw: pw, done: make(chan struct{})}
+
+	go func() {
+		err := extractTar(pr, dir)
+		if err == nil {
+			// Consume the end-of-archive padding.
+			_, err = io.Copy(io.Discard, pr)
+		}
+		pr.CloseWithError(err)
+		e.err = err
+		close(e.done)
+	}()
+
+	return e
+}
+
+func (e *tarExtractor) Write(p []byte) (int, error) {
+	return e.pw.Write(p)
+}
+
+func (e *tarExtractor) Close() error {
+	e.pw.Close()
+	<-e.done
+	return e.err
+}
+
+// isCephFSBackup reports whether chain restores a CephFS archive rather
+// than an RBD image.
+func isCephFSBackup(chain []BackupChainLink) bool {
+	link := chain[len(chain)-1]
+	if link.Manifest != nil && link.Manifest.VolumeType != "" {
+		return link.Manifest.VolumeType == volumeTypeCephFS
+	}
+	base, _ := trimEncryptionSuffix(link.ObjectName)
+	return strings.HasSuffix(base, archiveBackupSuffix)
+}
+
+// RestoreToSubvolume unpacks a CephFS backup into a subvolume, which is
+// created if it does not exist yet.
+func (rs *RestoreService) RestoreToSubvolume(chain []BackupChainLink, fsName, group, subvolume string) error {
+	path, err := rs.cephClient.SubvolumePath(fsName, group, subvolume)
+	if err != nil {
+		return err
+	}
+	if path == "" {
+		if err := rs.cephClient.CreateSubvolume(fsName, group, subvolume); err != nil {
+			return err
+		}
+		if path, err = rs.cephClient.SubvolumePath(fsName, group, subvolume); err != nil {
+			return err
+		}
+	}
+
+	dir, err := cephFSDir(fsName, path)
+	if err != nil {
+		return err
+	}
+	return rs.RestoreToDirectory(chain, dir)
+}
+
+// RestoreToDirectory unpacks a CephFS backup into dir, which has to be
+// empty so the restored tree is not mixed with other data.
+func (rs *RestoreService) RestoreToDirectory(chain []BackupChainLink, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read restore target: %w", err)
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("restore target %s is not empty", dir)
+	}
+
+	// Archives are always full backups, so the chain has a single link.
+	link := chain[len(chain)-1]
+	log.Infof("Restoring %s into %s", link.ObjectName, dir)
+	return rs.restoreObject(link, restoreTarget{dir: dir})
+}
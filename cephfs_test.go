@@ -0,0 +1,156 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	body     string
+}
+
+func buildTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Linkname: entry.linkname,
+			Mode:     0644,
+			Size:     int64(len(entry.body)),
+		}
+		if entry.typeflag == tar.TypeDir {
+			header.Mode = 0755
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestExtractTarRoundTrip(t *testing.T) {
+	source := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(source, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "sub", "data"), []byte("hello"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub/data", filepath.Join(source, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeTar(context.Background(), source, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	target := t.TempDir()
+	if err := extractTar(&buf, target); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(target, "link"))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+	info, err := os.Stat(filepath.Join(target, "sub", "data"))
+	if err != nil || info.Mode().Perm() != 0640 {
+		t.Fatalf("got %v, %v", info, err)
+	}
+}
+
+func TestExtractTarSymlinkThenFile(t *testing.T) {
+	outside := filepath.Join(t.TempDir(), "victim")
+	if err := os.WriteFile(outside, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	target := t.TempDir()
+	archive := buildTar(t, []tarEntry{
+		{name: "evil", typeflag: tar.TypeSymlink, linkname: outside},
+		{name: "evil", typeflag: tar.TypeReg, body: "overwritten"},
+	})
+	if err := extractTar(archive, target); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(outside)
+	if err != nil || string(data) != "original" {
+		t.Fatalf("file outside the target changed: %q, %v", data, err)
+	}
+	info, err := os.Lstat(filepath.Join(target, "evil"))
+	if err != nil || !info.Mode().IsRegular() {
+		t.Fatalf("expected a regular file in the target, got %v, %v", info, err)
+	}
+}
+
+func TestExtractTarExistingSymlink(t *testing.T) {
+	outside := filepath.Join(t.TempDir(), "victim")
+	if err := os.WriteFile(outside, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A symlink already in the subvolume is replaced, not written through.
+	target := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(target, "file")); err != nil {
+		t.Fatal(err)
+	}
+	archive := buildTar(t, []tarEntry{{name: "file", typeflag: tar.TypeReg, body: "restored"}})
+	if err := extractTar(archive, target); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(outside)
+	if err != nil || string(data) != "original" {
+		t.Fatalf("file outside the target changed: %q, %v", data, err)
+	}
+}
+
+func TestExtractTarSymlinkedDirectory(t *testing.T) {
+	outside := t.TempDir()
+
+	for name, entries := range map[string][]tarEntry{
+		"directory": {
+			{name: "dir", typeflag: tar.TypeSymlink, linkname: outside},
+			{name: "dir/", typeflag: tar.TypeDir},
+		},
+		"file below": {
+			{name: "dir", typeflag: tar.TypeSymlink, linkname: outside},
+			{name: "dir/file", typeflag: tar.TypeReg, body: "escaped"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := extractTar(buildTar(t, entries), t.TempDir()); err == nil {
+				t.Fatal("expected the archive to be refused")
+			}
+			if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+				t.Fatalf("archive wrote outside the target: %v", entries)
+			}
+		})
+	}
+}
+
+func TestExtractTarLeavingTarget(t *testing.T) {
+	archive := buildTar(t, []tarEntry{{name: "../escaped", typeflag: tar.TypeReg, body: "x"}})
+	if err := extractTar(archive, t.TempDir()); err == nil {
+		t.Fatal("expected the archive to be refused")
+	}
+}
@@ -1,66 +1,158 @@
 package main
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
 )
 
 var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List available backups in MinIO storage",
-	Long:  `List all available backups stored in the configured MinIO bucket.`,
+	Long: `List all available backups stored in the configured MinIO bucket, oldest
+first, with the namespace, PVC, pool and image they were taken from.
+
+--since and --before accept an RFC3339 time (seconds may be omitted), a date
+(2006-01-02) or an age such as 36h or 7d.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		runList()
+		runList(cmd)
 	},
 }
 
-var listPrefix string
+var (
+	listPrefix string
+	listOutput string
+	listPVCs   []string
+	listSince  string
+	listBefore string
+)
 
 func init() {
 	rootCmd.AddCommand(listCmd)
 	listCmd.Flags().StringVarP(&listPrefix, "prefix", "p", "", "Filter backups by prefix")
+	listCmd.Flags().StringVarP(&listOutput, "output", "o", "table", "Output format: table, json, yaml or csv")
+	listCmd.Flags().StringSliceVar(&listPVCs, "pvc", nil, "Only list backups of these PVCs (globs allowed)")
+	listCmd.Flags().StringVar(&listSince, "since", "", "Only list backups taken at or after this time")
+	listCmd.Flags().StringVar(&listBefore, "before", "", "Only list backups taken before this time")
 }
 
-func runList() {
+func runList(cmd *cobra.Command) {
+	// The persistent --namespace flag defaults to "default" for backups;
+	// for listing it only filters when given explicitly.
+	var filter backupFilter
+	if cmd.Flags().Changed("namespace") {
+		filter.namespaces = namespaces
+	}
+	filter.pvcs = listPVCs
+
+	var err error
+	now := time.Now()
+	if filter.since, err = parseTimeFilter(listSince, now); err != nil {
+		log.Fatal("Invalid --since:", err)
+	}
+	if filter.before, err = parseTimeFilter(listBefore, now); err != nil {
+		log.Fatal("Invalid --before:", err)
+	}
+
 	log.Info("Listing available backups...")
 
 	minioClient := NewMinioClient()
-	objects, err := minioClient.ListObjects(listPrefix)
+	entries, err := listBackups(minioClient, listPrefix, filter)
 	if err != nil {
 		log.Fatal("Failed to list backups:", err)
 	}
 
-	if len(objects) == 0 {
-		fmt.Println("No backups found.")
-		return
+	if err := writeBackupList(os.Stdout, entries, listOutput); err != nil {
+		log.Fatal("Failed to print backups:", err)
 	}
+}
+
+// writeBackupList prints entries to w in the given output format.
+func writeBackupList(w io.Writer, entries []BackupEntry, format string) error {
+	if entries == nil {
+		entries = []BackupEntry{}
+	}
+
+	switch format {
+	case "table", "":
+		if len(entries) == 0 {
+			fmt.Fprintln(w, "No backups found.")
+			return nil
+		}
 
-	fmt.Printf("Found %d backup(s):\n\n", len(objects))
-	fmt.Printf("%-50s %-20s %-20s %-20s\n", "Backup File", "PVC Name", "Pool", "Image")
-	fmt.Println(strings.Repeat("-", 110))
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "TIME\tNAMESPACE\tPVC\tTYPE\tSIZE\tPOOL\tIMAGE\tOBJECT")
+		for _, entry := range entries {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", entry.Time.Format(time.RFC3339), entry.Namespace,
+				entry.PVC, entry.Type, entry.Size, entry.Pool, entry.Image, entry.Object)
+		}
+		tw.Flush()
 
-	for _, object := range objects {
-		pvc, pool, image := parseBackupFileName(object)
-		fmt.Printf("%-50s %-20s %-20s %-20s\n", object, pvc, pool, image)
+		fmt.Fprintf(w, "\n%d backup(s)\n", len(entries))
+		return nil
+
+	case "json":
+		data, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode backups: %w", err)
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+
+	case "yaml":
+		data, err := yaml.Marshal(entries)
+		if err != nil {
+			return fmt.Errorf("failed to encode backups: %w", err)
+		}
+		_, err = w.Write(data)
+		return err
+
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"time", "namespace", "pvc", "type", "size_bytes", "pool", "image", "object", "parent"})
+		for _, entry := range entries {
+			cw.Write([]string{entry.Time.Format(time.RFC3339), entry.Namespace, entry.PVC, entry.Type,
+				strconv.FormatInt(entry.Size, 10), entry.Pool, entry.Image, entry.Object, entry.Parent})
+		}
+		cw.Flush()
+		return cw.Error()
 	}
+
+	return fmt.Errorf("unknown output format %q (expected table, json, yaml or csv)", format)
 }
 
-func parseBackupFileName(filename string) (pvc, pool, image string) {
-	base := strings.TrimSuffix(filename, ".rbd.gz.gpg")
-	
-	parts := strings.Split(base, "-")
-	if len(parts) >= 3 {
-		pvc = parts[0]
-		pool = parts[1]
-		image = strings.Join(parts[2:], "-")
-	} else {
-		pvc = filename
-		pool = "unknown"
-		image = "unknown"
+// parseTimeFilter parses the value of a time filter flag: an RFC3339 time,
+// a date, or an age relative to now such as "36h" or "7d". An empty value
+// returns the zero time.
+func parseTimeFilter(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04Z07:00", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
 	}
-	
-	return pvc, pool, image
-}
\ No newline at end of file
+
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if age, err := time.ParseDuration(value); err == nil && age >= 0 {
+		return now.Add(-age), nil
+	}
+
+	return time.Time{}, fmt.Errorf("%q is neither a time (RFC3339 or 2006-01-02) nor an age such as 36h or 7d", value)
+}
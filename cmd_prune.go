@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Delete backups that fall out of their retention policy",
+	Long: `Group the backups in the MinIO bucket per namespace and PVC and delete those
+not kept by the grandfather-father-son rules (keep-last, keep-daily,
+keep-weekly, keep-monthly, keep-yearly) of the retention config or of the PVC's
+retention annotation. Backups an incremental backup still depends on are kept.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runPrune()
+	},
+}
+
+var (
+	prunePrefix string
+	pruneDryRun bool
+)
+
+func init() {
+	rootCmd.AddCommand(pruneCmd)
+	pruneCmd.Flags().StringVarP(&prunePrefix, "prefix", "p", "", "only prune backups whose object name starts with this prefix")
+	pruneCmd.Flags().BoolVar(&pruneDryRun, "dry-run", false, "list what would be deleted without deleting anything")
+}
+
+func runPrune() {
+	if pruneDryRun {
+		log.Info("Pruning backups (dry run)...")
+	} else {
+		log.Info("Pruning backups...")
+	}
+
+	pruner, err := NewPruner(NewMinioClient(), pruneDryRun)
+	if err != nil {
+		log.Fatal("Invalid retention policy:", err)
+	}
+
+	decisions, err := pruner.Run(prunePrefix)
+	printPruneDecisions(decisions, pruneDryRun)
+	if err != nil {
+		log.Fatal("Prune failed:", err)
+	}
+}
+
+func printPruneDecisions(decisions []PruneDecision, dryRun bool) {
+	if len(decisions) == 0 {
+		fmt.Println("No backups found.")
+		return
+	}
+
+	deleteAction := "delete"
+	if dryRun {
+		deleteAction = "would delete"
+	}
+
+	var deleted int
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "OBJECT\tTYPE\tACTION\tREASON")
+	for _, decision := range decisions {
+		action := "keep"
+		if !decision.Keep {
+			action = deleteAction
+			deleted++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", decision.Object, decision.Metadata.Type, action, strings.Join(decision.Reasons, ", "))
+	}
+	tw.Flush()
+
+	if dryRun {
+		fmt.Printf("\n%d of %d backup(s) would be deleted.\n", deleted, len(decisions))
+	} else {
+		fmt.Printf("\n%d of %d backup(s) deleted.\n", deleted, len(decisions))
+	}
+}
@@ -1,75 +1,513 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"k8s.io/client-go/kubernetes"
 )
 
 var restoreCmd = &cobra.Command{
-	Use:   "restore [backup-file-name] [target-pool] [target-image]",
+	Use:   "restore [backup-file-name] ([target-pool] [target-image] | [fs-name] [subvolume] | --to-pvc [namespace/]name | --in-place | --apply-resources)",
 	Short: "Restore a backup to a CEPH RBD image",
 	Long: `Restore a backup from MinIO storage to a CEPH RBD image.
 This command will:
 1. Download the backup from MinIO
-2. Decrypt with GPG
-3. Decompress with gzip
-4. Import to RBD using the specified pool and image name`,
-	Args: cobra.ExactArgs(3),
+2. Verify its signature against signing.trusted_keys
+3. Decrypt it with the provider it was encrypted with (gpg, age or envelope)
+4. Decompress with gzip
+5. Import to RBD using the specified pool and image name
+
+Backups without a signature from a trusted key are refused unless
+--insecure-skip-verify is given, e.g. for backups taken before signing was
+enabled.
+
+Incremental backups are restored by importing the full backup they are based
+on and replaying every diff of the chain with rbd import-diff.
+
+With --pvc the backup is looked up instead of named: the newest backup of
+the PVC in --namespace taken at or before --at, or the newest one with
+--latest. The chain to replay is shown and has to be confirmed unless --yes
+is given. --at accepts the same formats as list --before.
+
+With --to-pvc a new PVC is created from the StorageClass and size recorded in
+the backup's manifest. Once ceph-csi has provisioned its RBD image, the image
+is replaced by the backup data.
+
+With --in-place the backup is restored over the image of the PVC it was taken
+from (or --pvc). Deployments and StatefulSets mounting the PVC are scaled to
+zero until the volume is detached, the current image is renamed aside as a
+rollback point, and the workloads are scaled back up afterwards.
+
+With --apply-resources the StorageClass, PV and PVC stored with the backup are
+re-created and the backup is imported into the RBD image the PV names, e.g.
+to rebuild a lost cluster. --target-namespace and --storage-class remap them.
+
+CephFS backups are tar archives. They are unpacked into an empty subvolume
+given as [fs-name] [subvolume] (in --subvolume-group, created if missing) or
+into a new PVC with --to-pvc. The filesystem has to be mounted below
+cephfs.mount_root.
+
+With --streaming (or backup.streaming in the config) the object is piped
+decrypted and gunzipped straight into "rbd import -", or unpacked as it
+arrives for CephFS backups, without plaintext files. The encrypted object is
+still downloaded first when its signature is checked, so nothing is
+decrypted or imported before it is verified.`,
+	Example: `  k8s-ceph-backup restore production/data-2026-10-01T02-00-00Z.rbd.gz.gpg rbd data-restored
+  k8s-ceph-backup restore -n production --pvc data --at 2026-10-01T12:00Z rbd data-restored
+  k8s-ceph-backup restore -n production --pvc data --latest --yes rbd data-restored
+  k8s-ceph-backup restore -n production --pvc data --latest --to-pvc staging/data-copy
+  k8s-ceph-backup restore -n production --pvc data --at 2026-10-01T12:00Z --in-place
+  k8s-ceph-backup restore -n production --pvc shared --latest myfs shared-restored
+  k8s-ceph-backup restore -n production --pvc data --latest --apply-resources --target-namespace production-dr`,
+	Args: cobra.MaximumNArgs(3),
 	Run: func(cmd *cobra.Command, args []string) {
-		runRestore(args[0], args[1], args[2])
+		runRestore(cmd, args)
 	},
 }
 
+var (
+	restorePVC    string
+	restoreAt     string
+	restoreLatest bool
+	restoreYes    bool
+
+	restoreToPVC        string
+	restoreStorageClass string
+	restoreSize         string
+	restoreInPlace      bool
+
+	restoreApplyResources  bool
+	restoreTargetNamespace string
+
+	restoreSubvolumeGroup string
+
+	restoreSkipVerify bool
+)
+
 func init() {
 	rootCmd.AddCommand(restoreCmd)
+	restoreCmd.Flags().Bool("streaming", false, "stream the backup into rbd import without temporary files")
+	restoreCmd.Flags().StringVar(&restorePVC, "pvc", "", "restore the backup of this PVC instead of a named object")
+	restoreCmd.Flags().StringVar(&restoreAt, "at", "", "with --pvc, restore the newest backup taken at or before this time")
+	restoreCmd.Flags().BoolVar(&restoreLatest, "latest", false, "with --pvc, restore the newest backup")
+	restoreCmd.Flags().BoolVarP(&restoreYes, "yes", "y", false, "do not ask for confirmation")
+	restoreCmd.Flags().StringVar(&restoreToPVC, "to-pvc", "", "restore into a new PVC [namespace/]name instead of [target-pool] [target-image]")
+	restoreCmd.Flags().StringVar(&restoreStorageClass, "storage-class", "", "with --to-pvc or --apply-resources, StorageClass of the new PVC (default: the backed up PVC's)")
+	restoreCmd.Flags().BoolVar(&restoreInPlace, "in-place", false, "restore over the image of the backed up PVC, scaling down its workloads meanwhile")
+	restoreCmd.Flags().BoolVar(&restoreApplyResources, "apply-resources", false, "re-create the StorageClass, PV and PVC stored with the backup and restore into the PV's image")
+	restoreCmd.Flags().StringVar(&restoreTargetNamespace, "target-namespace", "", "with --apply-resources, namespace to create the PVC in (default: the backed up PVC's)")
+	restoreCmd.Flags().StringVar(&restoreSubvolumeGroup, "subvolume-group", "", "subvolume group of [subvolume] for CephFS backups (default: cephfs.subvolume_group or \"csi\")")
+	restoreCmd.Flags().StringVar(&restoreSize, "size", "", "with --to-pvc, size of the new PVC (default: the backed up PVC's)")
+	restoreCmd.Flags().BoolVar(&restoreSkipVerify, "insecure-skip-verify", false, "restore backups without checking their signature")
+	viper.BindPFlag("backup.streaming", restoreCmd.Flags().Lookup("streaming"))
 }
 
-func runRestore(backupFile, targetPool, targetImage string) {
-	log.Infof("Starting restore process for backup: %s", backupFile)
-	log.Infof("Target: %s/%s", targetPool, targetImage)
-
+func runRestore(cmd *cobra.Command, args []string) {
 	restoreService := NewRestoreService()
-	if err := restoreService.Run(backupFile, targetPool, targetImage); err != nil {
+	restoreService.skipVerify = restoreSkipVerify
+
+	// The chain comes from a named object or from looking up the PVC; the
+	// remaining arguments name the target image.
+	var chain []BackupChainLink
+	var err error
+	targetArgs := args
+	if restorePVC == "" {
+		if restoreAt != "" || restoreLatest {
+			log.Fatal("--at and --latest require --pvc")
+		}
+		if len(args) == 0 {
+			log.Fatal("Expected [backup-file-name], or --pvc to look up the backup")
+		}
+
+		log.Infof("Starting restore process for backup: %s", args[0])
+		chain, err = resolveBackupChain(restoreService.minioClient, args[0])
+		targetArgs = args[1:]
+	} else {
+		if (restoreAt == "") == !restoreLatest {
+			log.Fatal("--pvc requires exactly one of --at or --latest")
+		}
+		if len(namespaces) != 1 {
+			log.Fatal("--pvc requires exactly one --namespace")
+		}
+
+		at, parseErr := parseTimeFilter(restoreAt, time.Now())
+		if parseErr != nil {
+			log.Fatal("Invalid --at:", parseErr)
+		}
+		chain, err = restoreService.resolve(namespaces[0], restorePVC, at)
+	}
+	if err == nil {
+		err = restoreService.verifyChain(chain)
+	}
+	if err != nil {
+		log.Fatal("Restore failed:", err)
+	}
+
+	var target string
+	var targetNamespace, targetPVC, targetPool, targetImage string
+	var resources *KubeResources
+	switch {
+	case restoreApplyResources:
+		if len(targetArgs) != 0 || restoreToPVC != "" || restoreInPlace {
+			log.Fatal("--apply-resources restores into the stored PV and takes no other target")
+		}
+		link := chain[len(chain)-1]
+		resources, err = loadKubeResources(restoreService.minioClient, link.Manifest)
+		if err == nil {
+			err = resources.remap(restoreTargetNamespace, restoreStorageClass, link.ObjectName)
+		}
+		if err != nil {
+			log.Fatal("Failed to load Kubernetes objects of backup:", err)
+		}
+		target = fmt.Sprintf("PVC %s/%s with PV %s", resources.PVC.Namespace, resources.PVC.Name, resources.PV.Name)
+	case restoreInPlace:
+		if len(targetArgs) != 0 || restoreToPVC != "" {
+			log.Fatal("--in-place restores into the backed up PVC and takes no other target")
+		}
+		manifest := chain[len(chain)-1].Manifest
+		switch {
+		case restorePVC != "":
+			targetNamespace, targetPVC = namespaces[0], restorePVC
+		case manifest != nil:
+			targetNamespace, targetPVC = manifest.Namespace, manifest.PVC
+		default:
+			log.Fatal("Backup has no manifest naming its PVC, use --pvc with --in-place")
+		}
+		target = fmt.Sprintf("PVC %s/%s in place", targetNamespace, targetPVC)
+	case restoreToPVC != "":
+		if len(targetArgs) != 0 {
+			log.Fatal("--to-pvc replaces [target-pool] [target-image]")
+		}
+		targetNamespace, targetPVC = namespaces[0], restoreToPVC
+		if ns, name, found := strings.Cut(restoreToPVC, "/"); found {
+			targetNamespace, targetPVC = ns, name
+		}
+		target = fmt.Sprintf("new PVC %s/%s", targetNamespace, targetPVC)
+	case isCephFSBackup(chain):
+		if len(targetArgs) != 2 {
+			log.Fatal("Expected [fs-name] [subvolume] for a CephFS backup, or --to-pvc")
+		}
+		if restoreSubvolumeGroup == "" {
+			restoreSubvolumeGroup = viper.GetString("cephfs.subvolume_group")
+		}
+		if restoreSubvolumeGroup == "" {
+			restoreSubvolumeGroup = defaultSubvolumeGroup
+		}
+		targetPool, targetImage = targetArgs[0], targetArgs[1]
+		target = fmt.Sprintf("CephFS subvolume %s/%s/%s", targetPool, restoreSubvolumeGroup, targetImage)
+	default:
+		if len(targetArgs) != 2 {
+			log.Fatal("Expected [target-pool] [target-image], or --to-pvc")
+		}
+		targetPool, targetImage = targetArgs[0], targetArgs[1]
+		target = targetPool + "/" + targetImage
+	}
+
+	printRestorePlan(os.Stdout, chain, target)
+
+	// Restores looked up by PVC are confirmed, since nobody typed the
+	// object name of what is about to be restored. In-place restores stop
+	// workloads and replace live data, so they are always confirmed.
+	if (restorePVC != "" || restoreInPlace) && !restoreYes && !confirm(fmt.Sprintf("Restore to %s?", target)) {
+		log.Fatal("Restore aborted")
+	}
+
+	switch {
+	case restoreApplyResources:
+		err = restoreService.RestoreWithResources(chain, resources)
+	case restoreInPlace:
+		err = restoreService.RestoreInPlace(chain, targetNamespace, targetPVC)
+	case restoreToPVC != "":
+		err = restoreService.RestoreToNewPVC(chain, targetNamespace, targetPVC, pvcOverrides{
+			storageClass: restoreStorageClass,
+			size:         restoreSize,
+		})
+	case isCephFSBackup(chain):
+		err = restoreService.RestoreToSubvolume(chain, targetPool, restoreSubvolumeGroup, targetImage)
+	default:
+		err = restoreService.Restore(chain, targetPool, targetImage, restoreService.importFeatures(chain, targetPool, ""))
+	}
+	if err != nil {
 		log.Fatal("Restore failed:", err)
 	}
 
 	log.Info("Restore completed successfully")
 }
 
+// printRestorePlan shows the backups a restore is going to replay.
+func printRestorePlan(w io.Writer, chain []BackupChainLink, target string) {
+	fmt.Fprintf(w, "Restoring %s to %s from %d backup(s):\n\n", chain[len(chain)-1].ObjectName, target, len(chain))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tTYPE\tTAKEN\tSOURCE\tOBJECT")
+	for i, link := range chain {
+		taken, source := "unknown", "unknown"
+		if link.Manifest != nil {
+			taken = link.Manifest.Started.Format(time.RFC3339)
+			source = fmt.Sprintf("%s/%s", link.Manifest.Pool, link.Manifest.Image)
+		} else if parsed, ok := parseBackupObjectName(link.ObjectName); ok {
+			taken = parsed.Time.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", i+1, link.Metadata.Type, taken, source, link.ObjectName)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+}
+
+// confirm asks question on stdout and reports whether the answer read from
+// stdin was yes. Without a terminal the answer is no.
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		fmt.Println()
+		return false
+	}
+
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
 type RestoreService struct {
 	minioClient *MinioClient
-	gpgClient   *GPGClient
 	cephClient  *CephClient
+	streaming   bool
+
+	// decryptors holds one Encryptor per provider, created as backups
+	// encrypted with it are restored.
+	decryptors map[string]Encryptor
+
+	// verifier checks the signature of every object before it is imported,
+	// unless skipVerify is set.
+	verifier   *Verifier
+	skipVerify bool
+
+	// k8sClient is only created for restores into PVCs.
+	k8sClient        kubernetes.Interface
+	provisionTimeout time.Duration
+	quiesceTimeout   time.Duration
 }
 
 func NewRestoreService() *RestoreService {
 	return &RestoreService{
-		minioClient: NewMinioClient(),
-		gpgClient:   NewGPGClient(),
-		cephClient:  NewCephClient(),
+		minioClient:      NewMinioClient(),
+		cephClient:       NewCephClient(),
+		decryptors:       make(map[string]Encryptor),
+		verifier:         NewVerifier(),
+		streaming:        viper.GetBool("backup.streaming"),
+		provisionTimeout: viper.GetDuration("restore.provision_timeout"),
+		quiesceTimeout:   viper.GetDuration("restore.quiesce_timeout"),
 	}
 }
 
-func (rs *RestoreService) Run(backupFile, targetPool, targetImage string) error {
-	tempDir := viper.GetString("backup.temp_dir")
-	if tempDir == "" {
-		tempDir = "/tmp/k8s-ceph-backup"
+// resolve finds the newest backup of a PVC taken at or before at, or the
+// newest one if at is zero, and returns its chain.
+func (rs *RestoreService) resolve(namespace, pvcName string, at time.Time) ([]BackupChainLink, error) {
+	entry, err := findBackup(rs.minioClient, namespace, pvcName, at)
+	if err != nil {
+		return nil, err
 	}
 
-	downloadPath := filepath.Join(tempDir, backupFile)
-	
-	log.Info("Downloading backup from MinIO...")
-	if err := rs.minioClient.DownloadFile(backupFile, downloadPath); err != nil {
-		return fmt.Errorf("failed to download backup: %w", err)
+	log.Infof("Selected backup %s taken %s", entry.Object, entry.Time.Format(time.RFC3339))
+
+	return resolveBackupChain(rs.minioClient, entry.Object)
+}
+
+// verifyChain replaces the manifests of chain by verified ones and checks
+// that they still link up, before anything is restored. Without
+// --insecure-skip-verify backups without a signed manifest are refused.
+func (rs *RestoreService) verifyChain(chain []BackupChainLink) error {
+	if rs.skipVerify {
+		log.Warn("Not verifying backup manifests and signatures (--insecure-skip-verify)")
+		return nil
+	}
+
+	for i := range chain {
+		manifest, signer, err := loadVerifiedManifest(rs.minioClient, rs.verifier, chain[i].ObjectName)
+		if err != nil {
+			return err
+		}
+
+		metadata := manifest.Metadata()
+		switch {
+		case i == 0 && metadata.IsIncremental():
+			return fmt.Errorf("backup chain of %s does not start with a full backup", chain[len(chain)-1].ObjectName)
+		case i > 0 && metadata.Parent != chain[i-1].ObjectName:
+			return fmt.Errorf("signed manifest of %s names parent %s, not %s", chain[i].ObjectName, metadata.Parent, chain[i-1].ObjectName)
+		}
+
+		log.Debugf("Manifest of %s signed by %s", chain[i].ObjectName, signer)
+		chain[i].Manifest = manifest
+		chain[i].Metadata = metadata
+		chain[i].SignedBy = signer
+	}
+	return nil
+}
+
+// Restore replays chain, as returned by resolveBackupChain, onto the target
+// image, which is created with features, or the cluster's default features
+// if there are none.
+func (rs *RestoreService) Restore(chain []BackupChainLink, targetPool, targetImage string, features []string) error {
+	if len(chain) > 1 {
+		log.Infof("Backup %s is incremental, replaying a chain of %d backups", chain[len(chain)-1].ObjectName, len(chain))
+	}
+
+	target := restoreTarget{pool: targetPool, image: targetImage, features: features}
+	for i, link := range chain {
+		log.Infof("Restoring %s (%d/%d, %s)", link.ObjectName, i+1, len(chain), link.Metadata.Type)
+
+		if err := rs.restoreObject(link, target); err != nil {
+			return err
+		}
+
+		// rbd import-diff requires the diff's starting snapshot on the
+		// target image, and rbd import does not recreate it.
+		if len(chain) > 1 && !link.Metadata.IsIncremental() {
+			if err := rs.cephClient.CreateSnapshot(targetPool, targetImage, link.Metadata.Snapshot); err != nil {
+				return fmt.Errorf("failed to prepare RBD image for diffs: %w", err)
+			}
+		}
+	}
+
+	if len(chain) > 1 {
+		for _, link := range chain {
+			if err := rs.cephClient.RemoveSnapshot(targetPool, targetImage, link.Metadata.Snapshot); err != nil {
+				log.Warnf("Failed to remove replay snapshot %s: %v", link.Metadata.Snapshot, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// importFeatures returns the RBD features to create the image restored
+// from chain with: those recorded in the manifest of the backup, or else
+// those of the image it replaces, unless replaced is empty. A restored
+// volume thereby maps wherever the original did, also with krbd for classes
+// limited to layering.
+func (rs *RestoreService) importFeatures(chain []BackupChainLink, pool, replaced string) []string {
+	if manifest := chain[len(chain)-1].Manifest; manifest != nil && len(manifest.ImageFeatures) > 0 {
+		return manifest.ImageFeatures
+	}
+	if replaced == "" {
+		return nil
+	}
+
+	info, err := rs.cephClient.ImageInfo(pool, replaced)
+	if err != nil {
+		log.Warnf("Failed to read features of %s/%s, restoring with the cluster's defaults: %v", pool, replaced, err)
+		return nil
+	}
+	return info.Features
+}
+
+// restoreTarget is where a backup is restored to: an RBD image, created
+// with features, or for CephFS backups a directory the archive is unpacked
+// into.
+type restoreTarget struct {
+	pool     string
+	image    string
+	features []string
+	dir      string
+}
+
+func (t restoreTarget) String() string {
+	if t.dir != "" {
+		return t.dir
+	}
+	return "RBD image " + imageSpec(t.pool, t.image, "")
+}
+
+func (rs *RestoreService) restoreObject(link BackupChainLink, target restoreTarget) error {
+	// Backups written before manifests existed cannot be verified.
+	var checksums BackupManifest
+	if link.Manifest != nil {
+		checksums = *link.Manifest
+		log.Infof("Backup of %s/%s (PV %s, image %s/%s) taken %s",
+			checksums.Namespace, checksums.PVC, checksums.PV, checksums.Pool, checksums.Image, checksums.Started.Format(time.RFC3339))
+	} else {
+		log.Warnf("Backup %s has no manifest, checksums are not verified", link.ObjectName)
+	}
+
+	decryptor, err := rs.decryptor(link)
+	if err != nil {
+		return err
+	}
+	if decryptor, err = decryptorForBackup(context.TODO(), decryptor, link.Manifest); err != nil {
+		return fmt.Errorf("cannot decrypt backup %s: %w", link.ObjectName, err)
+	}
+
+	// A signed manifest covers the object through its sha256, which is
+	// compared before anything is committed, so the object's own signature
+	// only has to be checked when the manifest does not vouch for it.
+	var verifying *signatureWriter
+	switch {
+	case rs.skipVerify:
+		log.Warnf("Not verifying the signature of %s (--insecure-skip-verify)", link.ObjectName)
+	case link.SignedBy != "" && checksums.SHA256 != "":
+		log.Debugf("Checking %s against the sha256 of its manifest signed by %s", link.ObjectName, link.SignedBy)
+	default:
+		if verifying, err = verifySignatureOf(rs.minioClient, rs.verifier, link.ObjectName); err != nil {
+			return err
+		}
+		defer verifying.Close()
+	}
+
+	if rs.streaming {
+		return rs.streamRestore(link.ObjectName, link.Metadata.IsIncremental(), checksums, decryptor, verifying, target)
+	}
+
+	return rs.fileRestore(link.ObjectName, link.Metadata.IsIncremental(), checksums, decryptor, verifying, target)
+}
+
+// decryptor returns the Encryptor of the provider link was encrypted with,
+// whatever encryption.provider is configured now.
+func (rs *RestoreService) decryptor(link BackupChainLink) (Encryptor, error) {
+	provider := encryptionProviderOf(link)
+	if decryptor, ok := rs.decryptors[provider]; ok {
+		return decryptor, nil
+	}
+
+	decryptor, err := NewEncryptor(provider)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt backup %s: %w", link.ObjectName, err)
+	}
+	rs.decryptors[provider] = decryptor
+	return decryptor, nil
+}
+
+// fileRestore downloads, decrypts and decompresses the backup through files
+// in backup.temp_dir before importing the result. Diffs of incremental
+// backups are applied with rbd import-diff, archives of CephFS backups are
+// unpacked. The downloaded and the decompressed file are checked against
+// the checksums of the manifest, and the download against its signature
+// unless verifying is nil.
+func (rs *RestoreService) fileRestore(backupFile string, diff bool, checksums BackupManifest, decryptor Encryptor, verifying *signatureWriter, target restoreTarget) error {
+	downloadPath, err := rs.downloadBackup(backupFile, checksums, verifying)
+	if err != nil {
+		return err
 	}
 	defer RemoveFile(downloadPath)
 
-	log.Info("Decrypting backup...")
-	decryptedPath, err := rs.gpgClient.DecryptFile(downloadPath)
+	log.Infof("Decrypting backup (%s)...", decryptor.Name())
+	decryptedPath, err := decryptor.DecryptFile(downloadPath)
 	if err != nil {
 		return fmt.Errorf("failed to decrypt backup: %w", err)
 	}
@@ -82,10 +520,187 @@ func (rs *RestoreService) Run(backupFile, targetPool, targetImage string) error
 	}
 	defer RemoveFile(decompressedPath)
 
+	if err := verifyFileChecksum("decompressed backup", checksums.RawSHA256, decompressedPath); err != nil {
+		return err
+	}
+
+	if target.dir != "" {
+		log.Infof("Unpacking archive into %s...", target.dir)
+		archive, err := os.Open(decompressedPath)
+		if err != nil {
+			return fmt.Errorf("failed to open archive: %w", err)
+		}
+		defer archive.Close()
+
+		if err := extractTar(archive, target.dir); err != nil {
+			return fmt.Errorf("failed to unpack archive: %w", err)
+		}
+		return nil
+	}
+
+	if diff {
+		log.Info("Applying diff to RBD...")
+		if err := rs.cephClient.ImportDiff(target.pool, target.image, decompressedPath); err != nil {
+			return fmt.Errorf("failed to import RBD diff: %w", err)
+		}
+		return nil
+	}
+
 	log.Info("Importing to RBD...")
-	if err := rs.cephClient.ImportImage(targetPool, targetImage, decompressedPath); err != nil {
+	if err := rs.cephClient.ImportImage(target.pool, target.image, decompressedPath, target.features); err != nil {
+		return fmt.Errorf("failed to import RBD image: %w", err)
+	}
+
+	return nil
+}
+
+// downloadBackup downloads backupFile into backup.temp_dir and checks it
+// against the checksum of the manifest and, unless verifying is nil, its
+// signature. The caller removes the returned file.
+func (rs *RestoreService) downloadBackup(backupFile string, checksums BackupManifest, verifying *signatureWriter) (string, error) {
+	tempDir := viper.GetString("backup.temp_dir")
+	if tempDir == "" {
+		tempDir = "/tmp/k8s-ceph-backup"
+	}
+
+	downloadPath := filepath.Join(tempDir, backupFile)
+	if err := os.MkdirAll(filepath.Dir(downloadPath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create download directory: %w", err)
+	}
+
+	log.Info("Downloading backup from MinIO...")
+	if err := rs.minioClient.DownloadFile(backupFile, downloadPath); err != nil {
+		return "", fmt.Errorf("failed to download backup: %w", err)
+	}
+
+	if err := verifyFileChecksum("downloaded backup", checksums.SHA256, downloadPath); err != nil {
+		RemoveFile(downloadPath)
+		return "", err
+	}
+
+	if verifying != nil {
+		signer, err := verifyFileSignature(verifying, downloadPath)
+		if err != nil {
+			RemoveFile(downloadPath)
+			return "", fmt.Errorf("refusing to restore %s: %w", backupFile, err)
+		}
+		log.Infof("Signature by %s verified", signer)
+	}
+
+	return downloadPath, nil
+}
+
+// streamRestore pipes the object through decryption and gunzip into the stdin of
+// rbd import, or rbd import-diff for diffs, so no plaintext touches the
+// disk. Checksums of the manifest are verified before rbd import is allowed
+// to finish, which for a signed manifest also stands in for the signature
+// of the object. Archives of CephFS backups are unpacked as they arrive, so
+// a checksum mismatch leaves a partially restored directory.
+//
+// Unless verifying is nil, the encrypted object is first downloaded into
+// backup.temp_dir and its signature checked, so nothing unverified is ever
+// decrypted or imported. Only backups without a checksum in a signed
+// manifest take that path.
+func (rs *RestoreService) streamRestore(backupFile string, diff bool, checksums BackupManifest, decryptor Encryptor, verifying *signatureWriter, target restoreTarget) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var object io.ReadCloser
+	if verifying != nil {
+		downloadPath, err := rs.downloadBackup(backupFile, checksums, verifying)
+		if err != nil {
+			return err
+		}
+		defer RemoveFile(downloadPath)
+
+		if object, err = os.Open(downloadPath); err != nil {
+			return fmt.Errorf("failed to open downloaded backup: %w", err)
+		}
+	} else {
+		var err error
+		if object, err = rs.minioClient.DownloadStream(ctx, backupFile); err != nil {
+			return fmt.Errorf("failed to download backup: %w", err)
+		}
+	}
+	defer object.Close()
+
+	downloadHash := sha256.New()
+	plaintext, err := decryptor.DecryptStream(ctx, io.TeeReader(object, downloadHash))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt backup: %w", err)
+	}
+	defer plaintext.Close()
+
+	decompressor, err := NewDecompressReader(plaintext)
+	if err != nil {
+		return fmt.Errorf("failed to decompress backup: %w", err)
+	}
+	defer decompressor.Close()
+
+	var importer io.WriteCloser
+	switch {
+	case target.dir != "":
+		importer = newTarExtractor(target.dir)
+	case diff:
+		importer, err = rs.cephClient.ImportDiffStream(ctx, target.pool, target.image)
+	default:
+		importer, err = rs.cephClient.ImportImageStream(ctx, target.pool, target.image, target.features)
+	}
+	if err != nil {
 		return fmt.Errorf("failed to import RBD image: %w", err)
 	}
+	// abort kills rbd import before it can commit a truncated image and
+	// waits for it to exit, so nothing writes to the target once the
+	// restore has failed. The import's own error only describes the kill.
+	abort := func() {
+		cancel()
+		importer.Close()
+	}
 
+	log.Infof("Streaming backup into %s...", target)
+	rawHash := sha256.New()
+	restored, err := io.Copy(io.MultiWriter(importer, rawHash), decompressor)
+	if err != nil {
+		abort()
+		return fmt.Errorf("failed to stream backup: %w", err)
+	}
+
+	if err := plaintext.Close(); err != nil {
+		abort()
+		return fmt.Errorf("failed to decrypt backup: %w", err)
+	}
+
+	// Whatever the decryptor left unread still belongs to the object.
+	if _, err := io.Copy(downloadHash, object); err != nil {
+		abort()
+		return fmt.Errorf("failed to download backup: %w", err)
+	}
+
+	if err := verifyChecksum("downloaded backup", checksums.SHA256, hex.EncodeToString(downloadHash.Sum(nil))); err != nil {
+		abort()
+		return err
+	}
+	if err := verifyChecksum("decompressed backup", checksums.RawSHA256, hex.EncodeToString(rawHash.Sum(nil))); err != nil {
+		abort()
+		return err
+	}
+
+	if err := importer.Close(); err != nil {
+		return fmt.Errorf("failed to restore into %s: %w", target, err)
+	}
+
+	log.Infof("Streamed %d bytes into %s", restored, target)
 	return nil
-}
\ No newline at end of file
+}
+
+func verifyFileChecksum(what, expected, path string) error {
+	if expected == "" {
+		return nil
+	}
+
+	actual, err := fileSHA256(path)
+	if err != nil {
+		return fmt.Errorf("failed to checksum %s: %w", what, err)
+	}
+	return verifyChecksum(what, expected, actual)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var rewrapCmd = &cobra.Command{
+	Use:   "rewrap-keys",
+	Short: "Re-wrap the data keys of envelope encrypted backups",
+	Long: `Wrap the data key recorded in the manifest of every envelope encrypted
+backup with the newest version of the configured Vault Transit or KMS key, or
+with a newly configured key altogether. Run it after rotating the wrapping
+key so old key versions can be retired. Only the manifests are rewritten,
+the backup data is left untouched. Manifests of signed backups are verified
+against signing.trusted_keys and signed again, which requires
+signing.private_key; manifests that do not verify are skipped.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runRewrap()
+	},
+}
+
+var (
+	rewrapPrefix string
+	rewrapDryRun bool
+)
+
+func init() {
+	rootCmd.AddCommand(rewrapCmd)
+	rewrapCmd.Flags().StringVarP(&rewrapPrefix, "prefix", "p", "", "only rewrap backups whose object name starts with this prefix")
+	rewrapCmd.Flags().BoolVar(&rewrapDryRun, "dry-run", false, "list the data keys that would be rewrapped without changing anything")
+}
+
+func runRewrap() {
+	wrapper, err := newKeyWrapper("")
+	if err != nil {
+		log.Fatal("Invalid envelope configuration:", err)
+	}
+
+	var signer *Signer
+	if viper.GetString("signing.private_key") != "" {
+		if signer, err = NewSigner(); err != nil {
+			log.Fatal("Invalid signing key:", err)
+		}
+	}
+
+	verifier := NewVerifier()
+	minioClient := NewMinioClient()
+	entries, err := listBackups(minioClient, rewrapPrefix, backupFilter{})
+	if err != nil {
+		log.Fatal("Failed to list backups:", err)
+	}
+
+	log.Infof("Rewrapping data keys with %s key %s...", wrapper.Name(), wrapper.KeyID())
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "OBJECT\tFROM\tTO")
+
+	var rewrapped, failed int
+	for _, entry := range entries {
+		if entry.Manifest == nil || entry.Manifest.Envelope == nil {
+			continue
+		}
+		manifest := entry.Manifest
+
+		// listBackups reads manifests without checking them. Signed ones
+		// are read again and verified, so a manifest edited in the bucket
+		// is never signed with our key. A manifest stripped of its
+		// signature field still has its signature object next to it.
+		signed := manifest.Signature != ""
+		if !signed {
+			if signed, err = minioClient.ObjectExists(signatureObjectName(manifestObjectName(entry.Object))); err != nil {
+				log.Errorf("Failed to check the manifest signature of %s: %v", entry.Object, err)
+				failed++
+				continue
+			}
+		}
+		if signed {
+			verified, _, err := loadVerifiedManifest(minioClient, verifier, entry.Object)
+			if err != nil {
+				log.Errorf("Skipping %s: %v", entry.Object, err)
+				failed++
+				continue
+			}
+			if verified.Envelope == nil {
+				continue
+			}
+			manifest = verified
+		}
+		from := manifest.Envelope.KeyProvider + ":" + manifest.Envelope.KeyID
+
+		if rewrapDryRun {
+			fmt.Fprintf(tw, "%s\t%s\t%s:%s\n", entry.Object, from, wrapper.Name(), wrapper.KeyID())
+			rewrapped++
+			continue
+		}
+
+		// Only signed backups get their manifest signed again.
+		var manifestSigner *Signer
+		if signed {
+			if signer == nil {
+				log.Errorf("Manifest of %s is signed, set signing.private_key to rewrap its data key", entry.Object)
+				failed++
+				continue
+			}
+			manifestSigner = signer
+		}
+
+		envelope, err := rewrapDataKey(context.TODO(), wrapper, *manifest.Envelope)
+		if err == nil {
+			manifest.Envelope = &envelope
+			err = uploadManifest(minioClient, manifestSigner, manifest)
+		}
+		if err != nil {
+			log.Errorf("Failed to rewrap data key of %s: %v", entry.Object, err)
+			failed++
+			continue
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s:%s\n", entry.Object, from, envelope.KeyProvider, envelope.KeyID)
+		rewrapped++
+	}
+	tw.Flush()
+
+	if rewrapDryRun {
+		fmt.Printf("\n%d data key(s) would be rewrapped.\n", rewrapped)
+	} else {
+		fmt.Printf("\n%d data key(s) rewrapped.\n", rewrapped)
+	}
+	if failed > 0 {
+		log.Fatalf("Failed to rewrap %d data key(s)", failed)
+	}
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os/exec"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 )
 
 var validateCmd = &cobra.Command{
@@ -28,12 +33,32 @@ func runValidate() {
 
 	// Check Kubernetes connectivity
 	log.Info("Checking Kubernetes connectivity...")
-	if _, err := createK8sClient(); err != nil {
+	k8sClient, err := createK8sClient()
+	if err != nil {
 		errors = append(errors, fmt.Sprintf("Kubernetes client: %v", err))
 	} else {
 		log.Info("✓ Kubernetes client connection successful")
 	}
 
+	// Check VolumeSnapshot support
+	if k8sClient != nil && viper.GetString("backup.snapshots.method") == snapshotMethodVolumeSnapshot {
+		log.Info("Checking VolumeSnapshot API and permissions...")
+		snapshotNamespaces := viper.GetStringSlice("namespace")
+		if viper.GetBool("all_namespaces") {
+			snapshotNamespaces = []string{metav1.NamespaceAll}
+		}
+
+		var snapshotErrors []string
+		for _, namespace := range snapshotNamespaces {
+			snapshotErrors = append(snapshotErrors, validateVolumeSnapshotAccess(k8sClient, namespace)...)
+		}
+		if len(snapshotErrors) > 0 {
+			errors = append(errors, snapshotErrors...)
+		} else {
+			log.Info("✓ VolumeSnapshot API available and permitted")
+		}
+	}
+
 	// Check RBD command
 	log.Info("Checking rbd command availability...")
 	cephClient := NewCephClient()
@@ -46,13 +71,47 @@ func runValidate() {
 		log.Info("✓ rbd command available")
 	}
 
-	// Check GPG setup
-	log.Info("Checking GPG configuration...")
-	gpgClient := NewGPGClient()
-	if err := gpgClient.ValidateRecipient(); err != nil {
-		errors = append(errors, fmt.Sprintf("GPG configuration: %v", err))
+	// The ceph command is only needed for CephFS volumes
+	log.Info("Checking ceph command availability...")
+	if cephClient.cephPath == "" {
+		cephClient.cephPath = "ceph"
+	}
+	if _, err := exec.LookPath(cephClient.cephPath); err != nil {
+		log.Warnf("ceph command not found, CephFS volumes cannot be backed up: %v", err)
 	} else {
-		log.Info("✓ GPG configuration valid")
+		log.Info("✓ ceph command available")
+	}
+
+	// Check snapshot retention
+	if keep := viper.GetInt("backup.snapshots.keep"); keep < 0 {
+		errors = append(errors, fmt.Sprintf("backup.snapshots.keep is %d, it must not be negative", keep))
+	}
+
+	// Check encryption setup
+	log.Info("Checking encryption configuration...")
+	if encryptor, err := NewEncryptor(""); err != nil {
+		errors = append(errors, fmt.Sprintf("Encryption configuration: %v", err))
+	} else if err := encryptor.Validate(); err != nil {
+		errors = append(errors, fmt.Sprintf("Encryption configuration (%s): %v", encryptor.Name(), err))
+	} else {
+		log.Infof("✓ Encryption configuration valid (%s)", encryptor.Name())
+	}
+
+	// Check signing setup
+	log.Info("Checking signing configuration...")
+	if viper.GetString("signing.private_key") != "" {
+		if signer, err := NewSigner(); err != nil {
+			errors = append(errors, fmt.Sprintf("Signing key: %v", err))
+		} else {
+			log.Infof("✓ Signing key valid (%s)", signer.KeyID())
+		}
+	}
+	if len(viper.GetStringSlice("signing.trusted_keys")) == 0 && viper.GetString("signing.trusted_keys_secret") == "" {
+		log.Warn("No trusted signing keys configured, restore and verify need --insecure-skip-verify")
+	} else if err := NewVerifier().Validate(); err != nil {
+		errors = append(errors, fmt.Sprintf("Trusted signing keys: %v", err))
+	} else {
+		log.Info("✓ Trusted signing keys valid")
 	}
 
 	// Check MinIO connectivity
@@ -75,4 +134,50 @@ func runValidate() {
 		log.Info("✓ All validations passed successfully!")
 		fmt.Println("\nValidation completed successfully. The tool is ready to use.")
 	}
+}
+
+// validateVolumeSnapshotAccess checks that the snapshot.storage.k8s.io/v1 API
+// is served and that the service account may use it in namespace.
+func validateVolumeSnapshotAccess(k8sClient kubernetes.Interface, namespace string) []string {
+	var errors []string
+
+	groupVersion := volumeSnapshotResource.GroupVersion().String()
+	if _, err := k8sClient.Discovery().ServerResourcesForGroupVersion(groupVersion); err != nil {
+		return []string{fmt.Sprintf("VolumeSnapshot API %s not available (is the snapshot controller installed?): %v", groupVersion, err)}
+	}
+
+	checks := []struct {
+		resource  string
+		namespace string
+		verbs     []string
+	}{
+		{volumeSnapshotResource.Resource, namespace, []string{"create", "get", "delete"}},
+		{volumeSnapshotContentResource.Resource, "", []string{"get"}},
+	}
+
+	for _, check := range checks {
+		for _, verb := range check.verbs {
+			review := &authorizationv1.SelfSubjectAccessReview{
+				Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+					ResourceAttributes: &authorizationv1.ResourceAttributes{
+						Group:     volumeSnapshotResource.Group,
+						Resource:  check.resource,
+						Namespace: check.namespace,
+						Verb:      verb,
+					},
+				},
+			}
+
+			result, err := k8sClient.AuthorizationV1().SelfSubjectAccessReviews().Create(context.TODO(), review, metav1.CreateOptions{})
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("failed to check permission to %s %s: %v", verb, check.resource, err))
+				continue
+			}
+			if !result.Status.Allowed {
+				errors = append(errors, fmt.Sprintf("missing permission to %s %s", verb, check.resource))
+			}
+		}
+	}
+
+	return errors
 }
\ No newline at end of file
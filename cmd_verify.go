@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify [backup-file-name...]",
+	Short: "Verify the checksums and signatures of backups",
+	Long: `Download backups and check them against the checksum recorded in their
+manifest, and the signatures of the data and the manifest against
+signing.trusted_keys, without decrypting or importing anything. The stored
+Kubernetes objects are checked against the manifest as well. Without object
+names every backup under --prefix is verified, every backup in the bucket if
+it is empty.
+
+Backups without a signature from a trusted key fail verification unless
+--insecure-skip-verify is given, which only checks the checksums.`,
+	Example: `  k8s-ceph-backup verify production/data-2026-10-01T02-00-00Z.rbd.gz.gpg
+  k8s-ceph-backup verify --prefix production/`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runVerify(args)
+	},
+}
+
+var (
+	verifyPrefix     string
+	verifySkipVerify bool
+)
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+	verifyCmd.Flags().StringVarP(&verifyPrefix, "prefix", "p", "", "verify the backups whose object name starts with this prefix")
+	verifyCmd.Flags().BoolVar(&verifySkipVerify, "insecure-skip-verify", false, "only check checksums, not signatures")
+}
+
+func runVerify(args []string) {
+	minioClient := NewMinioClient()
+	verifier := NewVerifier()
+
+	var entries []BackupEntry
+	if len(args) > 0 {
+		if verifyPrefix != "" {
+			log.Fatal("--prefix cannot be combined with object names")
+		}
+		for _, objectName := range args {
+			manifest, err := loadBackupManifest(minioClient, objectName)
+			if err != nil && !isNotFound(err) {
+				log.Fatalf("Failed to read manifest of %s: %v", objectName, err)
+			}
+			entries = append(entries, BackupEntry{Object: objectName, Manifest: manifest})
+		}
+	} else {
+		var err error
+		if entries, err = listBackups(minioClient, verifyPrefix, backupFilter{}); err != nil {
+			log.Fatal("Failed to list backups:", err)
+		}
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "OBJECT\tRESULT\tSIGNED BY")
+
+	var failed int
+	for _, entry := range entries {
+		signer, err := verifyBackupObject(minioClient, verifier, entry.Object, entry.Manifest)
+		if err != nil {
+			log.Errorf("Verification of %s failed: %v", entry.Object, err)
+			fmt.Fprintf(tw, "%s\tFAILED\t-\n", entry.Object)
+			failed++
+			continue
+		}
+		if signer == "" {
+			signer = "-"
+		}
+		fmt.Fprintf(tw, "%s\tok\t%s\n", entry.Object, signer)
+	}
+	tw.Flush()
+
+	fmt.Printf("\n%d backup(s) verified.\n", len(entries)-failed)
+	if failed > 0 {
+		log.Fatalf("Verification of %d backup(s) failed", failed)
+	}
+}
+
+// verifyBackupObject downloads objectName and checks it against the
+// checksum of its manifest and, without --insecure-skip-verify, the
+// signatures of both. It returns the key that signed the object.
+func verifyBackupObject(minioClient *MinioClient, verifier *Verifier, objectName string, manifest *BackupManifest) (string, error) {
+	var verifying *signatureWriter
+	if !verifySkipVerify {
+		var err error
+		if manifest, _, err = loadVerifiedManifest(minioClient, verifier, objectName); err != nil {
+			return "", err
+		}
+		if verifying, err = verifySignatureOf(minioClient, verifier, objectName); err != nil {
+			return "", err
+		}
+		defer verifying.Close()
+	}
+	if manifest == nil {
+		log.Warnf("Backup %s has no manifest, its checksum is not verified", objectName)
+		manifest = &BackupManifest{}
+	}
+
+	if manifest.Resources != "" {
+		if _, err := loadKubeResources(minioClient, manifest); err != nil {
+			return "", fmt.Errorf("invalid Kubernetes objects: %w", err)
+		}
+	}
+
+	object, err := minioClient.DownloadStream(context.Background(), objectName)
+	if err != nil {
+		return "", fmt.Errorf("failed to download backup: %w", err)
+	}
+	defer object.Close()
+
+	downloadHash := sha256.New()
+	var downloaded io.Writer = downloadHash
+	if verifying != nil {
+		downloaded = io.MultiWriter(downloadHash, verifying)
+	}
+	if _, err := io.Copy(downloaded, object); err != nil {
+		return "", fmt.Errorf("failed to download backup: %w", err)
+	}
+
+	if err := verifyChecksum("downloaded backup", manifest.SHA256, hex.EncodeToString(downloadHash.Sum(nil))); err != nil {
+		return "", err
+	}
+	if verifying == nil {
+		return "", nil
+	}
+	return verifying.Verify()
+}
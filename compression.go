@@ -63,6 +63,12 @@ func CompressFile(inputPath string) (string, error) {
 	return outputPath, nil
 }
 
+// NewCompressWriter returns a gzip writer that compresses everything written
+// to it into w. Close must be called to flush the gzip trailer.
+func NewCompressWriter(w io.Writer) io.WriteCloser {
+	return gzip.NewWriter(w)
+}
+
 func DecompressFile(inputPath string) (string, error) {
 	log.Debugf("Decompressing file: %s", inputPath)
 
@@ -95,6 +101,17 @@ func DecompressFile(inputPath string) (string, error) {
 	return outputPath, nil
 }
 
+// NewDecompressReader returns a reader that yields the decompressed contents
+// of the gzip stream r.
+func NewDecompressReader(r io.Reader) (io.ReadCloser, error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+
+	return gzipReader, nil
+}
+
 func RemoveFile(path string) error {
 	log.Debugf("Removing file: %s", path)
 	return os.Remove(path)
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	snapshotMethodRBD            = "rbd"
+	snapshotMethodVolumeSnapshot = "volumesnapshot"
+)
+
+var (
+	volumeSnapshotResource = schema.GroupVersionResource{
+		Group:    "snapshot.storage.k8s.io",
+		Version:  "v1",
+		Resource: "volumesnapshots",
+	}
+	volumeSnapshotContentResource = schema.GroupVersionResource{
+		Group:    "snapshot.storage.k8s.io",
+		Version:  "v1",
+		Resource: "volumesnapshotcontents",
+	}
+)
+
+// cephCSIHandle is a decoded ceph-csi volume or snapshot handle of the form
+// <version>-<clusterID length>-<clusterID>-<pool ID>-<uuid>, all numbers in
+// hex.
+type cephCSIHandle struct {
+	ClusterID string
+	PoolID    int64
+	UUID      string
+}
+
+func parseCephCSIHandle(handle string) (cephCSIHandle, error) {
+	// The UUID has a fixed length of 36 characters and contains dashes
+	// itself, so it is cut off the end before splitting the rest.
+	const uuidLength = 36
+	if len(handle) < uuidLength+1 || handle[len(handle)-uuidLength-1] != '-' {
+		return cephCSIHandle{}, fmt.Errorf("invalid ceph-csi handle %q", handle)
+	}
+	uuid := handle[len(handle)-uuidLength:]
+	rest := handle[:len(handle)-uuidLength-1]
+
+	parts := strings.SplitN(rest, "-", 3)
+	if len(parts) != 3 {
+		return cephCSIHandle{}, fmt.Errorf("invalid ceph-csi handle %q", handle)
+	}
+
+	clusterIDLength, err := strconv.ParseInt(parts[1], 16, 32)
+	if err != nil || int(clusterIDLength) >= len(parts[2]) {
+		return cephCSIHandle{}, fmt.Errorf("invalid cluster ID length in ceph-csi handle %q", handle)
+	}
+
+	clusterID := parts[2][:clusterIDLength]
+	poolPart := strings.TrimPrefix(parts[2][clusterIDLength:], "-")
+
+	poolID, err := strconv.ParseInt(poolPart, 16, 64)
+	if err != nil {
+		return cephCSIHandle{}, fmt.Errorf("invalid pool ID in ceph-csi handle %q", handle)
+	}
+
+	return cephCSIHandle{ClusterID: clusterID, PoolID: poolID, UUID: uuid}, nil
+}
+
+// createVolumeSnapshot takes a snapshot.storage.k8s.io/v1 VolumeSnapshot of
+// the PVC behind image and waits until it is ready. cut is called as soon as
+// the snapshot has been taken, which can be long before it is ready. It
+// returns the pool and name of the RBD image ceph-csi created for the
+// snapshot and a function that deletes the VolumeSnapshot again.
+func (bs *BackupService) createVolumeSnapshot(image CephImage, now time.Time, cut func() error) (string, string, func(), error) {
+	ctx := context.TODO()
+	client := bs.dynamicClient.Resource(volumeSnapshotResource).Namespace(image.Namespace)
+
+	suffix := fmt.Sprintf("-backup-%d", now.Unix())
+	prefix := image.PVCName
+	if len(prefix)+len(suffix) > 253 {
+		prefix = prefix[:253-len(suffix)]
+	}
+	name := prefix + suffix
+
+	spec := map[string]interface{}{
+		"source": map[string]interface{}{
+			"persistentVolumeClaimName": image.PVCName,
+		},
+	}
+	if bs.volumeSnapshotClass != "" {
+		spec["volumeSnapshotClassName"] = bs.volumeSnapshotClass
+	}
+
+	snapshot := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "snapshot.storage.k8s.io/v1",
+		"kind":       "VolumeSnapshot",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": image.Namespace,
+			"labels": map[string]interface{}{
+				"app.kubernetes.io/managed-by": "k8s-ceph-backup",
+			},
+		},
+		"spec": spec,
+	}}
+
+	bs.logger.Infof("Creating VolumeSnapshot %s/%s for PVC %s", image.Namespace, name, image.PVCName)
+	if _, err := client.Create(ctx, snapshot, metav1.CreateOptions{}); err != nil {
+		return "", "", nil, fmt.Errorf("failed to create VolumeSnapshot: %w", err)
+	}
+
+	release := func() {
+		bs.logger.Infof("Deleting VolumeSnapshot %s/%s", image.Namespace, name)
+		err := client.Delete(context.TODO(), name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			bs.logger.Warnf("Failed to delete VolumeSnapshot %s/%s: %v", image.Namespace, name, err)
+		}
+	}
+
+	contentName, err := bs.waitForVolumeSnapshot(ctx, image.Namespace, name, cut)
+	if err != nil {
+		release()
+		return "", "", nil, err
+	}
+
+	content, err := bs.dynamicClient.Resource(volumeSnapshotContentResource).Get(ctx, contentName, metav1.GetOptions{})
+	if err != nil {
+		release()
+		return "", "", nil, fmt.Errorf("failed to get VolumeSnapshotContent %s: %w", contentName, err)
+	}
+
+	snapshotHandle, _, _ := unstructured.NestedString(content.Object, "status", "snapshotHandle")
+	if snapshotHandle == "" {
+		release()
+		return "", "", nil, fmt.Errorf("VolumeSnapshotContent %s has no snapshotHandle", contentName)
+	}
+
+	handle, err := parseCephCSIHandle(snapshotHandle)
+	if err != nil {
+		release()
+		return "", "", nil, err
+	}
+
+	// ceph-csi backs every snapshot with an RBD image named after the
+	// handle's UUID in the pool the handle's pool ID names.
+	pool, err := bs.snapshotPool(image, handle)
+	if err != nil {
+		release()
+		return "", "", nil, fmt.Errorf("VolumeSnapshotContent %s: %w", contentName, err)
+	}
+	snapshotImage := "csi-snap-" + handle.UUID
+	bs.logger.Infof("VolumeSnapshot %s/%s is backed by RBD image %s/%s", image.Namespace, name, poolSpec(pool, image.RadosNamespace), snapshotImage)
+
+	return pool, snapshotImage, release, nil
+}
+
+// snapshotPool returns the name of the pool holding the RBD image of a
+// snapshot of image. The pool of the snapshot is usually that of the
+// volume, which is known without asking the cluster when the volume's
+// handle has the same pool ID. Snapshots of another cluster are refused.
+func (bs *BackupService) snapshotPool(image CephImage, handle cephCSIHandle) (string, error) {
+	if image.ClusterID != "" && handle.ClusterID != image.ClusterID {
+		return "", fmt.Errorf("snapshot belongs to cluster %q, the volume to %q", handle.ClusterID, image.ClusterID)
+	}
+
+	if image.pv != nil && image.pv.Spec.CSI != nil {
+		volume, err := parseCephCSIHandle(image.pv.Spec.CSI.VolumeHandle)
+		if err == nil && volume.PoolID == handle.PoolID {
+			return image.Pool, nil
+		}
+	}
+
+	pool, err := bs.cephClient.PoolName(handle.PoolID)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve pool %d of the snapshot: %w", handle.PoolID, err)
+	}
+	return pool, nil
+}
+
+// waitForVolumeSnapshot polls the VolumeSnapshot until it reports
+// readyToUse and returns the name of its bound VolumeSnapshotContent. cut is
+// called once status.creationTime is set, the point in time the snapshot
+// captures; a snapshot only becomes ready after that, possibly minutes later
+// once ceph-csi has copied it.
+func (bs *BackupService) waitForVolumeSnapshot(ctx context.Context, namespace, name string, cut func() error) (string, error) {
+	client := bs.dynamicClient.Resource(volumeSnapshotResource).Namespace(namespace)
+
+	timeout := bs.volumeSnapshotTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Minute
+	}
+	deadline := time.Now().Add(timeout)
+
+	taken := false
+	for {
+		snapshot, err := client.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return "", fmt.Errorf("failed to get VolumeSnapshot %s/%s: %w", namespace, name, err)
+		}
+
+		if message, found, _ := unstructured.NestedString(snapshot.Object, "status", "error", "message"); found && message != "" {
+			return "", fmt.Errorf("VolumeSnapshot %s/%s failed: %s", namespace, name, message)
+		}
+
+		ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse")
+		creationTime, _, _ := unstructured.NestedString(snapshot.Object, "status", "creationTime")
+		if !taken && (creationTime != "" || ready) {
+			taken = true
+			bs.logger.Infof("VolumeSnapshot %s/%s taken at %s", namespace, name, creationTime)
+			if err := cut(); err != nil {
+				return "", err
+			}
+		}
+
+		contentName, _, _ := unstructured.NestedString(snapshot.Object, "status", "boundVolumeSnapshotContentName")
+		if ready && contentName != "" {
+			return contentName, nil
+		}
+
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("VolumeSnapshot %s/%s not ready after %s", namespace, name, timeout)
+		}
+
+		bs.logger.Debugf("Waiting for VolumeSnapshot %s/%s to become ready", namespace, name)
+		time.Sleep(2 * time.Second)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestSnapshotPool(t *testing.T) {
+	const (
+		volumeHandle = "0001-0009-rook-ceph-0000000000000002-7d4e9b1c-2f3a-11ee-9c1a-0a580a810224"
+		uuid         = "b1a2c3d4-2f3a-11ee-9c1a-0a580a810224"
+	)
+	bs := &BackupService{
+		// A ceph binary that does not exist makes every pool lookup fail.
+		cephClient: &CephClient{cephPath: "/nonexistent/ceph", logger: log.NewEntry(log.StandardLogger()), output: io.Discard},
+		logger:     log.NewEntry(log.StandardLogger()),
+	}
+	image := CephImage{
+		Pool:      "replicapool",
+		ClusterID: "rook-ceph",
+		pv: &corev1.PersistentVolume{Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeHandle},
+			},
+		}},
+	}
+
+	pool, err := bs.snapshotPool(image, cephCSIHandle{ClusterID: "rook-ceph", PoolID: 2, UUID: uuid})
+	if err != nil || pool != "replicapool" {
+		t.Fatalf("got pool %q, %v", pool, err)
+	}
+
+	if _, err := bs.snapshotPool(image, cephCSIHandle{ClusterID: "rook-ceph", PoolID: 3, UUID: uuid}); err == nil ||
+		!strings.Contains(err.Error(), "pool 3") {
+		t.Fatalf("expected a pool lookup error, got %v", err)
+	}
+
+	if _, err := bs.snapshotPool(image, cephCSIHandle{ClusterID: "other", PoolID: 2, UUID: uuid}); err == nil {
+		t.Fatal("snapshot of another cluster accepted")
+	}
+}
+
+func TestWaitForVolumeSnapshotReleasesHooksWhenTaken(t *testing.T) {
+	snapshot := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "snapshot.storage.k8s.io/v1",
+		"kind":       "VolumeSnapshot",
+		"metadata":   map[string]interface{}{"name": "data-backup-1", "namespace": "production"},
+		"status":     map[string]interface{}{"creationTime": "2026-10-17T02:00:00Z", "readyToUse": false},
+	}}
+	bs := &BackupService{
+		dynamicClient: dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+			map[schema.GroupVersionResource]string{volumeSnapshotResource: "VolumeSnapshotList"}, snapshot),
+		volumeSnapshotTimeout: time.Nanosecond,
+		logger:                log.NewEntry(log.StandardLogger()),
+	}
+
+	var cuts int
+	_, err := bs.waitForVolumeSnapshot(context.Background(), "production", "data-backup-1", func() error {
+		cuts++
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "not ready") {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if cuts != 1 {
+		t.Fatalf("hooks released %d times before the snapshot was ready, expected 1", cuts)
+	}
+
+	hookErr := errors.New("unfreeze failed")
+	if _, err := bs.waitForVolumeSnapshot(context.Background(), "production", "data-backup-1", func() error { return hookErr }); !errors.Is(err, hookErr) {
+		t.Fatalf("expected the hook error, got %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Encryption providers, selected with encryption.provider and recorded with
+// every backup so restores pick the matching decryptor.
+const (
+	encryptionProviderGPG      = "gpg"
+	encryptionProviderAge      = "age"
+	encryptionProviderEnvelope = "envelope"
+)
+
+// Encryptor encrypts backups before upload and decrypts them on restore.
+type Encryptor interface {
+	// Name is the provider name recorded in object metadata and manifests.
+	Name() string
+	// Suffix is appended to the object names of backups it encrypts.
+	Suffix() string
+
+	EncryptFile(inputPath string) (string, error)
+	EncryptStream(ctx context.Context, w io.Writer) (io.WriteCloser, error)
+	DecryptFile(inputPath string) (string, error)
+	DecryptStream(ctx context.Context, r io.Reader) (io.ReadCloser, error)
+
+	// Validate checks that backups can be encrypted with the configured
+	// keys.
+	Validate() error
+	// Recipients identifies the keys backups are encrypted to, as recorded
+	// in manifests.
+	Recipients() ([]string, error)
+
+	WithPrefix(prefix string) Encryptor
+}
+
+// NewEncryptor returns the encryption provider named provider, or the one
+// configured as encryption.provider if provider is empty.
+func NewEncryptor(provider string) (Encryptor, error) {
+	if provider == "" {
+		provider = viper.GetString("encryption.provider")
+	}
+
+	switch provider {
+	case "", encryptionProviderGPG:
+		return NewGPGClient(), nil
+	case encryptionProviderAge:
+		return NewAgeClient(), nil
+	case encryptionProviderEnvelope:
+		return NewEnvelopeClient(), nil
+	}
+	return nil, fmt.Errorf("unknown encryption provider %q (expected %q, %q or %q)", provider, encryptionProviderGPG, encryptionProviderAge, encryptionProviderEnvelope)
+}
+
+// encryptorForBackup returns e, or for providers with a data key per backup
+// a copy of e holding a new one, recorded in manifest.
+func encryptorForBackup(ctx context.Context, e Encryptor, manifest *BackupManifest) (Encryptor, error) {
+	if keyed, ok := e.(dataKeyEncryptor); ok {
+		return keyed.ForBackup(ctx, manifest)
+	}
+	return e, nil
+}
+
+// decryptorForBackup returns e, or for providers with a data key per backup
+// a copy of e holding the one recorded in manifest.
+func decryptorForBackup(ctx context.Context, e Encryptor, manifest *BackupManifest) (Encryptor, error) {
+	if keyed, ok := e.(dataKeyEncryptor); ok {
+		return keyed.ForRestore(ctx, manifest)
+	}
+	return e, nil
+}
+
+// encryptionProviderOf returns the provider a backup was encrypted with.
+// Backups written before providers were recorded are OpenPGP, unless their
+// name says otherwise.
+func encryptionProviderOf(link BackupChainLink) string {
+	if link.Manifest != nil && link.Manifest.Encryption != "" {
+		return link.Manifest.Encryption
+	}
+	if link.Metadata.Encryption != "" {
+		return link.Metadata.Encryption
+	}
+	if strings.HasSuffix(link.ObjectName, ageSuffix) {
+		return encryptionProviderAge
+	}
+	if strings.HasSuffix(link.ObjectName, envelopeSuffix) {
+		return encryptionProviderEnvelope
+	}
+	return encryptionProviderGPG
+}
+
+// encryptFile encrypts inputPath with e into a file next to it, named with
+// e's suffix.
+func encryptFile(e Encryptor, logger *log.Entry, inputPath string) (string, error) {
+	logger.Debugf("Encrypting file: %s", inputPath)
+
+	input, err := os.Open(inputPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file to encrypt: %w", err)
+	}
+	defer input.Close()
+
+	outputPath := inputPath + e.Suffix()
+	output, err := os.Create(outputPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create encrypted file: %w", err)
+	}
+	defer output.Close()
+
+	encryptor, err := e.EncryptStream(context.Background(), output)
+	if err != nil {
+		os.Remove(outputPath)
+		return "", err
+	}
+	if _, err := io.Copy(encryptor, input); err != nil {
+		encryptor.Close()
+		os.Remove(outputPath)
+		return "", fmt.Errorf("%s encryption failed: %w", e.Name(), err)
+	}
+	if err := encryptor.Close(); err != nil {
+		os.Remove(outputPath)
+		return "", fmt.Errorf("%s encryption failed: %w", e.Name(), err)
+	}
+	if err := output.Close(); err != nil {
+		os.Remove(outputPath)
+		return "", fmt.Errorf("failed to write encrypted file: %w", err)
+	}
+
+	info, err := os.Stat(outputPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat encrypted file: %w", err)
+	}
+
+	logger.Infof("Successfully encrypted file to %s (size: %d bytes)", outputPath, info.Size())
+	return outputPath, nil
+}
+
+// decryptFile decrypts inputPath with e into a file named without the
+// encryption suffix.
+func decryptFile(e Encryptor, logger *log.Entry, inputPath string) (string, error) {
+	logger.Debugf("Decrypting file: %s", inputPath)
+
+	outputPath, ok := trimEncryptionSuffix(inputPath)
+	if !ok {
+		outputPath += ".decrypted"
+	}
+
+	input, err := os.Open(inputPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file to decrypt: %w", err)
+	}
+	defer input.Close()
+
+	output, err := os.Create(outputPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create decrypted file: %w", err)
+	}
+	defer output.Close()
+
+	decryptor, err := e.DecryptStream(context.Background(), input)
+	if err != nil {
+		os.Remove(outputPath)
+		return "", err
+	}
+	_, err = io.Copy(output, decryptor)
+	if closeErr := decryptor.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(outputPath)
+		return "", fmt.Errorf("%s decryption failed: %w", e.Name(), err)
+	}
+	if err := output.Close(); err != nil {
+		os.Remove(outputPath)
+		return "", fmt.Errorf("failed to write decrypted file: %w", err)
+	}
+
+	info, err := os.Stat(outputPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat decrypted file: %w", err)
+	}
+
+	logger.Infof("Successfully decrypted file to %s (size: %d bytes)", outputPath, info.Size())
+	return outputPath, nil
+}
+
+// decryptReader drains the plaintext and its source on Close. Authenticity
+// is only fully checked at the end of the data, and checksums of the source
+// have to cover all of it.
+type decryptReader struct {
+	io.Reader
+	source io.Reader
+	name   string
+
+	closed bool
+	err    error
+}
+
+func (d *decryptReader) Close() error {
+	if d.closed {
+		return d.err
+	}
+	d.closed = true
+
+	if _, err := io.Copy(io.Discard, d.Reader); err != nil {
+		d.err = fmt.Errorf("%s decryption failed: %w", d.name, err)
+		return d.err
+	}
+	_, d.err = io.Copy(io.Discard, d.source)
+	return d.err
+}
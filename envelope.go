@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Key management services data keys are wrapped with, selected with
+// envelope.key_provider.
+const (
+	keyProviderVault = "vault"
+	keyProviderKMS   = "kms"
+)
+
+const (
+	envelopeAlgorithm = "AES-256-GCM"
+	envelopeMagic     = "k8s-ceph-backup envelope v1\n"
+	envelopeChunkSize = 64 * 1024
+	dataKeySize       = 32
+)
+
+// EnvelopeKey is the data key of an envelope encrypted backup as recorded
+// in its manifest, wrapped by a key that never leaves the key management
+// service.
+type EnvelopeKey struct {
+	Algorithm   string    `json:"algorithm"`
+	KeyProvider string    `json:"key_provider"`
+	KeyID       string    `json:"key_id"`
+	WrappedKey  string    `json:"wrapped_key"`
+	Rewrapped   time.Time `json:"rewrapped,omitempty"`
+}
+
+// KeyWrapper wraps and unwraps data keys with a key held by a key
+// management service.
+type KeyWrapper interface {
+	Name() string
+	// KeyID names the configured wrapping key.
+	KeyID() string
+
+	Wrap(ctx context.Context, key []byte) (EnvelopeKey, error)
+	Unwrap(ctx context.Context, wrapped EnvelopeKey) ([]byte, error)
+	// Rewrap wraps the data key of wrapped with the newest version of the
+	// configured key, without the data key leaving the service where it
+	// supports that.
+	Rewrap(ctx context.Context, wrapped EnvelopeKey) (EnvelopeKey, error)
+}
+
+// newKeyWrapper returns the KeyWrapper of the named key management service,
+// or of the configured envelope.key_provider if provider is empty.
+func newKeyWrapper(provider string) (KeyWrapper, error) {
+	if provider == "" {
+		provider = viper.GetString("envelope.key_provider")
+	}
+
+	switch provider {
+	case "", keyProviderVault:
+		return NewVaultTransit()
+	case keyProviderKMS:
+		return NewKMSClient()
+	}
+	return nil, fmt.Errorf("unknown envelope.key_provider %q (expected %q or %q)", provider, keyProviderVault, keyProviderKMS)
+}
+
+// rewrapDataKey wraps the data key of wrapped with target's key. Keys of the
+// same service are rewrapped in place, keys of another service are
+// unwrapped by it first.
+func rewrapDataKey(ctx context.Context, target KeyWrapper, wrapped EnvelopeKey) (EnvelopeKey, error) {
+	var rewrapped EnvelopeKey
+	if wrapped.KeyProvider == target.Name() {
+		var err error
+		if rewrapped, err = target.Rewrap(ctx, wrapped); err != nil {
+			return EnvelopeKey{}, err
+		}
+	} else {
+		source, err := newKeyWrapper(wrapped.KeyProvider)
+		if err != nil {
+			return EnvelopeKey{}, err
+		}
+		key, err := source.Unwrap(ctx, wrapped)
+		if err != nil {
+			return EnvelopeKey{}, err
+		}
+		if rewrapped, err = target.Wrap(ctx, key); err != nil {
+			return EnvelopeKey{}, err
+		}
+	}
+
+	rewrapped.Algorithm = wrapped.Algorithm
+	rewrapped.Rewrapped = time.Now().UTC()
+	return rewrapped, nil
+}
+
+// dataKeyEncryptor is implemented by providers that encrypt every backup
+// with a data key of its own, kept wrapped in the backup's manifest.
+type dataKeyEncryptor interface {
+	Encryptor
+	// ForBackup generates the data key of a new backup, records it wrapped
+	// in manifest and returns an Encryptor using it.
+	ForBackup(ctx context.Context, manifest *BackupManifest) (Encryptor, error)
+	// ForRestore returns an Encryptor using the data key unwrapped from
+	// manifest.
+	ForRestore(ctx context.Context, manifest *BackupManifest) (Encryptor, error)
+}
+
+// EnvelopeClient encrypts every backup with a random data key in chunks of
+// AES-256-GCM. The data key is wrapped by Vault Transit or KMS and stored in
+// the manifest, so rotating the wrapping key only means rewrapping data
+// keys. Only copies returned by ForBackup and ForRestore hold a data key.
+type EnvelopeClient struct {
+	keyProvider string
+	dataKey     []byte
+
+	logger *log.Entry
+}
+
+func NewEnvelopeClient() *EnvelopeClient {
+	keyProvider := viper.GetString("envelope.key_provider")
+	if keyProvider == "" {
+		keyProvider = keyProviderVault
+	}
+
+	return &EnvelopeClient{
+		keyProvider: keyProvider,
+		logger:      log.NewEntry(log.StandardLogger()),
+	}
+}
+
+// WithPrefix returns a copy of the client whose log messages are prefixed
+// with prefix.
+func (e *EnvelopeClient) WithPrefix(prefix string) Encryptor {
+	prefixed := *e
+	prefixed.logger = log.WithField(logPrefixField, prefix)
+	return &prefixed
+}
+
+// Name returns the provider name recorded with backups.
+func (e *EnvelopeClient) Name() string {
+	return encryptionProviderEnvelope
+}
+
+// Suffix returns the file and object suffix of envelope encrypted data.
+func (e *EnvelopeClient) Suffix() string {
+	return envelopeSuffix
+}
+
+// ForBackup generates a data key and records it, wrapped with the
+// configured key, in manifest.
+func (e *EnvelopeClient) ForBackup(ctx context.Context, manifest *BackupManifest) (Encryptor, error) {
+	wrapper, err := newKeyWrapper(e.keyProvider)
+	if err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	wrapped, err := wrapper.Wrap(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	wrapped.Algorithm = envelopeAlgorithm
+	manifest.Envelope = &wrapped
+
+	e.logger.Debugf("Wrapped data key with %s key %s", wrapped.KeyProvider, wrapped.KeyID)
+
+	keyed := *e
+	keyed.dataKey = key
+	return &keyed, nil
+}
+
+// ForRestore unwraps the data key recorded in manifest with the key
+// management service it was wrapped by.
+func (e *EnvelopeClient) ForRestore(ctx context.Context, manifest *BackupManifest) (Encryptor, error) {
+	if manifest == nil || manifest.Envelope == nil {
+		return nil, fmt.Errorf("no wrapped data key recorded, the backup's manifest is required to decrypt it")
+	}
+	wrapped := *manifest.Envelope
+	if wrapped.Algorithm != envelopeAlgorithm {
+		return nil, fmt.Errorf("unsupported envelope algorithm %q", wrapped.Algorithm)
+	}
+
+	wrapper, err := newKeyWrapper(wrapped.KeyProvider)
+	if err != nil {
+		return nil, err
+	}
+	key, err := wrapper.Unwrap(ctx, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("unwrapped data key has %d bytes, expected %d", len(key), dataKeySize)
+	}
+
+	keyed := *e
+	keyed.dataKey = key
+	return &keyed, nil
+}
+
+// EncryptFile encrypts inputPath into a file named with Suffix.
+func (e *EnvelopeClient) EncryptFile(inputPath string) (string, error) {
+	return encryptFile(e, e.logger, inputPath)
+}
+
+// EncryptStream returns a writer encrypting its input with the data key and
+// writing it to w. Close seals the final chunk; it does not close w.
+func (e *EnvelopeClient) EncryptStream(ctx context.Context, w io.Writer) (io.WriteCloser, error) {
+	e.logger.Debug("Starting streaming envelope encryption")
+
+	aead, err := e.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	header := envelopeHeader(envelopeChunkSize)
+	if _, err := w.Write(header); err != nil {
+		return nil, fmt.Errorf("failed to write envelope header: %w", err)
+	}
+
+	return &envelopeWriter{
+		w:         w,
+		aead:      aead,
+		header:    header,
+		chunkSize: envelopeChunkSize,
+		buf:       make([]byte, 0, envelopeChunkSize+1),
+	}, nil
+}
+
+// DecryptFile decrypts inputPath into a file named without its encryption
+// suffix.
+func (e *EnvelopeClient) DecryptFile(inputPath string) (string, error) {
+	return decryptFile(e, e.logger, inputPath)
+}
+
+// DecryptStream decrypts the data read from r with the data key. Every
+// chunk is authenticated as it is read and Close reads whatever the caller
+// left unread, so a truncated or reordered stream is reported.
+func (e *EnvelopeClient) DecryptStream(ctx context.Context, r io.Reader) (io.ReadCloser, error) {
+	e.logger.Debug("Starting streaming envelope decryption")
+
+	aead, err := e.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	source := bufio.NewReader(r)
+	header := make([]byte, len(envelopeMagic)+4)
+	if _, err := io.ReadFull(source, header); err != nil {
+		return nil, fmt.Errorf("failed to read envelope header: %w", err)
+	}
+	if string(header[:len(envelopeMagic)]) != envelopeMagic {
+		return nil, fmt.Errorf("not envelope encrypted data")
+	}
+	chunkSize := int(binary.BigEndian.Uint32(header[len(envelopeMagic):]))
+	if chunkSize == 0 || chunkSize > 16*1024*1024 {
+		return nil, fmt.Errorf("invalid envelope chunk size %d", chunkSize)
+	}
+
+	plaintext := &envelopeReader{
+		r:         source,
+		aead:      aead,
+		header:    header,
+		chunkSize: chunkSize,
+		chunk:     make([]byte, chunkSize+aead.Overhead()),
+	}
+	return &decryptReader{Reader: plaintext, source: source, name: "envelope"}, nil
+}
+
+// Validate checks that a data key can be wrapped with the configured key.
+func (e *EnvelopeClient) Validate() error {
+	wrapper, err := newKeyWrapper(e.keyProvider)
+	if err != nil {
+		return err
+	}
+
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("failed to generate data key: %w", err)
+	}
+	wrapped, err := wrapper.Wrap(context.Background(), key)
+	if err != nil {
+		return fmt.Errorf("failed to wrap data key: %w", err)
+	}
+
+	e.logger.Debugf("Data keys are wrapped with %s key %s", wrapped.KeyProvider, wrapped.KeyID)
+	return nil
+}
+
+// Recipients returns the configured wrapping key. The key each data key is
+// actually wrapped with is recorded with it.
+func (e *EnvelopeClient) Recipients() ([]string, error) {
+	wrapper, err := newKeyWrapper(e.keyProvider)
+	if err != nil {
+		return nil, err
+	}
+	return []string{wrapper.Name() + ":" + wrapper.KeyID()}, nil
+}
+
+func (e *EnvelopeClient) aead() (cipher.AEAD, error) {
+	if e.dataKey == nil {
+		return nil, fmt.Errorf("no data key, envelope encryption needs the backup's manifest")
+	}
+	block, err := aes.NewCipher(e.dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up AES: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// envelopeHeader is written before the first chunk and authenticated with
+// every chunk.
+func envelopeHeader(chunkSize int) []byte {
+	header := make([]byte, len(envelopeMagic)+4)
+	copy(header, envelopeMagic)
+	binary.BigEndian.PutUint32(header[len(envelopeMagic):], uint32(chunkSize))
+	return header
+}
+
+// envelopeNonce is the chunk counter followed by a flag marking the final
+// chunk, so chunks cannot be reordered, dropped or cut off at a chunk
+// boundary unnoticed. A data key encrypts a single stream only.
+func envelopeNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// envelopeWriter seals its input in chunks of chunkSize. A chunk is only
+// sealed once more input follows it, so Close can seal the last one as
+// final, even if it is empty.
+type envelopeWriter struct {
+	w         io.Writer
+	aead      cipher.AEAD
+	header    []byte
+	chunkSize int
+
+	buf     []byte
+	counter uint64
+	closed  bool
+}
+
+func (e *envelopeWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to closed envelope writer")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := e.chunkSize + 1 - len(e.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		e.buf = append(e.buf, p[:n]...)
+		p = p[n:]
+		written += n
+
+		if len(e.buf) > e.chunkSize {
+			if err := e.seal(e.buf[:e.chunkSize], false); err != nil {
+				return written, err
+			}
+			e.buf = append(e.buf[:0], e.buf[e.chunkSize:]...)
+		}
+	}
+	return written, nil
+}
+
+func (e *envelopeWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.seal(e.buf, true)
+}
+
+func (e *envelopeWriter) seal(chunk []byte, final bool) error {
+	sealed := e.aead.Seal(nil, envelopeNonce(e.counter, final), chunk, e.header)
+	e.counter++
+	if _, err := e.w.Write(sealed); err != nil {
+		return err
+	}
+	return nil
+}
+
+// envelopeReader opens the chunks written by envelopeWriter. A short chunk,
+// or a full one at the end of the stream, has to be the final one.
+type envelopeReader struct {
+	r         *bufio.Reader
+	aead      cipher.AEAD
+	header    []byte
+	chunkSize int
+
+	chunk   []byte
+	pending []byte
+	counter uint64
+	done    bool
+	err     error
+}
+
+func (e *envelopeReader) Read(p []byte) (int, error) {
+	for len(e.pending) == 0 {
+		if e.err != nil {
+			return 0, e.err
+		}
+		if e.done {
+			return 0, io.EOF
+		}
+		e.pending, e.err = e.open()
+	}
+
+	n := copy(p, e.pending)
+	e.pending = e.pending[n:]
+	return n, nil
+}
+
+func (e *envelopeReader) open() ([]byte, error) {
+	n, err := io.ReadFull(e.r, e.chunk)
+	final := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		final = true
+	case err != nil:
+		return nil, err
+	default:
+		if _, err := e.r.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if n < e.aead.Overhead() {
+		return nil, fmt.Errorf("envelope encrypted data is truncated")
+	}
+
+	plaintext, err := e.aead.Open(e.chunk[:0], envelopeNonce(e.counter, final), e.chunk[:n], e.header)
+	if err != nil {
+		if final {
+			return nil, fmt.Errorf("envelope encrypted data is truncated or corrupted")
+		}
+		return nil, fmt.Errorf("envelope encrypted data is corrupted at chunk %d", e.counter)
+	}
+	e.counter++
+	e.done = final
+
+	// Open reuses the chunk buffer, so the plaintext has to be consumed
+	// before the next chunk is read, which Read ensures.
+	return plaintext, nil
+}
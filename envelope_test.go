@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func newTestEnvelope(t *testing.T) *EnvelopeClient {
+	t.Helper()
+
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return &EnvelopeClient{dataKey: key, logger: log.NewEntry(log.StandardLogger())}
+}
+
+func envelopeEncrypt(t *testing.T, e *EnvelopeClient, plaintext []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w, err := e.EncryptStream(context.Background(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// envelopeDecrypt reads all of ciphertext like a restore does, returning
+// the first error of reading or closing.
+func envelopeDecrypt(e *EnvelopeClient, ciphertext []byte) ([]byte, error) {
+	r, err := e.DecryptStream(context.Background(), bytes.NewReader(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := io.ReadAll(r)
+	if closeErr := r.Close(); err == nil {
+		err = closeErr
+	}
+	return plaintext, err
+}
+
+// envelopeChunks splits ciphertext into its header and sealed chunks.
+func envelopeChunks(ciphertext []byte) ([]byte, [][]byte) {
+	headerSize := len(envelopeMagic) + 4
+	sealedSize := envelopeChunkSize + 16
+
+	header, rest := ciphertext[:headerSize], ciphertext[headerSize:]
+	var chunks [][]byte
+	for len(rest) > sealedSize {
+		chunks = append(chunks, rest[:sealedSize])
+		rest = rest[sealedSize:]
+	}
+	return header, append(chunks, rest)
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	e := newTestEnvelope(t)
+
+	for _, size := range []int{0, 1, envelopeChunkSize - 1, envelopeChunkSize, envelopeChunkSize + 1, 3 * envelopeChunkSize, 3*envelopeChunkSize + 100} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+
+		decrypted, err := envelopeDecrypt(e, envelopeEncrypt(t, e, plaintext))
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Fatalf("size %d: decrypted data differs", size)
+		}
+	}
+}
+
+func TestEnvelopeTampering(t *testing.T) {
+	e := newTestEnvelope(t)
+	plaintext := make([]byte, 2*envelopeChunkSize+1000)
+	rand.Read(plaintext)
+	ciphertext := envelopeEncrypt(t, e, plaintext)
+	header, chunks := envelopeChunks(ciphertext)
+	if len(chunks) != 3 {
+		t.Fatalf("expected 3 chunks, got %d", len(chunks))
+	}
+
+	join := func(chunks ...[]byte) []byte {
+		return bytes.Join(append([][]byte{header}, chunks...), nil)
+	}
+
+	for name, tampered := range map[string][]byte{
+		"truncated stream":    ciphertext[:len(ciphertext)-10],
+		"truncated header":    ciphertext[:len(envelopeMagic)],
+		"reordered chunks":    join(chunks[1], chunks[0], chunks[2]),
+		"missing final chunk": join(chunks[0], chunks[1]),
+		"missing chunk":       join(chunks[0], chunks[2]),
+		"duplicated chunk":    join(chunks[0], chunks[0], chunks[1], chunks[2]),
+		"flipped bit": func() []byte {
+			flipped := append([]byte{}, ciphertext...)
+			flipped[len(header)+100] ^= 1
+			return flipped
+		}(),
+		"trailing data": append(append([]byte{}, ciphertext...), make([]byte, 32)...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := envelopeDecrypt(e, tampered); err == nil {
+				t.Fatal("tampered stream decrypted without error")
+			}
+		})
+	}
+}
+
+func TestEnvelopeWrongKey(t *testing.T) {
+	ciphertext := envelopeEncrypt(t, newTestEnvelope(t), []byte("secret"))
+	if _, err := envelopeDecrypt(newTestEnvelope(t), ciphertext); err == nil {
+		t.Fatal("decrypted with another data key")
+	}
+}
+
+func TestEnvelopeWithoutDataKey(t *testing.T) {
+	e := &EnvelopeClient{logger: log.NewEntry(log.StandardLogger())}
+	if _, err := e.EncryptStream(context.Background(), io.Discard); err == nil {
+		t.Fatal("encrypted without a data key")
+	}
+}
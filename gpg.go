@@ -1,175 +1,438 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// GPGClient encrypts backups to OpenPGP public keys and decrypts them with
+// the matching private keys, in process. Keys are read from armored files,
+// directories of them or a Kubernetes Secret on first use.
 type GPGClient struct {
-	gpgPath    string
+	publicKeys        []string
+	publicKeysSecret  string
+	privateKeys       []string
+	privateKeysSecret string
+	passphrase        string
+	passphraseFile    string
+
+	// armor selects ASCII armored instead of binary output.
+	armor bool
+
+	// recipients pins the public keys to encrypt to by fingerprint.
+	// recipient is the older selector matched against user IDs.
+	recipients []string
 	recipient  string
-	keyring    string
-	trustModel string
+
+	// keys is shared by the copies WithPrefix returns, so keys are only
+	// loaded once per run.
+	keys *gpgKeys
+
+	logger *log.Entry
+}
+
+type gpgKeys struct {
+	publicOnce  sync.Once
+	public      openpgp.EntityList
+	publicErr   error
+	privateOnce sync.Once
+	private     openpgp.EntityList
+	privateErr  error
 }
 
 func NewGPGClient() *GPGClient {
 	return &GPGClient{
-		gpgPath:    viper.GetString("gpg.path"),
-		recipient:  viper.GetString("gpg.recipient"),
-		keyring:    viper.GetString("gpg.keyring"),
-		trustModel: viper.GetString("gpg.trust_model"),
+		publicKeys:        viper.GetStringSlice("gpg.public_keys"),
+		publicKeysSecret:  viper.GetString("gpg.public_keys_secret"),
+		privateKeys:       viper.GetStringSlice("gpg.private_keys"),
+		privateKeysSecret: viper.GetString("gpg.private_keys_secret"),
+		passphrase:        viper.GetString("gpg.passphrase"),
+		passphraseFile:    viper.GetString("gpg.passphrase_file"),
+		armor:             viper.GetBool("gpg.armor"),
+		recipients:        viper.GetStringSlice("gpg.recipients"),
+		recipient:         viper.GetString("gpg.recipient"),
+		keys:              &gpgKeys{},
+		logger:            log.NewEntry(log.StandardLogger()),
 	}
 }
 
-func (g *GPGClient) EncryptFile(inputPath string) (string, error) {
-	log.Debugf("Encrypting file: %s", inputPath)
+// WithPrefix returns a copy of the client whose log messages are prefixed
+// with prefix.
+func (g *GPGClient) WithPrefix(prefix string) Encryptor {
+	prefixed := *g
+	prefixed.logger = log.WithField(logPrefixField, prefix)
+	return &prefixed
+}
 
-	if g.gpgPath == "" {
-		g.gpgPath = "gpg"
-	}
+// packetConfig is used for encryption. The data is already compressed, so
+// OpenPGP compression stays off.
+var packetConfig = &packet.Config{
+	DefaultCipher:          packet.CipherAES256,
+	DefaultCompressionAlgo: packet.CompressionNone,
+}
 
-	if g.recipient == "" {
-		return "", fmt.Errorf("GPG recipient not configured")
+// Name returns the provider name recorded with backups.
+func (g *GPGClient) Name() string {
+	return encryptionProviderGPG
+}
+
+// Suffix returns the file and object suffix of the configured output
+// format.
+func (g *GPGClient) Suffix() string {
+	if g.armor {
+		return armoredPGPSuffix
 	}
+	return binaryPGPSuffix
+}
+
+// EncryptFile encrypts inputPath into a file named with Suffix.
+func (g *GPGClient) EncryptFile(inputPath string) (string, error) {
+	return encryptFile(g, g.logger, inputPath)
+}
+
+// EncryptStream returns a writer encrypting its input to the recipients'
+// public keys and writing the binary, or with gpg.armor the armored,
+// ciphertext to w. Close finishes the message; it does not close w.
+func (g *GPGClient) EncryptStream(ctx context.Context, w io.Writer) (io.WriteCloser, error) {
+	g.logger.Debug("Starting streaming GPG encryption")
 
-	outputPath := inputPath + ".gpg"
+	recipients, err := g.recipientKeys()
+	if err != nil {
+		return nil, err
+	}
 
-	args := []string{
-		"--encrypt",
-		"--armor",
-		"--recipient", g.recipient,
-		"--output", outputPath,
+	if !g.armor {
+		plaintext, err := openpgp.Encrypt(w, recipients, nil, &openpgp.FileHints{IsBinary: true}, packetConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start GPG encryption: %w", err)
+		}
+		return plaintext, nil
 	}
 
-	if g.keyring != "" {
-		args = append(args, "--keyring", g.keyring)
+	armored, err := armor.Encode(w, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start GPG encryption: %w", err)
+	}
+	plaintext, err := openpgp.Encrypt(armored, recipients, nil, &openpgp.FileHints{IsBinary: true}, packetConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start GPG encryption: %w", err)
 	}
+	return &armoredWriter{WriteCloser: plaintext, armor: armored}, nil
+}
 
-	if g.trustModel != "" {
-		args = append(args, "--trust-model", g.trustModel)
-	} else {
-		args = append(args, "--trust-model", "always")
+// armoredWriter closes the armor encoder after the OpenPGP message.
+type armoredWriter struct {
+	io.WriteCloser
+	armor io.WriteCloser
+}
+
+func (a *armoredWriter) Close() error {
+	if err := a.WriteCloser.Close(); err != nil {
+		return err
 	}
+	return a.armor.Close()
+}
 
-	args = append(args, inputPath)
+// DecryptFile decrypts inputPath into a file named without its encryption
+// suffix.
+func (g *GPGClient) DecryptFile(inputPath string) (string, error) {
+	return decryptFile(g, g.logger, inputPath)
+}
 
-	log.Debugf("Running GPG command: %s %v", g.gpgPath, args)
+// DecryptStream decrypts the armored or binary OpenPGP message read from r
+// and returns its plaintext. The message's integrity is only checked at its
+// end, so Close reads whatever the caller left unread and reports a failed
+// check.
+func (g *GPGClient) DecryptStream(ctx context.Context, r io.Reader) (io.ReadCloser, error) {
+	g.logger.Debug("Starting streaming GPG decryption")
 
-	cmd := exec.Command(g.gpgPath, args...)
-	
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	keys, err := g.privateKeyRing()
+	if err != nil {
+		return nil, err
+	}
 
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("GPG encryption failed: %w", err)
+	source := bufio.NewReader(r)
+	var message io.Reader = source
+	if prefix, _ := source.Peek(len("-----BEGIN PGP")); string(prefix) == "-----BEGIN PGP" {
+		block, err := armor.Decode(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read armored GPG message: %w", err)
+		}
+		message = block.Body
 	}
 
-	info, err := os.Stat(outputPath)
+	details, err := openpgp.ReadMessage(message, keys, nil, packetConfig)
 	if err != nil {
-		return "", fmt.Errorf("failed to stat encrypted file: %w", err)
+		return nil, fmt.Errorf("GPG decryption failed: %w", err)
 	}
 
-	log.Infof("Successfully encrypted file to %s (size: %d bytes)", outputPath, info.Size())
-	return outputPath, nil
+	return &decryptReader{Reader: details.UnverifiedBody, source: source, name: "GPG"}, nil
 }
 
-func (g *GPGClient) DecryptFile(inputPath string) (string, error) {
-	log.Debugf("Decrypting file: %s", inputPath)
-
-	if g.gpgPath == "" {
-		g.gpgPath = "gpg"
+// Validate checks that the configured public keys can be loaded and that
+// every recipient has a usable encryption key.
+func (g *GPGClient) Validate() error {
+	recipients, err := g.recipientKeys()
+	if err != nil {
+		return err
 	}
 
-	outputPath := filepath.Dir(inputPath) + "/" + filepath.Base(inputPath)
-	if filepath.Ext(outputPath) == ".gpg" {
-		outputPath = outputPath[:len(outputPath)-4]
+	for _, entity := range recipients {
+		g.logger.Debugf("GPG recipient %s (%s)", fingerprint(entity), entityName(entity))
 	}
+	return nil
+}
 
-	args := []string{
-		"--decrypt",
-		"--output", outputPath,
+// Recipients returns the primary key fingerprints of the keys backups are
+// encrypted to, as recorded in backup manifests.
+func (g *GPGClient) Recipients() ([]string, error) {
+	recipients, err := g.recipientKeys()
+	if err != nil {
+		return nil, err
 	}
 
-	if g.keyring != "" {
-		args = append(args, "--keyring", g.keyring)
+	var fingerprints []string
+	for _, entity := range recipients {
+		fingerprints = append(fingerprints, fingerprint(entity))
 	}
+	return fingerprints, nil
+}
 
-	args = append(args, inputPath)
+// recipientKeys returns the public keys to encrypt to: the keys pinned by
+// gpg.recipients, those whose user ID contains gpg.recipient, or else all
+// configured keys. Each has to have a valid encryption key.
+func (g *GPGClient) recipientKeys() (openpgp.EntityList, error) {
+	g.keys.publicOnce.Do(func() {
+		g.keys.public, g.keys.publicErr = loadKeys(g.publicKeys, g.publicKeysSecret)
+	})
+	if g.keys.publicErr != nil {
+		return nil, fmt.Errorf("failed to load GPG public keys: %w", g.keys.publicErr)
+	}
+	if len(g.keys.public) == 0 {
+		return nil, fmt.Errorf("no GPG public keys configured, set gpg.public_keys or gpg.public_keys_secret")
+	}
 
-	log.Debugf("Running GPG decrypt command: %s %v", g.gpgPath, args)
+	var recipients openpgp.EntityList
+	switch {
+	case len(g.recipients) > 0:
+		for _, pinned := range g.recipients {
+			want := normalizeFingerprint(pinned)
+			var found *openpgp.Entity
+			for _, entity := range g.keys.public {
+				if fingerprint(entity) == want {
+					found = entity
+					break
+				}
+			}
+			if found == nil {
+				return nil, fmt.Errorf("GPG recipient %s not found in the configured public keys", pinned)
+			}
+			recipients = append(recipients, found)
+		}
+	case g.recipient != "":
+		for _, entity := range g.keys.public {
+			for name := range entity.Identities {
+				if strings.Contains(strings.ToLower(name), strings.ToLower(g.recipient)) {
+					recipients = append(recipients, entity)
+					break
+				}
+			}
+		}
+		if len(recipients) == 0 {
+			return nil, fmt.Errorf("no GPG public key found for recipient %s", g.recipient)
+		}
+	default:
+		recipients = g.keys.public
+	}
 
-	cmd := exec.Command(g.gpgPath, args...)
-	
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	now := time.Now()
+	for _, entity := range recipients {
+		if _, ok := entity.EncryptionKey(now); !ok {
+			return nil, fmt.Errorf("GPG key %s has no valid encryption key", fingerprint(entity))
+		}
+	}
+	return recipients, nil
+}
 
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("GPG decryption failed: %w", err)
+// privateKeyRing returns the private keys for decryption, unlocked with the
+// configured passphrase where they are protected.
+func (g *GPGClient) privateKeyRing() (openpgp.EntityList, error) {
+	g.keys.privateOnce.Do(func() {
+		g.keys.private, g.keys.privateErr = g.loadPrivateKeys()
+	})
+	if g.keys.privateErr != nil {
+		return nil, fmt.Errorf("failed to load GPG private keys: %w", g.keys.privateErr)
+	}
+	if len(g.keys.private) == 0 {
+		return nil, fmt.Errorf("no GPG private keys configured, set gpg.private_keys or gpg.private_keys_secret")
 	}
+	return g.keys.private, nil
+}
 
-	info, err := os.Stat(outputPath)
+func (g *GPGClient) loadPrivateKeys() (openpgp.EntityList, error) {
+	keys, err := loadKeys(g.privateKeys, g.privateKeysSecret)
 	if err != nil {
-		return "", fmt.Errorf("failed to stat decrypted file: %w", err)
+		return nil, err
 	}
 
-	log.Infof("Successfully decrypted file to %s (size: %d bytes)", outputPath, info.Size())
-	return outputPath, nil
+	passphrase := g.passphrase
+	if g.passphraseFile != "" {
+		data, err := os.ReadFile(g.passphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase file: %w", err)
+		}
+		passphrase = strings.TrimRight(string(data), "\r\n")
+	}
+
+	for _, entity := range keys {
+		if entity.PrivateKey == nil {
+			return nil, fmt.Errorf("GPG key %s is not a private key", fingerprint(entity))
+		}
+		if !entity.PrivateKey.Encrypted {
+			continue
+		}
+		if passphrase == "" {
+			return nil, fmt.Errorf("GPG key %s is protected, set gpg.passphrase or gpg.passphrase_file", fingerprint(entity))
+		}
+		if err := entity.DecryptPrivateKeys([]byte(passphrase)); err != nil {
+			return nil, fmt.Errorf("failed to unlock GPG key %s: %w", fingerprint(entity), err)
+		}
+	}
+	return keys, nil
 }
 
-func (g *GPGClient) ListKeys() error {
-	log.Debug("Listing GPG keys")
+// loadKeys reads armored keys from files, directories of files and every
+// entry of the Secret named <namespace>/<name> by secretRef.
+func loadKeys(paths []string, secretRef string) (openpgp.EntityList, error) {
+	var keys openpgp.EntityList
+
+	for _, path := range paths {
+		files, err := keyFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read key file: %w", err)
+			}
+			entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse key file %s: %w", file, err)
+			}
+			keys = append(keys, entities...)
+		}
+	}
 
-	if g.gpgPath == "" {
-		g.gpgPath = "gpg"
+	if secretRef != "" {
+		entities, err := loadSecretKeys(secretRef)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, entities...)
 	}
 
-	args := []string{"--list-keys"}
+	return keys, nil
+}
 
-	if g.keyring != "" {
-		args = append(args, "--keyring", g.keyring)
+// keyFiles returns path itself, or the files in it if it is a directory.
+// Hidden entries are skipped, such as the ..data links of mounted Secrets.
+func keyFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
 	}
 
-	cmd := exec.Command(g.gpgPath, args...)
-	
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to list GPG keys: %w", err)
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key directory: %w", err)
 	}
 
-	return nil
+	var files []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		file := filepath.Join(path, entry.Name())
+		if info, err := os.Stat(file); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, file)
+	}
+	return files, nil
 }
 
-func (g *GPGClient) ValidateRecipient() error {
-	log.Debugf("Validating GPG recipient: %s", g.recipient)
-
-	if g.recipient == "" {
-		return fmt.Errorf("GPG recipient not configured")
+func loadSecretKeys(secretRef string) (openpgp.EntityList, error) {
+	data, err := readKeySecret(secretRef)
+	if err != nil {
+		return nil, err
 	}
 
-	if g.gpgPath == "" {
-		g.gpgPath = "gpg"
+	var keys openpgp.EntityList
+	for key, value := range data {
+		entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(value))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key %s of secret %s: %w", key, secretRef, err)
+		}
+		keys = append(keys, entities...)
 	}
+	return keys, nil
+}
 
-	args := []string{"--list-keys", g.recipient}
-
-	if g.keyring != "" {
-		args = append(args, "--keyring", g.keyring)
+// readKeySecret returns the entries of the Secret named <namespace>/<name>
+// by secretRef.
+func readKeySecret(secretRef string) (map[string][]byte, error) {
+	namespace, name, found := strings.Cut(secretRef, "/")
+	if !found {
+		return nil, fmt.Errorf("key secret %q must be given as <namespace>/<name>", secretRef)
 	}
 
-	cmd := exec.Command(g.gpgPath, args...)
-	
-	output, err := cmd.Output()
+	k8sClient, err := createK8sClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+	secret, err := k8sClient.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
 	if err != nil {
-		return fmt.Errorf("GPG recipient %s not found or invalid: %w", g.recipient, err)
+		return nil, fmt.Errorf("failed to get key secret %s: %w", secretRef, err)
 	}
+	return secret.Data, nil
+}
 
-	log.Debugf("GPG recipient validation successful: %s", string(output))
-	return nil
-}
\ No newline at end of file
+// fingerprint returns the primary key fingerprint in upper case hex.
+func fingerprint(entity *openpgp.Entity) string {
+	return strings.ToUpper(hex.EncodeToString(entity.PrimaryKey.Fingerprint))
+}
+
+// normalizeFingerprint strips the spaces and 0x prefix fingerprints are
+// often written with.
+func normalizeFingerprint(value string) string {
+	value = strings.ReplaceAll(value, " ", "")
+	value = strings.TrimPrefix(strings.TrimPrefix(value, "0x"), "0X")
+	return strings.ToUpper(value)
+}
+
+func entityName(entity *openpgp.Entity) string {
+	if identity := entity.PrimaryIdentity(); identity != nil {
+		return identity.Name
+	}
+	return "no user ID"
+}
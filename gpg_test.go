@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+func gpgEncrypt(t *testing.T, g *GPGClient, plaintext []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w, err := g.EncryptStream(context.Background(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gpgDecrypt(g *GPGClient, ciphertext []byte) ([]byte, error) {
+	r, err := g.DecryptStream(context.Background(), bytes.NewReader(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := io.ReadAll(r)
+	if closeErr := r.Close(); err == nil {
+		err = closeErr
+	}
+	return plaintext, err
+}
+
+// newTestGPGClient generates a key pair and returns a client configured
+// with it.
+func newTestGPGClient(t *testing.T, armored bool) *GPGClient {
+	t.Helper()
+
+	privateKey, publicKey := generatePGPKey(t, t.TempDir())
+	setConfig(t, map[string]interface{}{
+		"gpg.public_keys":  []string{publicKey},
+		"gpg.private_keys": []string{privateKey},
+		"gpg.armor":        armored,
+	})
+	return NewGPGClient()
+}
+
+func TestGPGRoundTrip(t *testing.T) {
+	plaintext := make([]byte, 200000)
+	rand.Read(plaintext)
+
+	for name, armored := range map[string]bool{"binary": false, "armored": true} {
+		t.Run(name, func(t *testing.T) {
+			g := newTestGPGClient(t, armored)
+
+			ciphertext := gpgEncrypt(t, g, plaintext)
+			if isArmored := bytes.HasPrefix(ciphertext, []byte("-----BEGIN PGP MESSAGE-----")); isArmored != armored {
+				t.Fatalf("armored output: %v, expected %v", isArmored, armored)
+			}
+
+			decrypted, err := gpgDecrypt(g, ciphertext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Fatal("decrypted data differs")
+			}
+		})
+	}
+}
+
+func TestGPGFileRoundTrip(t *testing.T) {
+	g := newTestGPGClient(t, false)
+	inputPath := writeFile(t, filepath.Join(t.TempDir(), "backup.rbd.gz"), []byte("backup data"))
+
+	encryptedPath, err := g.EncryptFile(inputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encryptedPath != inputPath+binaryPGPSuffix {
+		t.Fatalf("encrypted to %s", encryptedPath)
+	}
+	if err := os.Remove(inputPath); err != nil {
+		t.Fatal(err)
+	}
+
+	decryptedPath, err := g.DecryptFile(encryptedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(decryptedPath)
+	if err != nil || string(data) != "backup data" {
+		t.Fatalf("got %q, %v from %s", data, err, decryptedPath)
+	}
+}
+
+func TestGPGWrongKey(t *testing.T) {
+	ciphertext := gpgEncrypt(t, newTestGPGClient(t, true), []byte("secret"))
+
+	other := newTestGPGClient(t, true)
+	if _, err := gpgDecrypt(other, ciphertext); err == nil {
+		t.Fatal("decrypted with another private key")
+	}
+}
+
+func TestGPGTamperedMessage(t *testing.T) {
+	g := newTestGPGClient(t, false)
+	ciphertext := gpgEncrypt(t, g, bytes.Repeat([]byte("backup data "), 1000))
+	ciphertext[len(ciphertext)-10] ^= 1
+
+	if _, err := gpgDecrypt(g, ciphertext); err == nil {
+		t.Fatal("tampered message decrypted without error")
+	}
+}
+
+func TestGPGPassphrase(t *testing.T) {
+	entity, err := openpgp.NewEntity("Backup Test", "", "backup@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.EncryptPrivateKeys([]byte("correct horse"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var private, public bytes.Buffer
+	w, err := armor.Encode(&private, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.SerializePrivateWithoutSigning(w, nil); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	w, err = armor.Encode(&public, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	dir := t.TempDir()
+	setConfig(t, map[string]interface{}{
+		"gpg.public_keys":  []string{writeFile(t, filepath.Join(dir, "pgp.asc"), public.Bytes())},
+		"gpg.private_keys": []string{writeFile(t, filepath.Join(dir, "pgp.key"), private.Bytes())},
+	})
+	ciphertext := gpgEncrypt(t, NewGPGClient(), []byte("secret"))
+
+	if _, err := gpgDecrypt(NewGPGClient(), ciphertext); err == nil || !strings.Contains(err.Error(), "gpg.passphrase") {
+		t.Fatalf("expected a missing passphrase error, got %v", err)
+	}
+
+	passphraseFile := writeFile(t, filepath.Join(dir, "passphrase"), []byte("correct horse\n"))
+	setConfig(t, map[string]interface{}{"gpg.passphrase_file": passphraseFile})
+	plaintext, err := gpgDecrypt(NewGPGClient(), ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "secret" {
+		t.Fatalf("got %q", plaintext)
+	}
+}
+
+func TestGPGRecipients(t *testing.T) {
+	g := newTestGPGClient(t, false)
+	fingerprints, err := g.Recipients()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fingerprints) != 1 {
+		t.Fatalf("got recipients %v", fingerprints)
+	}
+
+	setConfig(t, map[string]interface{}{"gpg.recipients": fingerprints})
+	if err := NewGPGClient().Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	setConfig(t, map[string]interface{}{"gpg.recipients": []string{strings.Repeat("0", len(fingerprints[0]))}})
+	if err := NewGPGClient().Validate(); err == nil {
+		t.Fatal("unknown recipient accepted")
+	}
+}
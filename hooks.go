@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// What to do when a hook fails.
+const (
+	hookOnErrorAbort    = "abort"
+	hookOnErrorContinue = "continue"
+)
+
+// backupHooks are shell commands run inside the pods mounting a PVC before
+// and after its point-in-time copy is taken, e.g. to freeze a filesystem or
+// put a database into backup mode.
+type backupHooks struct {
+	pre       string
+	post      string
+	container string
+	timeout   time.Duration
+	onError   string
+}
+
+func (h backupHooks) empty() bool {
+	return h.pre == "" && h.post == ""
+}
+
+// parseBackupHooks returns hooks with the values set by the hook annotations
+// replaced.
+func parseBackupHooks(annotations map[string]string, hooks backupHooks) (backupHooks, error) {
+	if value, ok := annotations[annotationPreHook]; ok {
+		hooks.pre = strings.TrimSpace(value)
+	}
+	if value, ok := annotations[annotationPostHook]; ok {
+		hooks.post = strings.TrimSpace(value)
+	}
+	if value, ok := annotations[annotationHookContainer]; ok {
+		hooks.container = strings.TrimSpace(value)
+	}
+
+	if value, ok := annotations[annotationHookTimeout]; ok {
+		timeout, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || timeout <= 0 {
+			return backupHooks{}, fmt.Errorf("invalid %s annotation %q: expected a positive duration", annotationHookTimeout, value)
+		}
+		hooks.timeout = timeout
+	}
+
+	if value, ok := annotations[annotationHookOnError]; ok {
+		hooks.onError = strings.TrimSpace(value)
+	}
+	if hooks.onError != hookOnErrorAbort && hooks.onError != hookOnErrorContinue {
+		return backupHooks{}, fmt.Errorf("invalid %s annotation %q: expected %q or %q", annotationHookOnError, hooks.onError, hookOnErrorAbort, hookOnErrorContinue)
+	}
+
+	return hooks, nil
+}
+
+// podHooks are the hooks to run in one pod.
+type podHooks struct {
+	pod       corev1.Pod
+	container string
+	hooks     backupHooks
+}
+
+func (p podHooks) String() string {
+	return p.pod.Name + "/" + p.container
+}
+
+// runPreHooks runs the pre hooks of the pods mounting the PVC of image and
+// returns a function running their post hooks. The returned function only
+// runs the post hooks on its first call, so it can be deferred as well as
+// called once the copy is taken.
+//
+// If a pre hook fails with on-error "abort", the post hooks of the pods
+// whose pre hooks ran, including the failed one, are run right away.
+func (bs *BackupService) runPreHooks(image CephImage) (func() error, error) {
+	ctx := context.Background()
+	noHooks := func() error { return nil }
+
+	pods, err := podsUsingPVC(ctx, bs.k8sClient, image.Namespace, image.PVCName)
+	if err != nil {
+		// Pods are only listed to find hooks; without hooks on the PVC the
+		// backup does not depend on them.
+		if image.Hooks.empty() {
+			bs.logger.Debugf("Not looking for backup hooks: %v", err)
+			return noHooks, nil
+		}
+		return nil, stageFailed(stageHook, err)
+	}
+
+	var targets []podHooks
+	for _, pod := range pods {
+		if pod.Status.Phase != corev1.PodRunning {
+			continue
+		}
+
+		hooks, err := parseBackupHooks(pod.Annotations, image.Hooks)
+		if err != nil {
+			return nil, stageFailed(stageHook, fmt.Errorf("pod %s: %w", pod.Name, err))
+		}
+		if hooks.empty() {
+			continue
+		}
+
+		container, err := hookContainer(pod, image.PVCName, hooks.container)
+		if err != nil {
+			return nil, stageFailed(stageHook, err)
+		}
+		targets = append(targets, podHooks{pod: pod, container: container, hooks: hooks})
+	}
+
+	if len(targets) == 0 {
+		if !image.Hooks.empty() {
+			bs.logger.Infof("No running pod mounts PVC %s, skipping backup hooks", image.PVCName)
+		}
+		return noHooks, nil
+	}
+
+	var ran []podHooks
+	for _, target := range targets {
+		if target.hooks.pre != "" {
+			if err := bs.runHook(ctx, target, "pre", target.hooks.pre); err != nil {
+				if target.hooks.onError == hookOnErrorAbort {
+					bs.postHooks(ctx, append(ran, target))()
+					return nil, stageFailed(stageHook, err)
+				}
+			}
+		}
+		ran = append(ran, target)
+	}
+
+	return bs.postHooks(ctx, ran), nil
+}
+
+// postHooks returns a function running the post hooks of targets in reverse
+// order on its first call. Failures of hooks with on-error "abort" are
+// returned, all of them are logged.
+func (bs *BackupService) postHooks(ctx context.Context, targets []podHooks) func() error {
+	done := false
+	return func() error {
+		if done {
+			return nil
+		}
+		done = true
+
+		var errs []error
+		for i := len(targets) - 1; i >= 0; i-- {
+			target := targets[i]
+			if target.hooks.post == "" {
+				continue
+			}
+			if err := bs.runHook(ctx, target, "post", target.hooks.post); err != nil && target.hooks.onError == hookOnErrorAbort {
+				errs = append(errs, err)
+			}
+		}
+		if len(errs) > 0 {
+			return stageFailed(stageHook, errors.Join(errs...))
+		}
+		return nil
+	}
+}
+
+// runHook runs command in the target container through the exec API and
+// logs its output.
+func (bs *BackupService) runHook(ctx context.Context, target podHooks, kind, command string) error {
+	bs.logger.Infof("Running %s hook in %s: %s", kind, target, command)
+
+	ctx, cancel := context.WithTimeout(ctx, target.hooks.timeout)
+	defer cancel()
+
+	stdout, stderr, err := bs.execInPod(ctx, target.pod, target.container, command)
+	if stdout != "" {
+		bs.logger.Debugf("%s hook stdout: %s", kind, stdout)
+	}
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %s", target.hooks.timeout)
+		}
+		err = fmt.Errorf("%s hook in %s failed: %w", kind, target, err)
+		if stderr != "" {
+			err = fmt.Errorf("%w: %s", err, stderr)
+		}
+
+		if target.hooks.onError == hookOnErrorAbort {
+			bs.logger.Error(err)
+		} else {
+			bs.logger.Warnf("%v (continuing)", err)
+		}
+		return err
+	}
+
+	if stderr != "" {
+		bs.logger.Debugf("%s hook stderr: %s", kind, stderr)
+	}
+	return nil
+}
+
+// execInPod runs command with /bin/sh -c in a container and returns its
+// trimmed output. A non-zero exit status is returned as an error.
+func (bs *BackupService) execInPod(ctx context.Context, pod corev1.Pod, container, command string) (string, string, error) {
+	request := bs.k8sClient.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(pod.Namespace).
+		Name(pod.Name).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: container,
+			Command:   []string{"/bin/sh", "-c", command},
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	executor, err := remotecommand.NewSPDYExecutor(bs.restConfig, "POST", request.URL())
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create executor: %w", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	err = executor.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	return strings.TrimSpace(stdout.String()), strings.TrimSpace(stderr.String()), err
+}
+
+// hookContainer returns the container of pod hooks run in: the named one,
+// or else the first container mounting the PVC.
+func hookContainer(pod corev1.Pod, pvcName, name string) (string, error) {
+	if name != "" {
+		for _, container := range pod.Spec.Containers {
+			if container.Name == name {
+				return name, nil
+			}
+		}
+		return "", fmt.Errorf("pod %s has no container %s", pod.Name, name)
+	}
+
+	var volumes []string
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == pvcName {
+			volumes = append(volumes, volume.Name)
+		}
+	}
+
+	for _, container := range pod.Spec.Containers {
+		for _, mount := range container.VolumeMounts {
+			for _, volume := range volumes {
+				if mount.Name == volume {
+					return container.Name, nil
+				}
+			}
+		}
+		for _, device := range container.VolumeDevices {
+			for _, volume := range volumes {
+				if device.Name == volume {
+					return container.Name, nil
+				}
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no container of pod %s mounts PVC %s, set %s", pod.Name, pvcName, annotationHookContainer)
+}
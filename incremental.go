@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// planBackup decides whether the backup of image taken from snapshot is a
+// full export or an export-diff against the previous backup snapshot, and
+// returns the metadata to store with it.
+func (bs *BackupService) planBackup(image CephImage, snapshot string, now time.Time) BackupMetadata {
+	full := BackupMetadata{
+		Type:        backupTypeFull,
+		Snapshot:    snapshot,
+		ChainStart:  now,
+		ChainLength: 1,
+	}
+
+	// CephFS backups are archives of the whole subvolume.
+	if !bs.incremental || snapshot == "" || image.VolumeType == volumeTypeCephFS {
+		return full
+	}
+
+	parentObject, parent, ok := bs.findParentBackup(image)
+	if !ok {
+		bs.logger.Infof("No previous backup snapshot usable for %s/%s, taking a full backup", image.Pool, image.ImageName)
+		return full
+	}
+
+	if bs.fullInterval > 0 && now.Sub(parent.ChainStart) >= bs.fullInterval {
+		bs.logger.Infof("Last full backup of %s/%s is older than %s, taking a full backup", image.Pool, image.ImageName, bs.fullInterval)
+		return full
+	}
+
+	if bs.maxChainLength > 0 && parent.ChainLength >= bs.maxChainLength {
+		bs.logger.Infof("Backup chain of %s/%s reached %d backups, taking a full backup", image.Pool, image.ImageName, parent.ChainLength)
+		return full
+	}
+
+	return BackupMetadata{
+		Type:         backupTypeIncremental,
+		Snapshot:     snapshot,
+		FromSnapshot: parent.Snapshot,
+		Parent:       parentObject,
+		ChainStart:   parent.ChainStart,
+		ChainLength:  parent.ChainLength + 1,
+	}
+}
+
+// findParentBackup returns the uploaded backup belonging to the newest
+// backup snapshot that still exists on image. A diff is only possible
+// against a snapshot whose backup actually made it to the bucket.
+func (bs *BackupService) findParentBackup(image CephImage) (string, BackupMetadata, bool) {
+	snapshots, err := bs.cephClient.ListSnapshots(image.rbdPool(), image.ImageName)
+	if err != nil {
+		bs.logger.Warnf("Failed to list snapshots of %s/%s: %v", image.Pool, image.ImageName, err)
+		return "", BackupMetadata{}, false
+	}
+
+	var ours []string
+	for _, snap := range snapshots {
+		if strings.HasPrefix(snap.Name, backupSnapshotPrefix) {
+			ours = append(ours, snap.Name)
+		}
+	}
+	if len(ours) == 0 {
+		return "", BackupMetadata{}, false
+	}
+
+	sort.Strings(ours)
+	newest := ours[len(ours)-1]
+	isoDate := strings.TrimPrefix(newest, backupSnapshotPrefix)
+
+	// The parent may have been encrypted in another format than the one
+	// configured now, or stored by an older version without a namespace.
+	for _, keyNamespace := range backupKeyNamespaces(image.Namespace) {
+		for _, backupType := range []string{backupTypeIncremental, backupTypeFull} {
+			for _, suffix := range encryptionSuffixes {
+				objectName := backupObjectName(keyNamespace, image.PVCName, isoDate, volumeTypeRBD, backupType, suffix)
+
+				metadata, _, err := readBackupMetadata(bs.minioClient, objectName)
+				if err != nil {
+					bs.logger.Debugf("No usable parent backup %s: %v", objectName, err)
+					continue
+				}
+
+				if metadata.Snapshot != newest || metadata.ChainStart.IsZero() {
+					bs.logger.Debugf("Backup %s does not belong to snapshot %s", objectName, newest)
+					continue
+				}
+
+				return objectName, metadata, true
+			}
+		}
+	}
+
+	return "", BackupMetadata{}, false
+}
+
+// BackupChainLink is one object of a backup chain as replayed by restore.
+// Manifest is nil for backups written before manifests existed. SignedBy
+// is set once the signature of the manifest has been verified.
+type BackupChainLink struct {
+	ObjectName string
+	Metadata   BackupMetadata
+	Manifest   *BackupManifest
+	SignedBy   string
+}
+
+// resolveBackupChain follows the parent links of objectName back to the
+// full backup it is based on and returns the chain in restore order.
+func resolveBackupChain(minioClient *MinioClient, objectName string) ([]BackupChainLink, error) {
+	var chain []BackupChainLink
+	seen := make(map[string]bool)
+
+	for current := objectName; ; {
+		if seen[current] {
+			return nil, fmt.Errorf("backup chain of %s contains a cycle at %s", objectName, current)
+		}
+		seen[current] = true
+
+		metadata, manifest, err := readBackupMetadata(minioClient, current)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve backup chain of %s: %w", objectName, err)
+		}
+
+		chain = append([]BackupChainLink{{ObjectName: current, Metadata: metadata, Manifest: manifest}}, chain...)
+
+		if !metadata.IsIncremental() {
+			break
+		}
+
+		if metadata.Parent == "" {
+			return nil, fmt.Errorf("incremental backup %s has no parent", current)
+		}
+		current = metadata.Parent
+	}
+
+	if len(chain) > 1 && chain[0].Metadata.Snapshot == "" {
+		return nil, fmt.Errorf("full backup %s records no snapshot to replay diffs onto", chain[0].ObjectName)
+	}
+
+	return chain, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// KMSClient wraps data keys with a key of AWS KMS, or of any service
+// speaking its JSON API such as LocalStack, signing requests with AWS
+// Signature Version 4.
+type KMSClient struct {
+	endpoint     string
+	region       string
+	keyID        string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+
+	httpClient *http.Client
+}
+
+func NewKMSClient() (*KMSClient, error) {
+	// Environment variables take precedence over config file, as for the
+	// AWS CLI.
+	env := func(name, key string) string {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+		return viper.GetString(key)
+	}
+
+	k := &KMSClient{
+		endpoint:     strings.TrimSuffix(viper.GetString("kms.endpoint"), "/"),
+		region:       env("AWS_REGION", "kms.region"),
+		keyID:        viper.GetString("kms.key_id"),
+		accessKey:    env("AWS_ACCESS_KEY_ID", "kms.access_key"),
+		secretKey:    env("AWS_SECRET_ACCESS_KEY", "kms.secret_key"),
+		sessionToken: env("AWS_SESSION_TOKEN", "kms.session_token"),
+		httpClient:   &http.Client{Timeout: 30 * time.Second},
+	}
+	if k.region == "" {
+		return nil, fmt.Errorf("KMS region not configured, set kms.region or AWS_REGION")
+	}
+	if k.endpoint == "" {
+		k.endpoint = fmt.Sprintf("https://kms.%s.amazonaws.com", k.region)
+	}
+	if k.keyID == "" {
+		return nil, fmt.Errorf("KMS key not configured, set kms.key_id")
+	}
+	if k.accessKey == "" || k.secretKey == "" {
+		return nil, fmt.Errorf("KMS credentials not configured, set kms.access_key and kms.secret_key or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+
+	return k, nil
+}
+
+func (k *KMSClient) Name() string {
+	return keyProviderKMS
+}
+
+// KeyID returns the configured key ID, ARN or alias.
+func (k *KMSClient) KeyID() string {
+	return k.keyID
+}
+
+// Wrap encrypts key with the KMS key. The key is recorded by the ARN KMS
+// returns, so aliases can later point elsewhere.
+func (k *KMSClient) Wrap(ctx context.Context, key []byte) (EnvelopeKey, error) {
+	var response struct {
+		CiphertextBlob string `json:"CiphertextBlob"`
+		KeyID          string `json:"KeyId"`
+	}
+	request := map[string]string{
+		"KeyId":     k.keyID,
+		"Plaintext": base64.StdEncoding.EncodeToString(key),
+	}
+	if err := k.call(ctx, "Encrypt", request, &response); err != nil {
+		return EnvelopeKey{}, err
+	}
+
+	return EnvelopeKey{KeyProvider: keyProviderKMS, KeyID: response.KeyID, WrappedKey: response.CiphertextBlob}, nil
+}
+
+// Unwrap decrypts the data key with the KMS key it was wrapped with.
+func (k *KMSClient) Unwrap(ctx context.Context, wrapped EnvelopeKey) ([]byte, error) {
+	var response struct {
+		Plaintext string `json:"Plaintext"`
+	}
+	request := map[string]string{
+		"KeyId":          wrapped.KeyID,
+		"CiphertextBlob": wrapped.WrappedKey,
+	}
+	if err := k.call(ctx, "Decrypt", request, &response); err != nil {
+		return nil, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(response.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode data key from KMS: %w", err)
+	}
+	return key, nil
+}
+
+// Rewrap re-encrypts the data key with the configured KMS key inside KMS.
+func (k *KMSClient) Rewrap(ctx context.Context, wrapped EnvelopeKey) (EnvelopeKey, error) {
+	var response struct {
+		CiphertextBlob string `json:"CiphertextBlob"`
+		KeyID          string `json:"KeyId"`
+	}
+	request := map[string]string{
+		"CiphertextBlob":   wrapped.WrappedKey,
+		"SourceKeyId":      wrapped.KeyID,
+		"DestinationKeyId": k.keyID,
+	}
+	if err := k.call(ctx, "ReEncrypt", request, &response); err != nil {
+		return EnvelopeKey{}, err
+	}
+
+	return EnvelopeKey{KeyProvider: keyProviderKMS, KeyID: response.KeyID, WrappedKey: response.CiphertextBlob}, nil
+}
+
+// call invokes the KMS action with request and decodes the result into
+// response.
+func (k *KMSClient) call(ctx context.Context, action string, request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create KMS request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	if k.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", k.sessionToken)
+	}
+	signAWSRequest(req, body, k.accessKey, k.secretKey, k.region, "kms", time.Now())
+
+	resp, err := k.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("KMS %s failed: %w", action, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("failed to read KMS response: %w", err)
+	}
+
+	if resp.StatusCode/100 != 2 {
+		var failure struct {
+			Type         string `json:"__type"`
+			Message      string `json:"message"`
+			MessageUpper string `json:"Message"`
+		}
+		if json.Unmarshal(data, &failure) == nil && failure.Type != "" {
+			message := failure.Message
+			if message == "" {
+				message = failure.MessageUpper
+			}
+			return fmt.Errorf("KMS %s failed: %s: %s", action, failure.Type, message)
+		}
+		return fmt.Errorf("KMS %s failed: %s", action, resp.Status)
+	}
+
+	if err := json.Unmarshal(data, response); err != nil {
+		return fmt.Errorf("failed to decode KMS response: %w", err)
+	}
+	return nil
+}
+
+// signAWSRequest adds an AWS Signature Version 4 Authorization header
+// covering all headers set on req and its body.
+func signAWSRequest(req *http.Request, body []byte, accessKey, secretKey, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const kmsTestKeyARN = "arn:aws:kms:eu-central-1:111122223333:key/backup"
+
+// kmsStub implements Encrypt, Decrypt and ReEncrypt of the KMS JSON API,
+// remembering the plaintext of every ciphertext it returned.
+type kmsStub struct {
+	mu          sync.Mutex
+	plaintexts  map[string]string
+	targets     []string
+	ciphertexts int
+}
+
+func newKMSStub(t *testing.T) (*kmsStub, *httptest.Server) {
+	t.Helper()
+
+	stub := &kmsStub{plaintexts: map[string]string{}}
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+
+	for _, name := range []string{"AWS_REGION", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN"} {
+		t.Setenv(name, "")
+	}
+	setConfig(t, map[string]interface{}{
+		"kms.endpoint":   server.URL,
+		"kms.region":     "eu-central-1",
+		"kms.key_id":     "alias/backup",
+		"kms.access_key": "AKIDEXAMPLE",
+		"kms.secret_key": "secret",
+	})
+	return stub, server
+}
+
+func (s *kmsStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	target := r.Header.Get("X-Amz-Target")
+	s.targets = append(s.targets, target)
+
+	fail := func(errorType, message string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"__type": errorType, "message": message})
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") ||
+		r.Header.Get("X-Amz-Date") == "" {
+		fail("MissingAuthenticationTokenException", "missing authentication")
+		return
+	}
+	if r.Method != http.MethodPost || r.URL.Path != "/" || r.Header.Get("Content-Type") != "application/x-amz-json-1.1" {
+		fail("UnsupportedOperationException", "unsupported request")
+		return
+	}
+
+	var request map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		fail("SerializationException", err.Error())
+		return
+	}
+
+	var response map[string]string
+	switch target {
+	case "TrentService.Encrypt":
+		if request["KeyId"] != "alias/backup" {
+			fail("NotFoundException", "key not found")
+			return
+		}
+		response = map[string]string{"CiphertextBlob": s.encrypt(request["Plaintext"]), "KeyId": kmsTestKeyARN}
+	case "TrentService.Decrypt":
+		plaintext, ok := s.plaintexts[request["CiphertextBlob"]]
+		if !ok {
+			fail("InvalidCiphertextException", "invalid ciphertext")
+			return
+		}
+		response = map[string]string{"Plaintext": plaintext, "KeyId": kmsTestKeyARN}
+	case "TrentService.ReEncrypt":
+		plaintext, ok := s.plaintexts[request["CiphertextBlob"]]
+		if !ok {
+			fail("InvalidCiphertextException", "invalid ciphertext")
+			return
+		}
+		response = map[string]string{"CiphertextBlob": s.encrypt(plaintext), "KeyId": kmsTestKeyARN}
+	default:
+		fail("UnknownOperationException", "unknown operation")
+		return
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *kmsStub) encrypt(plaintext string) string {
+	s.ciphertexts++
+	ciphertext := fmt.Sprintf("ciphertext-%d", s.ciphertexts)
+	s.plaintexts[ciphertext] = plaintext
+	return ciphertext
+}
+
+func TestKMSWrapUnwrapAndRewrap(t *testing.T) {
+	stub, _ := newKMSStub(t)
+	kms, err := NewKMSClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := bytes.Repeat([]byte{5}, dataKeySize)
+
+	wrapped, err := kms.Wrap(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrapped.KeyProvider != keyProviderKMS || wrapped.KeyID != kmsTestKeyARN {
+		t.Fatalf("unexpected wrapped key %+v", wrapped)
+	}
+
+	rewrapped, err := rewrapDataKey(context.Background(), kms, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewrapped.WrappedKey == wrapped.WrappedKey {
+		t.Fatal("data key was not rewrapped")
+	}
+
+	unwrapped, err := kms.Unwrap(context.Background(), rewrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, key) {
+		t.Fatal("unwrapped key differs")
+	}
+
+	expected := []string{"TrentService.Encrypt", "TrentService.ReEncrypt", "TrentService.Decrypt"}
+	if strings.Join(stub.targets, ",") != strings.Join(expected, ",") {
+		t.Fatalf("called %v, expected %v", stub.targets, expected)
+	}
+}
+
+func TestKMSErrors(t *testing.T) {
+	newKMSStub(t)
+	kms, err := NewKMSClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = kms.Unwrap(context.Background(), EnvelopeKey{KeyID: kmsTestKeyARN, WrappedKey: "forged"})
+	if err == nil || !strings.Contains(err.Error(), "InvalidCiphertextException: invalid ciphertext") {
+		t.Fatalf("expected the KMS error, got %v", err)
+	}
+}
+
+// TestSignAWSRequest checks signAWSRequest against the get-vanilla and
+// post-vanilla cases of the AWS Signature Version 4 test suite.
+func TestSignAWSRequest(t *testing.T) {
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		method    string
+		signature string
+	}{
+		{http.MethodGet, "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{http.MethodPost, "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b"},
+	} {
+		req, err := http.NewRequest(test.method, "https://example.amazonaws.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signAWSRequest(req, nil, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "service", now)
+
+		expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+			"SignedHeaders=host;x-amz-date, Signature=" + test.signature
+		if authorization := req.Header.Get("Authorization"); authorization != expected {
+			t.Errorf("%s: got %s, expected %s", test.method, authorization, expected)
+		}
+		if date := req.Header.Get("X-Amz-Date"); date != "20150830T123600Z" {
+			t.Errorf("%s: got X-Amz-Date %s", test.method, date)
+		}
+	}
+}
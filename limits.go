@@ -0,0 +1,98 @@
+package main
+
+import "sync"
+
+// semaphore bounds how many goroutines hold it at once. A nil semaphore
+// never blocks.
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+func (s semaphore) acquire() {
+	if s != nil {
+		s <- struct{}{}
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// stageLimiter bounds the number of concurrent rbd exports, compressions
+// and uploads across all backup workers, and the number of concurrent
+// exports per Ceph pool. Slots are always acquired in the order pool,
+// export, compress, upload, so workers holding several never deadlock.
+type stageLimiter struct {
+	export   semaphore
+	compress semaphore
+	upload   semaphore
+
+	perPool int
+	mu      sync.Mutex
+	pools   map[string]semaphore
+}
+
+func newStageLimiter(exports, compressions, uploads, perPool int) *stageLimiter {
+	return &stageLimiter{
+		export:   newSemaphore(exports),
+		compress: newSemaphore(compressions),
+		upload:   newSemaphore(uploads),
+		perPool:  perPool,
+		pools:    make(map[string]semaphore),
+	}
+}
+
+func (l *stageLimiter) pool(name string) semaphore {
+	if l.perPool <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.pools[name]; !ok {
+		l.pools[name] = newSemaphore(l.perPool)
+	}
+	return l.pools[name]
+}
+
+// acquireExport takes a pool and an export slot and returns their release.
+func (l *stageLimiter) acquireExport(pool string) func() {
+	poolSlot := l.pool(pool)
+	poolSlot.acquire()
+	l.export.acquire()
+	return func() {
+		l.export.release()
+		poolSlot.release()
+	}
+}
+
+func (l *stageLimiter) acquireCompress() func() {
+	l.compress.acquire()
+	return l.compress.release
+}
+
+func (l *stageLimiter) acquireUpload() func() {
+	l.upload.acquire()
+	return l.upload.release
+}
+
+// acquireAll takes every slot a streaming backup needs, since all of its
+// stages run at the same time.
+func (l *stageLimiter) acquireAll(pool string) func() {
+	releaseExport := l.acquireExport(pool)
+	releaseCompress := l.acquireCompress()
+	releaseUpload := l.acquireUpload()
+	return func() {
+		releaseUpload()
+		releaseCompress()
+		releaseExport()
+	}
+}
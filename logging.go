@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// logPrefixField is the log field holding the per-image prefix. The
+// prefixHook moves it to the front of the message, so lines of parallel
+// backups stay readable with the default text formatter.
+const logPrefixField = "prefix"
+
+type prefixHook struct{}
+
+func (prefixHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (prefixHook) Fire(entry *log.Entry) error {
+	prefix, ok := entry.Data[logPrefixField].(string)
+	if !ok {
+		return nil
+	}
+
+	entry.Message = "[" + prefix + "] " + entry.Message
+
+	// Entry.Data is shared with the entry the message was logged from, so
+	// it is copied rather than modified.
+	data := make(log.Fields, len(entry.Data)-1)
+	for key, value := range entry.Data {
+		if key != logPrefixField {
+			data[key] = value
+		}
+	}
+	entry.Data = data
+
+	return nil
+}
+
+func init() {
+	log.AddHook(prefixHook{})
+}
+
+// prefixWriter prefixes every line written to it, so the output of rbd of
+// parallel backups can be told apart.
+type prefixWriter struct {
+	mu          sync.Mutex
+	w           io.Writer
+	prefix      []byte
+	atLineStart bool
+}
+
+func newPrefixWriter(w io.Writer, prefix string) io.Writer {
+	return &prefixWriter{w: w, prefix: []byte("[" + prefix + "] "), atLineStart: true}
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var out bytes.Buffer
+	for _, b := range data {
+		if p.atLineStart {
+			out.Write(p.prefix)
+			p.atLineStart = false
+		}
+		out.WriteByte(b)
+		if b == '\n' {
+			p.atLineStart = true
+		}
+	}
+
+	if _, err := p.w.Write(out.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
@@ -1,18 +1,32 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	log "github.com/sirupsen/logrus"
 )
 
+// Exit codes of a backup run, so CronJobs and alerting can tell a run where
+// every PVC failed from one where only some did.
+const (
+	exitTotalFailure   = 2
+	exitPartialFailure = 3
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
 var (
-	cfgFile   string
-	namespace string
-	verbose   bool
+	cfgFile       string
+	namespaces    []string
+	allNamespaces bool
+	selector      string
+	verbose       bool
 )
 
 var rootCmd = &cobra.Command{
@@ -20,7 +34,7 @@ var rootCmd = &cobra.Command{
 	Short: "Backup CEPH CSI backed PVCs in Kubernetes",
 	Long: `A tool to backup Kubernetes Persistent Volume Claims that are backed by CEPH CSI.
 This tool will:
-1. List PVCs in a namespace
+1. List PVCs in one or more namespaces
 2. Extract CEPH pool and image information from attached PVs
 3. Export RBD images using rbd command
 4. Compress with gzip
@@ -35,11 +49,25 @@ func init() {
 	cobra.OnInitialize(initConfig)
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.k8s-ceph-backup.yaml)")
-	rootCmd.PersistentFlags().StringVarP(&namespace, "namespace", "n", "default", "Kubernetes namespace to backup PVCs from")
+	rootCmd.PersistentFlags().StringSliceVarP(&namespaces, "namespace", "n", []string{"default"}, "Kubernetes namespace to backup PVCs from (repeatable)")
+	rootCmd.PersistentFlags().BoolVarP(&allNamespaces, "all-namespaces", "A", false, "backup PVCs from all namespaces")
+	rootCmd.PersistentFlags().StringVarP(&selector, "selector", "l", "", "label selector to filter PVCs (e.g. tier=db,backup!=skip)")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "verbose output")
+	rootCmd.Flags().String("summary-file", "", "write a JSON summary of the run to this file")
+	rootCmd.Flags().Int("concurrency", 1, "number of PVCs to back up in parallel")
+	rootCmd.Flags().Bool("prune", false, "apply retention policies to the backed up PVCs after each successful backup")
+	rootCmd.Flags().Bool("daemon", false, "keep running, back up every --interval and serve metrics")
+	rootCmd.Flags().Duration("interval", 24*time.Hour, "time between backup runs in daemon mode")
 
 	viper.BindPFlag("namespace", rootCmd.PersistentFlags().Lookup("namespace"))
+	viper.BindPFlag("all_namespaces", rootCmd.PersistentFlags().Lookup("all-namespaces"))
+	viper.BindPFlag("selector", rootCmd.PersistentFlags().Lookup("selector"))
 	viper.BindPFlag("verbose", rootCmd.PersistentFlags().Lookup("verbose"))
+	viper.BindPFlag("backup.summary_file", rootCmd.Flags().Lookup("summary-file"))
+	viper.BindPFlag("backup.concurrency", rootCmd.Flags().Lookup("concurrency"))
+	viper.BindPFlag("backup.prune", rootCmd.Flags().Lookup("prune"))
+	viper.BindPFlag("daemon.enabled", rootCmd.Flags().Lookup("daemon"))
+	viper.BindPFlag("daemon.interval", rootCmd.Flags().Lookup("interval"))
 }
 
 func initConfig() {
@@ -66,14 +94,96 @@ func initConfig() {
 }
 
 func runBackup() {
-	log.Info("Starting CEPH CSI PVC backup process")
-	
-	backupService := NewBackupService()
-	if err := backupService.Run(viper.GetString("namespace")); err != nil {
+	if viper.GetBool("daemon.enabled") {
+		runDaemon()
+		return
+	}
+
+	metrics := NewMetrics()
+	summary, err := runOnce(metrics)
+
+	if url := viper.GetString("metrics.pushgateway_url"); url != "" {
+		if err := metrics.Push(url, metricsJob()); err != nil {
+			log.Error("Failed to push metrics: ", err)
+		}
+	}
+
+	var failed *BackupFailedError
+	switch {
+	case errors.As(err, &failed) && failed.Total():
+		log.Error("Backup failed: ", err)
+		os.Exit(exitTotalFailure)
+	case errors.As(err, &failed):
+		log.Error("Backup partially failed: ", err)
+		os.Exit(exitPartialFailure)
+	case err != nil:
 		log.Fatal("Backup failed:", err)
 	}
-	
-	log.Info("Backup completed successfully")
+
+	log.Infof("Backup completed successfully (%d PVCs)", summary.count(resultSucceeded))
+}
+
+// runDaemon backs up every daemon.interval and serves the metrics of the
+// runs until the process is stopped. Failed runs, including those with an
+// invalid configuration, are logged and retried at the next interval.
+func runDaemon() {
+	interval := viper.GetDuration("daemon.interval")
+	if interval <= 0 {
+		log.Fatalf("Invalid daemon interval %s", interval)
+	}
+
+	metrics := NewMetrics()
+	address := viper.GetString("metrics.listen_address")
+	if address == "" {
+		address = ":9090"
+	}
+	go func() {
+		log.Fatal(metrics.Serve(address))
+	}()
+
+	log.Infof("Running in daemon mode, backing up every %s", interval)
+	for {
+		if _, err := runOnce(metrics); err != nil {
+			log.Error("Backup run failed: ", err)
+		}
+
+		log.Infof("Next backup run at %s", time.Now().Add(interval).Format(time.RFC3339))
+		time.Sleep(interval)
+	}
+}
+
+// runOnce performs a single backup run, reports its results and records
+// them in metrics.
+func runOnce(metrics *Metrics) (*RunSummary, error) {
+	log.Info("Starting CEPH CSI PVC backup process")
+
+	backupService, err := NewBackupService()
+	if err != nil {
+		now := time.Now().UTC()
+		summary := &RunSummary{Started: now, Finished: now}
+		metrics.Record(summary, err)
+		return summary, err
+	}
+	summary, err := backupService.Run(viper.GetStringSlice("namespace"))
+
+	summary.PrintTable(os.Stdout)
+
+	if path := viper.GetString("backup.summary_file"); path != "" {
+		if err := summary.WriteJSON(path); err != nil {
+			log.Error("Failed to write summary:", err)
+		}
+	}
+
+	metrics.Record(summary, err)
+
+	return summary, err
+}
+
+func metricsJob() string {
+	if job := viper.GetString("metrics.job"); job != "" {
+		return job
+	}
+	return "k8s-ceph-backup"
 }
 
 func main() {
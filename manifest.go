@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	manifestSuffix        = ".manifest.json"
+	manifestFormatVersion = 1
+)
+
+// BackupManifest is stored as a JSON object next to every backup and
+// describes where the data came from and how it was written.
+type BackupManifest struct {
+	FormatVersion int    `json:"format_version"`
+	ToolVersion   string `json:"tool_version"`
+	Object        string `json:"object"`
+
+	Namespace    string   `json:"namespace"`
+	PVC          string   `json:"pvc"`
+	PV           string   `json:"pv"`
+	StorageClass string   `json:"storage_class,omitempty"`
+	Capacity     string   `json:"capacity,omitempty"`
+	AccessModes  []string `json:"access_modes,omitempty"`
+	VolumeMode   string   `json:"volume_mode,omitempty"`
+
+	// For CephFS backups Pool and Image hold the filesystem and subvolume.
+	VolumeType     string   `json:"volume_type,omitempty"`
+	Pool           string   `json:"pool"`
+	Image          string   `json:"image"`
+	RadosNamespace string   `json:"rados_namespace,omitempty"`
+	SubvolumeGroup string   `json:"subvolume_group,omitempty"`
+	SubvolumePath  string   `json:"subvolume_path,omitempty"`
+	ClusterID      string   `json:"cluster_id,omitempty"`
+	ImageSize      uint64   `json:"image_size_bytes,omitempty"`
+	ImageFeatures  []string `json:"image_features,omitempty"`
+
+	Type         string    `json:"type"`
+	Snapshot     string    `json:"snapshot,omitempty"`
+	FromSnapshot string    `json:"from_snapshot,omitempty"`
+	Parent       string    `json:"parent,omitempty"`
+	ChainStart   time.Time `json:"chain_start"`
+	ChainLength  int       `json:"chain_length"`
+	Retention    string    `json:"retention,omitempty"`
+
+	// Resources is the key of the sanitized PVC, PV and StorageClass YAML.
+	Resources       string `json:"resources,omitempty"`
+	ResourcesSHA256 string `json:"resources_sha256,omitempty"`
+
+	Compression string   `json:"compression"`
+	Encryption  string   `json:"encryption"`
+	Recipients  []string `json:"recipients,omitempty"`
+
+	// Envelope is the wrapped data key of envelope encrypted backups,
+	// without which they cannot be decrypted.
+	Envelope *EnvelopeKey `json:"envelope,omitempty"`
+
+	// Signature is the key of the detached signature of the object and
+	// SignedBy the key that made it, for signed backups.
+	Signature string `json:"signature,omitempty"`
+	SignedBy  string `json:"signed_by,omitempty"`
+
+	RawSize        int64  `json:"raw_size_bytes"`
+	RawSHA256      string `json:"raw_sha256"`
+	CompressedSize int64  `json:"compressed_size_bytes"`
+	Size           int64  `json:"size_bytes"`
+	SHA256         string `json:"sha256"`
+
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+// Metadata returns the chain information of the manifest.
+func (m *BackupManifest) Metadata() BackupMetadata {
+	return BackupMetadata{
+		Type:         m.Type,
+		Snapshot:     m.Snapshot,
+		FromSnapshot: m.FromSnapshot,
+		Parent:       m.Parent,
+		ChainStart:   m.ChainStart,
+		ChainLength:  m.ChainLength,
+		Retention:    m.Retention,
+		Encryption:   m.Encryption,
+	}
+}
+
+// manifestObjectName returns the key of the manifest belonging to a backup.
+func manifestObjectName(objectName string) string {
+	return objectName + manifestSuffix
+}
+
+// newManifest starts the manifest of a backup of image. Sizes, checksums and
+// the finish time are filled in as the backup proceeds.
+func (bs *BackupService) newManifest(image CephImage, metadata BackupMetadata, objectName string, started time.Time) *BackupManifest {
+	manifest := &BackupManifest{
+		FormatVersion: manifestFormatVersion,
+		ToolVersion:   version,
+		Object:        objectName,
+
+		Namespace:    image.Namespace,
+		PVC:          image.PVCName,
+		PV:           image.PVName,
+		StorageClass: image.StorageClass,
+		Capacity:     image.Capacity,
+		AccessModes:  image.AccessModes,
+		VolumeMode:   image.VolumeMode,
+
+		VolumeType:     image.VolumeType,
+		Pool:           image.Pool,
+		Image:          image.ImageName,
+		RadosNamespace: image.RadosNamespace,
+		SubvolumeGroup: image.SubvolumeGroup,
+		SubvolumePath:  image.SubvolumePath,
+		ClusterID:      image.ClusterID,
+
+		Type:         metadata.Type,
+		Snapshot:     metadata.Snapshot,
+		FromSnapshot: metadata.FromSnapshot,
+		Parent:       metadata.Parent,
+		ChainStart:   metadata.ChainStart,
+		ChainLength:  metadata.ChainLength,
+		Retention:    metadata.Retention,
+
+		Compression: "gzip",
+		Encryption:  bs.encryptor.Name(),
+
+		Started: started,
+	}
+
+	// The manifest is informational beyond the chain fields, so a failed
+	// lookup is not worth failing the backup for.
+	if image.VolumeType != volumeTypeCephFS {
+		if info, err := bs.cephClient.ImageInfo(image.rbdPool(), image.ImageName); err != nil {
+			bs.logger.Warnf("Failed to read RBD image info for manifest: %v", err)
+		} else {
+			manifest.ImageSize = info.Size
+			manifest.ImageFeatures = info.Features
+		}
+	}
+
+	if recipients, err := bs.encryptor.Recipients(); err != nil {
+		bs.logger.Warnf("Failed to read encryption recipients for manifest: %v", err)
+	} else {
+		manifest.Recipients = recipients
+	}
+
+	return manifest
+}
+
+// writeManifest uploads the manifest of a finished backup.
+func (bs *BackupService) writeManifest(manifest *BackupManifest) error {
+	manifest.Finished = time.Now().UTC()
+
+	return uploadManifest(bs.minioClient, bs.signer, manifest)
+}
+
+// uploadManifest stores manifest next to its backup, signed by signer
+// unless it is nil. The manifest is signed along with the data: restores
+// take the chain, checksums and wrapped data key from it.
+func uploadManifest(minioClient *MinioClient, signer *Signer, manifest *BackupManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode backup manifest: %w", err)
+	}
+
+	if err := uploadSigned(minioClient, signer, manifestObjectName(manifest.Object), data, "application/json"); err != nil {
+		return fmt.Errorf("failed to upload backup manifest: %w", err)
+	}
+	return nil
+}
+
+// loadBackupManifest reads the manifest of a backup. Backups written before
+// manifests existed have none; the returned error then satisfies isNotFound.
+func loadBackupManifest(minioClient *MinioClient, objectName string) (*BackupManifest, error) {
+	var manifest BackupManifest
+	if err := minioClient.DownloadJSON(manifestObjectName(objectName), &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// readBackupMetadata returns the chain information of a backup from its
+// manifest, falling back to the object's user metadata for backups written
+// before manifests existed. The manifest is nil in that case.
+func readBackupMetadata(minioClient *MinioClient, objectName string) (BackupMetadata, *BackupManifest, error) {
+	manifest, err := loadBackupManifest(minioClient, objectName)
+	if err == nil {
+		return manifest.Metadata(), manifest, nil
+	}
+	if !isNotFound(err) {
+		return BackupMetadata{}, nil, err
+	}
+
+	info, err := minioClient.StatObject(objectName)
+	if err != nil {
+		return BackupMetadata{}, nil, err
+	}
+	return parseBackupMetadata(info.UserMetadata), nil, nil
+}
+
+// isManifestObject reports whether objectName is a manifest rather than
+// backup data.
+func isManifestObject(objectName string) bool {
+	return strings.HasSuffix(objectName, manifestSuffix)
+}
+
+// verifyChecksum compares a hex encoded sha256 against the expected value
+// from a manifest. An empty expectation is not checked.
+func verifyChecksum(what, expected, actual string) error {
+	if expected == "" {
+		return nil
+	}
+	if actual != expected {
+		return fmt.Errorf("%s checksum mismatch: expected sha256 %s, got %s", what, expected, actual)
+	}
+	return nil
+}
+
+// fileSHA256 returns the hex encoded sha256 of the file at path.
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to hash file: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
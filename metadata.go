@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	backupTypeFull        = "full"
+	backupTypeIncremental = "incremental"
+
+	fullBackupSuffix    = ".rbd.gz"
+	diffBackupSuffix    = ".rbd-diff.gz"
+	archiveBackupSuffix = ".tar.gz"
+)
+
+// Backup objects end in the suffix of their encryption format: binary
+// OpenPGP messages in .gpg, armored ones in .asc, age files in .age and
+// envelope encrypted data in .enc. Backups written before binary output
+// existed are armored but end in .gpg.
+const (
+	binaryPGPSuffix  = ".gpg"
+	armoredPGPSuffix = ".asc"
+	ageSuffix        = ".age"
+	envelopeSuffix   = ".enc"
+)
+
+var encryptionSuffixes = []string{binaryPGPSuffix, armoredPGPSuffix, ageSuffix, envelopeSuffix}
+
+// trimEncryptionSuffix cuts the encryption suffix off objectName and
+// reports whether it had one.
+func trimEncryptionSuffix(objectName string) (string, bool) {
+	for _, suffix := range encryptionSuffixes {
+		if strings.HasSuffix(objectName, suffix) {
+			return strings.TrimSuffix(objectName, suffix), true
+		}
+	}
+	return objectName, false
+}
+
+// BackupMetadata is stored as S3 user metadata on every backup object and
+// links incremental backups to their parent.
+type BackupMetadata struct {
+	Type         string
+	Snapshot     string
+	FromSnapshot string
+	Parent       string
+	ChainStart   time.Time
+	ChainLength  int
+	Retention    string
+
+	// Encryption is the provider the object is encrypted with. It is empty
+	// for objects written before providers were recorded.
+	Encryption string
+}
+
+func (m BackupMetadata) IsIncremental() bool {
+	return m.Type == backupTypeIncremental
+}
+
+func (m BackupMetadata) UserMetadata() map[string]string {
+	metadata := map[string]string{
+		"backup-type":  m.Type,
+		"chain-length": strconv.Itoa(m.ChainLength),
+	}
+	if m.Snapshot != "" {
+		metadata["snapshot"] = m.Snapshot
+	}
+	if m.FromSnapshot != "" {
+		metadata["from-snapshot"] = m.FromSnapshot
+	}
+	if m.Parent != "" {
+		metadata["parent"] = m.Parent
+	}
+	if !m.ChainStart.IsZero() {
+		metadata["chain-start"] = m.ChainStart.UTC().Format(time.RFC3339)
+	}
+	if m.Retention != "" {
+		metadata["retention"] = m.Retention
+	}
+	if m.Encryption != "" {
+		metadata["encryption"] = m.Encryption
+	}
+	return metadata
+}
+
+// parseBackupMetadata reads BackupMetadata back from the user metadata
+// returned by StatObject. Objects uploaded before incremental support carry
+// no backup-type and are treated as full backups.
+func parseBackupMetadata(userMetadata map[string]string) BackupMetadata {
+	get := func(key string) string {
+		if value, ok := userMetadata[key]; ok {
+			return value
+		}
+		return userMetadata[http.CanonicalHeaderKey(key)]
+	}
+
+	metadata := BackupMetadata{
+		Type:         get("backup-type"),
+		Snapshot:     get("snapshot"),
+		FromSnapshot: get("from-snapshot"),
+		Parent:       get("parent"),
+		Retention:    get("retention"),
+		Encryption:   get("encryption"),
+	}
+	if metadata.Type == "" {
+		metadata.Type = backupTypeFull
+	}
+	if start, err := time.Parse(time.RFC3339, get("chain-start")); err == nil {
+		metadata.ChainStart = start
+	}
+	if length, err := strconv.Atoi(get("chain-length")); err == nil {
+		metadata.ChainLength = length
+	}
+	return metadata
+}
+
+// backupObjectName builds the object key of a backup. A non-empty
+// namespace is used as a key prefix so equally named PVCs of different
+// namespaces do not collide. CephFS backups are tar archives.
+// encryptionSuffix names the format the data is encrypted in.
+func backupObjectName(namespace, pvcName, isoDate, volumeType, backupType, encryptionSuffix string) string {
+	suffix := fullBackupSuffix
+	switch {
+	case volumeType == volumeTypeCephFS:
+		suffix = archiveBackupSuffix
+	case backupType == backupTypeIncremental:
+		suffix = diffBackupSuffix
+	}
+	return backupObjectPrefix(namespace, pvcName) + isoDate + suffix + encryptionSuffix
+}
+
+// backupObjectPrefix is the key prefix shared by all backups of a PVC.
+func backupObjectPrefix(namespace, pvcName string) string {
+	if namespace == "" {
+		return pvcName + "-"
+	}
+	return namespace + "/" + pvcName + "-"
+}
+
+// BackupObjectName holds the parts encoded in a backup object key.
+type BackupObjectName struct {
+	Namespace string
+	PVCName   string
+	Time      time.Time
+	Type      string
+}
+
+// parseBackupObjectName splits an object key created by backupObjectName
+// into its parts. It cuts the fixed-length timestamp off the end, so PVC
+// names containing dashes are preserved.
+func parseBackupObjectName(objectName string) (BackupObjectName, bool) {
+	const isoDateLayout = "2006-01-02T15-04-05Z"
+
+	var parsed BackupObjectName
+	base, ok := trimEncryptionSuffix(objectName)
+	if !ok {
+		return BackupObjectName{}, false
+	}
+
+	switch {
+	case strings.HasSuffix(base, diffBackupSuffix):
+		base = strings.TrimSuffix(base, diffBackupSuffix)
+		parsed.Type = backupTypeIncremental
+	case strings.HasSuffix(base, fullBackupSuffix):
+		base = strings.TrimSuffix(base, fullBackupSuffix)
+		parsed.Type = backupTypeFull
+	case strings.HasSuffix(base, archiveBackupSuffix):
+		base = strings.TrimSuffix(base, archiveBackupSuffix)
+		parsed.Type = backupTypeFull
+	default:
+		return BackupObjectName{}, false
+	}
+
+	if namespace, rest, found := strings.Cut(base, "/"); found {
+		parsed.Namespace = namespace
+		base = rest
+	}
+
+	if len(base) < len(isoDateLayout)+2 || base[len(base)-len(isoDateLayout)-1] != '-' {
+		return BackupObjectName{}, false
+	}
+
+	backupTime, err := time.Parse(isoDateLayout, base[len(base)-len(isoDateLayout):])
+	if err != nil {
+		return BackupObjectName{}, false
+	}
+
+	parsed.PVCName = base[:len(base)-len(isoDateLayout)-1]
+	parsed.Time = backupTime
+	return parsed, true
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBackupObjectName(t *testing.T) {
+	taken := time.Date(2026, 10, 1, 2, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		objectName string
+		expected   BackupObjectName
+	}{
+		{"data-2026-10-01T02-00-00Z.rbd.gz.gpg", BackupObjectName{PVCName: "data", Time: taken, Type: backupTypeFull}},
+		{"my-data-pvc-2026-10-01T02-00-00Z.rbd.gz.gpg", BackupObjectName{PVCName: "my-data-pvc", Time: taken, Type: backupTypeFull}},
+		{"production/my-data-pvc-2026-10-01T02-00-00Z.rbd.gz.asc", BackupObjectName{Namespace: "production", PVCName: "my-data-pvc", Time: taken, Type: backupTypeFull}},
+		{"kube-system/data-0-2026-10-01T02-00-00Z.rbd-diff.gz.age", BackupObjectName{Namespace: "kube-system", PVCName: "data-0", Time: taken, Type: backupTypeIncremental}},
+		{"production/shared-files-2026-10-01T02-00-00Z.tar.gz.enc", BackupObjectName{Namespace: "production", PVCName: "shared-files", Time: taken, Type: backupTypeFull}},
+		{"production/2026-10-01-2026-10-01T02-00-00Z.rbd.gz.gpg", BackupObjectName{Namespace: "production", PVCName: "2026-10-01", Time: taken, Type: backupTypeFull}},
+	} {
+		parsed, ok := parseBackupObjectName(test.objectName)
+		if !ok {
+			t.Errorf("%s: rejected", test.objectName)
+			continue
+		}
+		if parsed != test.expected {
+			t.Errorf("%s: got %+v, expected %+v", test.objectName, parsed, test.expected)
+		}
+	}
+
+	for _, objectName := range []string{
+		"data-2026-10-01T02-00-00Z.rbd.gz",
+		"data-2026-10-01T02-00-00Z.rbd.gz.gpg.sig",
+		"data-2026-10-01T02-00-00Z.rbd.gz.gpg.manifest.json",
+		"data-2026-10-01T02-00-00Z.img.gz.gpg",
+		"data-2026-10-01T02:00:00Z.rbd.gz.gpg",
+		"data-2026-13-01T02-00-00Z.rbd.gz.gpg",
+		"data2026-10-01T02-00-00Z.rbd.gz.gpg",
+		"-2026-10-01T02-00-00Z.rbd.gz.gpg",
+		"production/-2026-10-01T02-00-00Z.rbd-diff.gz.age",
+		"2026-10-01T02-00-00Z.tar.gz.enc",
+	} {
+		if parsed, ok := parseBackupObjectName(objectName); ok {
+			t.Errorf("%s: accepted as %+v", objectName, parsed)
+		}
+	}
+}
+
+func TestParseBackupObjectNameRoundTrip(t *testing.T) {
+	for _, suffix := range encryptionSuffixes {
+		for _, backupType := range []string{backupTypeFull, backupTypeIncremental} {
+			objectName := backupObjectName("production", "my-data-pvc", "2026-10-01T02-00-00Z", volumeTypeRBD, backupType, suffix)
+			parsed, ok := parseBackupObjectName(objectName)
+			if !ok || parsed.Namespace != "production" || parsed.PVCName != "my-data-pvc" || parsed.Type != backupType {
+				t.Errorf("%s: got %+v, %v", objectName, parsed, ok)
+			}
+		}
+	}
+}
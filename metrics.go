@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	log "github.com/sirupsen/logrus"
+)
+
+const metricsNamespace = "k8s_ceph_backup"
+
+// Metrics holds the Prometheus metrics of backup runs. It is served on
+// /metrics in daemon mode and pushed to a Pushgateway after one-shot runs.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	lastSuccess     *prometheus.GaugeVec
+	duration        *prometheus.GaugeVec
+	exportedBytes   *prometheus.GaugeVec
+	compressedBytes *prometheus.GaugeVec
+	uploadedBytes   *prometheus.GaugeVec
+	failures        *prometheus.CounterVec
+
+	runPVCs          *prometheus.GaugeVec
+	runDuration      prometheus.Gauge
+	runLastTimestamp prometheus.Gauge
+	runs             *prometheus.CounterVec
+}
+
+func NewMetrics() *Metrics {
+	pvcLabels := []string{"namespace", "pvc"}
+
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "last_success_timestamp_seconds",
+			Help:      "Unix time of the last successful backup of the PVC.",
+		}, pvcLabels),
+		duration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "duration_seconds",
+			Help:      "Duration of the last backup attempt of the PVC.",
+		}, pvcLabels),
+		exportedBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "exported_bytes",
+			Help:      "Bytes exported from RBD by the last successful backup of the PVC.",
+		}, pvcLabels),
+		compressedBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "compressed_bytes",
+			Help:      "Bytes after compression in the last successful backup of the PVC.",
+		}, pvcLabels),
+		uploadedBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "uploaded_bytes",
+			Help:      "Bytes uploaded by the last successful backup of the PVC.",
+		}, pvcLabels),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "failures_total",
+			Help:      "Failed PVC backups by the stage they failed in. Runs failing before backing up any PVC count without namespace and PVC at stage setup.",
+		}, append(pvcLabels, "stage")),
+
+		runPVCs: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "run_pvcs",
+			Help:      "PVCs of the last run by result status.",
+		}, []string{"status"}),
+		runDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "run_duration_seconds",
+			Help:      "Duration of the last backup run.",
+		}),
+		runLastTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "run_last_timestamp_seconds",
+			Help:      "Unix time the last backup run finished.",
+		}),
+		runs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "runs_total",
+			Help:      "Backup runs by overall status.",
+		}, []string{"status"}),
+	}
+
+	m.registry.MustRegister(
+		m.lastSuccess, m.duration, m.exportedBytes, m.compressedBytes, m.uploadedBytes, m.failures,
+		m.runPVCs, m.runDuration, m.runLastTimestamp, m.runs,
+	)
+
+	return m
+}
+
+// Record updates the metrics from the results of a finished run. err is the
+// error returned by the run; anything but a *BackupFailedError counts the run
+// as "error" and a failure at stage setup, since it did not get to back up
+// all PVCs.
+func (m *Metrics) Record(summary *RunSummary, err error) {
+	for _, result := range summary.Results {
+		labels := prometheus.Labels{"namespace": result.Namespace, "pvc": result.PVC}
+
+		if !result.LastSuccess.IsZero() {
+			m.lastSuccess.With(labels).Set(float64(result.LastSuccess.Unix()))
+		}
+
+		switch result.Status {
+		case resultSucceeded:
+			m.duration.With(labels).Set(result.Duration.Seconds())
+			m.exportedBytes.With(labels).Set(float64(result.ExportedBytes))
+			m.compressedBytes.With(labels).Set(float64(result.CompressedBytes))
+			m.uploadedBytes.With(labels).Set(float64(result.Size))
+		case resultFailed:
+			m.duration.With(labels).Set(result.Duration.Seconds())
+			stage := result.Stage
+			if stage == "" {
+				stage = "other"
+			}
+			m.failures.WithLabelValues(result.Namespace, result.PVC, stage).Inc()
+		}
+	}
+
+	for _, status := range []string{resultSucceeded, resultFailed, resultSkipped} {
+		m.runPVCs.WithLabelValues(status).Set(float64(summary.count(status)))
+	}
+	m.runDuration.Set(summary.Finished.Sub(summary.Started).Seconds())
+	m.runLastTimestamp.Set(float64(summary.Finished.Unix()))
+
+	status := summary.status()
+	var failed *BackupFailedError
+	if err != nil && !errors.As(err, &failed) {
+		status = "error"
+		m.failures.WithLabelValues("", "", stageSetup).Inc()
+	}
+	m.runs.WithLabelValues(status).Inc()
+}
+
+// Serve exposes the metrics and the Go runtime metrics on /metrics at addr.
+// It blocks until the server fails.
+func (m *Metrics) Serve(addr string) error {
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+
+	log.Infof("Serving metrics on %s/metrics", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		return fmt.Errorf("metrics server failed: %w", err)
+	}
+	return nil
+}
+
+// Push sends the metrics to the Pushgateway at url, replacing the previous
+// push of job.
+func (m *Metrics) Push(url, job string) error {
+	log.Infof("Pushing metrics to %s (job %s)", url, job)
+
+	if err := push.New(url, job).Gatherer(m.registry).Push(); err != nil {
+		return fmt.Errorf("failed to push metrics: %w", err)
+	}
+	return nil
+}
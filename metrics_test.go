@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecordSetupFailure(t *testing.T) {
+	metrics := NewMetrics()
+	now := time.Now()
+
+	metrics.Record(&RunSummary{Started: now, Finished: now}, errors.New("invalid backup.snapshots.keep -1"))
+	metrics.Record(&RunSummary{Started: now, Finished: now}, errors.New("invalid backup.snapshots.keep -1"))
+
+	if failures := testutil.ToFloat64(metrics.failures.WithLabelValues("", "", stageSetup)); failures != 2 {
+		t.Fatalf("recorded %v setup failures, expected 2", failures)
+	}
+	if runs := testutil.ToFloat64(metrics.runs.WithLabelValues("error")); runs != 2 {
+		t.Fatalf("recorded %v failed runs, expected 2", runs)
+	}
+}
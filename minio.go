@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 
@@ -15,9 +19,22 @@ import (
 type MinioClient struct {
 	client     *minio.Client
 	bucketName string
+	partSize   uint64
+
+	logger *log.Entry
 }
 
 func NewMinioClient() *MinioClient {
+	m, err := newMinioClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return m
+}
+
+// newMinioClient creates a client from the configuration, returning
+// configuration errors for callers that must not exit on them.
+func newMinioClient() (*MinioClient, error) {
 	endpoint := viper.GetString("minio.endpoint")
 	
 	// Environment variables take precedence over config file
@@ -35,16 +52,16 @@ func NewMinioClient() *MinioClient {
 	bucketName := viper.GetString("minio.bucket_name")
 
 	if endpoint == "" {
-		log.Fatal("MinIO endpoint not configured")
+		return nil, fmt.Errorf("MinIO endpoint not configured")
 	}
 	if accessKey == "" {
-		log.Fatal("MinIO access key not configured")
+		return nil, fmt.Errorf("MinIO access key not configured")
 	}
 	if secretKey == "" {
-		log.Fatal("MinIO secret key not configured")
+		return nil, fmt.Errorf("MinIO secret key not configured")
 	}
 	if bucketName == "" {
-		log.Fatal("MinIO bucket name not configured")
+		return nil, fmt.Errorf("MinIO bucket name not configured")
 	}
 
 	minioClient, err := minio.New(endpoint, &minio.Options{
@@ -52,68 +69,209 @@ func NewMinioClient() *MinioClient {
 		Secure: useSSL,
 	})
 	if err != nil {
-		log.Fatal("Failed to create MinIO client:", err)
+		return nil, fmt.Errorf("failed to create MinIO client: %w", err)
+	}
+
+	// Streamed uploads have no known length, so minio-go buffers one part
+	// at a time in memory. The part size also caps the object size at
+	// 10000 parts.
+	partSize := viper.GetUint64("minio.part_size_mb") * 1024 * 1024
+	if partSize == 0 {
+		partSize = 128 * 1024 * 1024
 	}
 
 	return &MinioClient{
 		client:     minioClient,
 		bucketName: bucketName,
-	}
+		partSize:   partSize,
+		logger:     log.NewEntry(log.StandardLogger()),
+	}, nil
 }
 
-func (m *MinioClient) UploadFile(filePath, objectName string) error {
-	log.Infof("Uploading file %s to MinIO as %s", filePath, objectName)
-
-	ctx := context.Background()
+// WithPrefix returns a copy of the client whose log messages are prefixed
+// with prefix.
+func (m *MinioClient) WithPrefix(prefix string) *MinioClient {
+	prefixed := *m
+	prefixed.logger = log.WithField(logPrefixField, prefix)
+	return &prefixed
+}
 
+func (m *MinioClient) ensureBucket(ctx context.Context) error {
 	exists, err := m.client.BucketExists(ctx, m.bucketName)
 	if err != nil {
 		return fmt.Errorf("failed to check if bucket exists: %w", err)
 	}
 
 	if !exists {
-		log.Infof("Creating bucket %s", m.bucketName)
+		m.logger.Infof("Creating bucket %s", m.bucketName)
 		err = m.client.MakeBucket(ctx, m.bucketName, minio.MakeBucketOptions{})
 		if err != nil {
+			// A parallel worker may have created it in the meantime.
+			if exists, existsErr := m.client.BucketExists(ctx, m.bucketName); existsErr == nil && exists {
+				return nil
+			}
 			return fmt.Errorf("failed to create bucket: %w", err)
 		}
 	}
 
+	return nil
+}
+
+// objectMetadata merges the metadata stored with every upload into extra.
+func objectMetadata(originalFilename string, extra map[string]string) map[string]string {
+	metadata := map[string]string{
+		"original-filename": originalFilename,
+		"backup-tool":       "k8s-ceph-backup",
+	}
+	for key, value := range extra {
+		metadata[key] = value
+	}
+	return metadata
+}
+
+// contentType returns the content type of a backup object by its suffix.
+// Armored OpenPGP messages are text, binary ones plain octets.
+func contentType(name string) string {
+	if filepath.Ext(name) == armoredPGPSuffix {
+		return "application/pgp-encrypted"
+	}
+	return "application/octet-stream"
+}
+
+// UploadFile uploads filePath as objectName and returns the stored size.
+func (m *MinioClient) UploadFile(filePath, objectName string, metadata map[string]string) (int64, error) {
+	m.logger.Infof("Uploading file %s to MinIO as %s", filePath, objectName)
+
+	ctx := context.Background()
+
+	if err := m.ensureBucket(ctx); err != nil {
+		return 0, err
+	}
+
 	file, err := os.Open(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+		return 0, fmt.Errorf("failed to open file: %w", err)
 	}
 	defer file.Close()
 
 	fileStat, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to stat file: %w", err)
+		return 0, fmt.Errorf("failed to stat file: %w", err)
 	}
 
-	contentType := "application/octet-stream"
-	if filepath.Ext(filePath) == ".gpg" {
-		contentType = "application/pgp-encrypted"
+	uploadInfo, err := m.client.PutObject(ctx, m.bucketName, objectName, file, fileStat.Size(), minio.PutObjectOptions{
+		ContentType:  contentType(filePath),
+		UserMetadata: objectMetadata(filepath.Base(filePath), metadata),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to upload file: %w", err)
 	}
 
-	uploadInfo, err := m.client.PutObject(ctx, m.bucketName, objectName, file, fileStat.Size(), minio.PutObjectOptions{
-		ContentType: contentType,
-		UserMetadata: map[string]string{
-			"original-filename": filepath.Base(filePath),
-			"backup-tool":      "k8s-ceph-backup",
-		},
+	m.logger.Infof("Successfully uploaded %s to MinIO bucket %s (ETag: %s, Size: %d bytes)", 
+		objectName, m.bucketName, uploadInfo.ETag, uploadInfo.Size)
+
+	return uploadInfo.Size, nil
+}
+
+// UploadStream uploads everything read from reader as objectName using a
+// multipart upload of unknown length. If reader fails, the multipart upload
+// is aborted and no object is created.
+func (m *MinioClient) UploadStream(ctx context.Context, reader io.Reader, objectName string, metadata map[string]string) (int64, error) {
+	m.logger.Infof("Streaming upload to MinIO as %s", objectName)
+
+	if err := m.ensureBucket(ctx); err != nil {
+		return 0, err
+	}
+
+	uploadInfo, err := m.client.PutObject(ctx, m.bucketName, objectName, reader, -1, minio.PutObjectOptions{
+		ContentType:  contentType(objectName),
+		PartSize:     m.partSize,
+		UserMetadata: objectMetadata(objectName, metadata),
 	})
 	if err != nil {
-		return fmt.Errorf("failed to upload file: %w", err)
+		return 0, fmt.Errorf("failed to upload stream: %w", err)
 	}
 
-	log.Infof("Successfully uploaded %s to MinIO bucket %s (ETag: %s, Size: %d bytes)", 
+	m.logger.Infof("Successfully uploaded %s to MinIO bucket %s (ETag: %s, Size: %d bytes)",
 		objectName, m.bucketName, uploadInfo.ETag, uploadInfo.Size)
 
+	return uploadInfo.Size, nil
+}
+
+// UploadJSON stores v as a small JSON object.
+func (m *MinioClient) UploadJSON(objectName string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", objectName, err)
+	}
+
+	return m.UploadBytes(objectName, data, "application/json")
+}
+
+// UploadBytes stores data as a small object of the given content type.
+func (m *MinioClient) UploadBytes(objectName string, data []byte, contentType string) error {
+	m.logger.Debugf("Uploading %s to MinIO", objectName)
+
+	ctx := context.Background()
+
+	if err := m.ensureBucket(ctx); err != nil {
+		return err
+	}
+
+	_, err := m.client.PutObject(ctx, m.bucketName, objectName, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType:  contentType,
+		UserMetadata: objectMetadata(objectName, nil),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", objectName, err)
+	}
+
 	return nil
 }
 
+// DownloadJSON decodes the JSON object objectName into v.
+func (m *MinioClient) DownloadJSON(objectName string, v interface{}) error {
+	m.logger.Debugf("Downloading %s from MinIO", objectName)
+
+	object, err := m.client.GetObject(context.Background(), m.bucketName, objectName, minio.GetObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %w", objectName, err)
+	}
+	defer object.Close()
+
+	if err := json.NewDecoder(object).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", objectName, err)
+	}
+
+	return nil
+}
+
+// DownloadBytes returns the content of the small object objectName.
+func (m *MinioClient) DownloadBytes(objectName string) ([]byte, error) {
+	m.logger.Debugf("Downloading %s from MinIO", objectName)
+
+	object, err := m.client.GetObject(context.Background(), m.bucketName, objectName, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", objectName, err)
+	}
+	defer object.Close()
+
+	data, err := io.ReadAll(object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", objectName, err)
+	}
+
+	return data, nil
+}
+
+// isNotFound reports whether err means the requested object does not exist.
+func isNotFound(err error) bool {
+	var response minio.ErrorResponse
+	return errors.As(err, &response) && response.Code == "NoSuchKey"
+}
+
 func (m *MinioClient) DownloadFile(objectName, filePath string) error {
-	log.Infof("Downloading object %s from MinIO to %s", objectName, filePath)
+	m.logger.Infof("Downloading object %s from MinIO to %s", objectName, filePath)
 
 	ctx := context.Background()
 
@@ -138,17 +296,54 @@ func (m *MinioClient) DownloadFile(objectName, filePath string) error {
 		return fmt.Errorf("failed to download object: %w", err)
 	}
 
-	log.Infof("Successfully downloaded %s from MinIO (Size: %d bytes)", objectName, stat.Size)
+	m.logger.Infof("Successfully downloaded %s from MinIO (Size: %d bytes)", objectName, stat.Size)
 
 	return nil
 }
 
+// DownloadStream returns a reader for objectName. The object is fetched
+// lazily as the reader is consumed.
+func (m *MinioClient) DownloadStream(ctx context.Context, objectName string) (io.ReadCloser, error) {
+	m.logger.Infof("Streaming object %s from MinIO", objectName)
+
+	object, err := m.client.GetObject(ctx, m.bucketName, objectName, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object: %w", err)
+	}
+
+	stat, err := object.Stat()
+	if err != nil {
+		object.Close()
+		return nil, fmt.Errorf("failed to stat object: %w", err)
+	}
+
+	m.logger.Infof("Object %s is %d bytes", objectName, stat.Size)
+
+	return object, nil
+}
+
 func (m *MinioClient) ListObjects(prefix string) ([]string, error) {
-	log.Debugf("Listing objects in bucket %s with prefix %s", m.bucketName, prefix)
+	infos, err := m.ListObjectsInfo(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]string, 0, len(infos))
+	for _, info := range infos {
+		objects = append(objects, info.Key)
+	}
+
+	return objects, nil
+}
+
+// ListObjectsInfo lists the objects under prefix with their size and
+// modification time.
+func (m *MinioClient) ListObjectsInfo(prefix string) ([]minio.ObjectInfo, error) {
+	m.logger.Debugf("Listing objects in bucket %s with prefix %s", m.bucketName, prefix)
 
 	ctx := context.Background()
 
-	var objects []string
+	var objects []minio.ObjectInfo
 
 	objectCh := m.client.ListObjects(ctx, m.bucketName, minio.ListObjectsOptions{
 		Prefix:    prefix,
@@ -159,16 +354,16 @@ func (m *MinioClient) ListObjects(prefix string) ([]string, error) {
 		if object.Err != nil {
 			return nil, fmt.Errorf("error listing objects: %w", object.Err)
 		}
-		objects = append(objects, object.Key)
+		objects = append(objects, object)
 	}
 
-	log.Debugf("Found %d objects with prefix %s", len(objects), prefix)
+	m.logger.Debugf("Found %d objects with prefix %s", len(objects), prefix)
 
 	return objects, nil
 }
 
 func (m *MinioClient) DeleteObject(objectName string) error {
-	log.Infof("Deleting object %s from MinIO", objectName)
+	m.logger.Infof("Deleting object %s from MinIO", objectName)
 
 	ctx := context.Background()
 
@@ -177,13 +372,27 @@ func (m *MinioClient) DeleteObject(objectName string) error {
 		return fmt.Errorf("failed to delete object: %w", err)
 	}
 
-	log.Infof("Successfully deleted object %s from MinIO", objectName)
+	m.logger.Infof("Successfully deleted object %s from MinIO", objectName)
 
 	return nil
 }
 
+// StatObject returns the object's info including its user metadata.
+func (m *MinioClient) StatObject(objectName string) (minio.ObjectInfo, error) {
+	m.logger.Debugf("Reading metadata of object %s", objectName)
+
+	ctx := context.Background()
+
+	info, err := m.client.StatObject(ctx, m.bucketName, objectName, minio.StatObjectOptions{})
+	if err != nil {
+		return minio.ObjectInfo{}, fmt.Errorf("failed to stat object %s: %w", objectName, err)
+	}
+
+	return info, nil
+}
+
 func (m *MinioClient) ObjectExists(objectName string) (bool, error) {
-	log.Debugf("Checking if object %s exists in MinIO", objectName)
+	m.logger.Debugf("Checking if object %s exists in MinIO", objectName)
 
 	ctx := context.Background()
 
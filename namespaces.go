@@ -0,0 +1,46 @@
+package main
+
+import (
+	"path"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// namespaceFilter applies the include and exclude globs from the
+// namespaces section of the config.
+type namespaceFilter struct {
+	include []string
+	exclude []string
+}
+
+// matches reports whether namespace passes the filter. With include globs
+// configured a namespace must match one of them; a match on any exclude
+// glob always removes it.
+func (f namespaceFilter) matches(namespace string) bool {
+	if len(f.include) > 0 && !matchAnyGlob(f.include, namespace) {
+		return false
+	}
+	return !matchAnyGlob(f.exclude, namespace)
+}
+
+func matchAnyGlob(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		matched, err := path.Match(pattern, name)
+		if err != nil {
+			log.Warnf("Ignoring invalid namespace glob %q: %v", pattern, err)
+			continue
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// backupKeyNamespaces returns the key namespaces the backups of a PVC in
+// namespace are looked up under. New backups are always stored under the
+// namespace; earlier releases stored flat <pvc>-<time> keys, which are still
+// looked up.
+func backupKeyNamespaces(namespace string) []string {
+	return []string{namespace, ""}
+}
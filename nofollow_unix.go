@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// oNoFollow makes opening a symlink fail instead of following it.
+const oNoFollow = syscall.O_NOFOLLOW
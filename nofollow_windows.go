@@ -0,0 +1,5 @@
+package main
+
+// oNoFollow is not supported on Windows, where extractTar removes existing
+// symlinks before creating files all the same.
+const oNoFollow = 0
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// PruneDecision records whether a backup object is kept or deleted by prune
+// and why.
+type PruneDecision struct {
+	Object    string
+	Namespace string
+	PVC       string
+	Time      time.Time
+	Metadata  BackupMetadata
+	Keep      bool
+	Reasons   []string
+}
+
+// Pruner applies retention policies to the backups in the bucket.
+type Pruner struct {
+	minioClient   *MinioClient
+	defaultPolicy RetentionPolicy
+	dryRun        bool
+	logger        *log.Entry
+}
+
+func NewPruner(minioClient *MinioClient, dryRun bool) (*Pruner, error) {
+	policy, err := defaultRetentionPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Pruner{
+		minioClient:   minioClient,
+		defaultPolicy: policy,
+		dryRun:        dryRun,
+		logger:        minioClient.logger,
+	}, nil
+}
+
+// defaultRetentionPolicy reads the policy applied to PVCs without a
+// retention annotation from the retention config section.
+func defaultRetentionPolicy() (RetentionPolicy, error) {
+	policy := RetentionPolicy{
+		KeepLast:    viper.GetInt("retention.keep_last"),
+		KeepDaily:   viper.GetInt("retention.keep_daily"),
+		KeepWeekly:  viper.GetInt("retention.keep_weekly"),
+		KeepMonthly: viper.GetInt("retention.keep_monthly"),
+		KeepYearly:  viper.GetInt("retention.keep_yearly"),
+	}
+	if policy.KeepLast < 0 || policy.KeepDaily < 0 || policy.KeepWeekly < 0 || policy.KeepMonthly < 0 || policy.KeepYearly < 0 {
+		return RetentionPolicy{}, fmt.Errorf("invalid retention config %+v: counts must not be negative", policy)
+	}
+	return policy, nil
+}
+
+// Run prunes the backups of every PVC with objects under prefix.
+func (p *Pruner) Run(prefix string) ([]PruneDecision, error) {
+	return p.prune([]string{prefix}, func(BackupObjectName) bool { return true })
+}
+
+// PrunePVC prunes the backups of a single PVC, including those older
+// versions stored without a namespace.
+func (p *Pruner) PrunePVC(namespace, pvcName string) ([]PruneDecision, error) {
+	keyNamespaces := backupKeyNamespaces(namespace)
+
+	var prefixes []string
+	for _, keyNamespace := range keyNamespaces {
+		prefixes = append(prefixes, backupObjectPrefix(keyNamespace, pvcName))
+	}
+	return p.prune(prefixes, func(name BackupObjectName) bool {
+		return name.PVCName == pvcName && (name.Namespace == keyNamespaces[0] || name.Namespace == keyNamespaces[1])
+	})
+}
+
+func (p *Pruner) prune(prefixes []string, match func(BackupObjectName) bool) ([]PruneDecision, error) {
+	// Objects that do not look like backups are never touched.
+	groups := make(map[string][]PruneDecision)
+	var keys []string
+	for _, prefix := range prefixes {
+		objects, err := p.minioClient.ListObjects(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list backups: %w", err)
+		}
+
+		for _, object := range objects {
+			name, ok := parseBackupObjectName(object)
+			if !ok || !match(name) {
+				continue
+			}
+
+			key := backupObjectPrefix(name.Namespace, name.PVCName)
+			if _, ok := groups[key]; !ok {
+				keys = append(keys, key)
+			}
+			groups[key] = append(groups[key], PruneDecision{
+				Object:    object,
+				Namespace: name.Namespace,
+				PVC:       name.PVCName,
+				Time:      name.Time,
+			})
+		}
+	}
+	sort.Strings(keys)
+
+	var decisions []PruneDecision
+	var failed int
+	failedPVCs := make(map[string]bool)
+	for _, key := range keys {
+		group, err := p.pruneGroup(groups[key])
+		if err != nil {
+			p.logger.Errorf("Failed to prune backups of %s: %v", strings.TrimSuffix(key, "-"), err)
+			failed++
+			failedPVCs[group[0].PVC] = true
+		}
+		decisions = append(decisions, group...)
+	}
+
+	// Chains started under keys without a namespace continue under the
+	// namespaced keys, so parents are kept across groups. A PVC whose
+	// decisions are incomplete might need any backup of that name.
+	keepChainParents(decisions, p.logger)
+	for i := range decisions {
+		if !decisions[i].Keep && failedPVCs[decisions[i].PVC] {
+			decisions[i].Keep = true
+			decisions[i].Reasons = []string{"other backups of the PVC could not be pruned"}
+		}
+	}
+
+	deleteFailed := p.deleteBackups(decisions)
+
+	if failed > 0 {
+		return decisions, fmt.Errorf("failed to prune backups of %d PVC(s)", failed)
+	}
+	if deleteFailed > 0 {
+		return decisions, fmt.Errorf("failed to delete %d backup(s)", deleteFailed)
+	}
+	return decisions, nil
+}
+
+// pruneGroup decides which backups of one PVC to keep. The decisions are
+// returned newest first. When no decision is possible all backups are kept
+// and an error is returned.
+func (p *Pruner) pruneGroup(backups []PruneDecision) ([]PruneDecision, error) {
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Time.After(backups[j].Time)
+	})
+
+	for i := range backups {
+		metadata, _, err := readBackupMetadata(p.minioClient, backups[i].Object)
+		if err != nil {
+			keepAll(backups, "metadata error")
+			return backups, fmt.Errorf("failed to read metadata of %s: %w", backups[i].Object, err)
+		}
+		backups[i].Metadata = metadata
+	}
+
+	// The newest backup carries the PVC's current retention annotation.
+	policy := p.defaultPolicy
+	if value := backups[0].Metadata.Retention; value != "" {
+		parsed, err := parseRetentionPolicy(value)
+		if err != nil {
+			keepAll(backups, "policy error")
+			return backups, fmt.Errorf("backup %s: %w", backups[0].Object, err)
+		}
+		policy = parsed
+	}
+
+	if policy.IsZero() {
+		p.logger.Debugf("No retention policy for %s/%s, keeping all %d backups", backups[0].Namespace, backups[0].PVC, len(backups))
+		keepAll(backups, "no retention policy")
+		return backups, nil
+	}
+
+	applyRetentionPolicy(backups, policy)
+	return backups, nil
+}
+
+func keepAll(backups []PruneDecision, reason string) {
+	for i := range backups {
+		backups[i].Keep = true
+		backups[i].Reasons = []string{reason}
+	}
+}
+
+// deleteBackups deletes the backups not kept unless running dry. It returns
+// the number of failed deletions.
+func (p *Pruner) deleteBackups(decisions []PruneDecision) int {
+	// Delete newest first, so an interrupted prune never leaves an
+	// incremental backup whose parent is already gone behind.
+	order := newestFirst(decisions)
+
+	var deleteFailed int
+	for _, i := range order {
+		backup := decisions[i]
+		if backup.Keep {
+			continue
+		}
+		if p.dryRun {
+			p.logger.Infof("Would delete %s", backup.Object)
+			continue
+		}
+		if err := p.minioClient.DeleteObject(backup.Object); err != nil {
+			p.logger.Errorf("Failed to delete %s: %v", backup.Object, err)
+			deleteFailed++
+			continue
+		}
+		if err := p.minioClient.DeleteObject(signatureObjectName(backup.Object)); err != nil {
+			p.logger.Warnf("Failed to delete signature of %s: %v", backup.Object, err)
+		}
+		if err := p.minioClient.DeleteObject(resourcesObjectName(backup.Object)); err != nil {
+			p.logger.Warnf("Failed to delete Kubernetes objects of %s: %v", backup.Object, err)
+		}
+		// Removing a missing key succeeds, so this also covers backups
+		// written before manifests existed.
+		if err := p.minioClient.DeleteObject(manifestObjectName(backup.Object)); err != nil {
+			p.logger.Warnf("Failed to delete manifest of %s: %v", backup.Object, err)
+		}
+		if err := p.minioClient.DeleteObject(signatureObjectName(manifestObjectName(backup.Object))); err != nil {
+			p.logger.Warnf("Failed to delete manifest signature of %s: %v", backup.Object, err)
+		}
+	}
+	return deleteFailed
+}
+
+// newestFirst returns the indexes of backups ordered newest first.
+func newestFirst(backups []PruneDecision) []int {
+	order := make([]int, len(backups))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return backups[order[a]].Time.After(backups[order[b]].Time)
+	})
+	return order
+}
+
+// applyRetentionPolicy marks the backups kept by the grandfather-father-son
+// rules of policy. backups must be sorted newest first. Each periodic rule
+// keeps the newest backup of that many distinct periods.
+func applyRetentionPolicy(backups []PruneDecision, policy RetentionPolicy) {
+	for i := range backups {
+		if i < policy.KeepLast {
+			backups[i].Keep = true
+			backups[i].Reasons = append(backups[i].Reasons, "keep-last")
+		}
+	}
+
+	rules := []struct {
+		name   string
+		count  int
+		period func(time.Time) string
+	}{
+		{"keep-daily", policy.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"keep-weekly", policy.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"keep-monthly", policy.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{"keep-yearly", policy.KeepYearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+
+	for _, rule := range rules {
+		seen := make(map[string]bool)
+		for i := range backups {
+			if len(seen) >= rule.count {
+				break
+			}
+			period := rule.period(backups[i].Time.UTC())
+			if seen[period] {
+				continue
+			}
+			seen[period] = true
+			backups[i].Keep = true
+			backups[i].Reasons = append(backups[i].Reasons, rule.name)
+		}
+	}
+
+	for i := range backups {
+		if !backups[i].Keep {
+			backups[i].Reasons = []string{"expired"}
+		}
+	}
+}
+
+// keepChainParents keeps every backup a kept incremental backup depends on,
+// so a chain is never broken by deleting a parent that is still needed.
+func keepChainParents(backups []PruneDecision, logger *log.Entry) {
+	index := make(map[string]int, len(backups))
+	for i, backup := range backups {
+		index[backup.Object] = i
+	}
+
+	// Children are newer than their parents, so walking newest first
+	// reaches every child before its parent.
+	for _, i := range newestFirst(backups) {
+		if !backups[i].Keep || !backups[i].Metadata.IsIncremental() {
+			continue
+		}
+
+		parent := backups[i].Metadata.Parent
+		j, ok := index[parent]
+		if !ok {
+			logger.Warnf("Parent %s of kept backup %s is missing, its chain is already broken", parent, backups[i].Object)
+			continue
+		}
+
+		reason := "parent of " + backups[i].Object
+		if !backups[j].Keep {
+			backups[j].Keep = true
+			backups[j].Reasons = []string{reason}
+		} else {
+			backups[j].Reasons = append(backups[j].Reasons, reason)
+		}
+	}
+}
+
+// pruneBackups applies retention to the backups of image after a successful
+// backup. Failures are logged but do not fail the backup.
+func (bs *BackupService) pruneBackups(image CephImage) {
+	pruner := *bs.pruner
+	pruner.minioClient = bs.minioClient
+	pruner.logger = bs.logger
+
+	decisions, err := pruner.PrunePVC(image.Namespace, image.PVCName)
+	if err != nil {
+		bs.logger.Warnf("Failed to prune backups of PVC %s: %v", image.PVCName, err)
+	}
+
+	var deleted int
+	for _, decision := range decisions {
+		if !decision.Keep {
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		bs.logger.Infof("Pruned %d of %d backup(s) of PVC %s", deleted, len(decisions), image.PVCName)
+	}
+}
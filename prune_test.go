@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestKeepChainParentsAcrossKeyNamespaces(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 10, d, 2, 0, 0, 0, time.UTC) }
+
+	// A chain started under a key without a namespace and continued under
+	// the namespaced key, in the order prune collects the groups in.
+	decisions := []PruneDecision{
+		{
+			Object:   "data-2026-10-02T02-00-00Z.rbd-diff.gz.gpg",
+			Time:     day(2),
+			Metadata: BackupMetadata{Type: backupTypeIncremental, Parent: "data-2026-10-01T02-00-00Z.rbd.gz.gpg"},
+		},
+		{
+			Object:   "data-2026-10-01T02-00-00Z.rbd.gz.gpg",
+			Time:     day(1),
+			Metadata: BackupMetadata{Type: backupTypeFull},
+		},
+		{
+			Object:   "data-2026-09-30T02-00-00Z.rbd.gz.gpg",
+			Time:     day(1).Add(-24 * time.Hour),
+			Metadata: BackupMetadata{Type: backupTypeFull},
+		},
+		{
+			Object:   "production/data-2026-10-03T02-00-00Z.rbd-diff.gz.gpg",
+			Time:     day(3),
+			Keep:     true,
+			Metadata: BackupMetadata{Type: backupTypeIncremental, Parent: "data-2026-10-02T02-00-00Z.rbd-diff.gz.gpg"},
+		},
+	}
+
+	keepChainParents(decisions, log.NewEntry(log.StandardLogger()))
+
+	for i, keep := range []bool{true, true, false, true} {
+		if decisions[i].Keep != keep {
+			t.Errorf("%s: keep %v, expected %v (%v)", decisions[i].Object, decisions[i].Keep, keep, decisions[i].Reasons)
+		}
+	}
+}
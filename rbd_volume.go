@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// cephConnection is the cluster and credentials an in-tree RBD volume names
+// itself. CSI volumes leave it empty and use the configured cluster.
+type cephConnection struct {
+	Monitors []string
+	User     string
+	Secret   *corev1.SecretReference
+}
+
+// rbdVolume is the RBD image backing a PV.
+type rbdVolume struct {
+	ClusterID      string
+	Pool           string
+	RadosNamespace string
+	Image          string
+
+	// InTree is set for volumes of the in-tree rbd plugin, which carry
+	// their own Connection.
+	InTree     bool
+	Connection cephConnection
+}
+
+// poolSpec returns the pool as rbd expects it, <pool>/<namespace> for
+// images in a RADOS namespace.
+func poolSpec(pool, radosNamespace string) string {
+	if radosNamespace == "" {
+		return pool
+	}
+	return pool + "/" + radosNamespace
+}
+
+// rbdVolumeOfPV resolves the RBD image behind an in-tree or ceph-csi PV.
+// poolName maps pool IDs of volume handles to names; without it PVs that
+// only name their pool by ID cannot be resolved.
+func rbdVolumeOfPV(pv *corev1.PersistentVolume, poolName func(int64) (string, error)) (*rbdVolume, error) {
+	switch {
+	case pv.Spec.RBD != nil:
+		return inTreeRBDVolume(pv)
+	case pv.Spec.CSI != nil:
+		return csiRBDVolume(pv, poolName)
+	}
+	return nil, fmt.Errorf("PV %s is neither an RBD nor a CSI volume", pv.Name)
+}
+
+// inTreeRBDVolume resolves a PV of the in-tree rbd plugin, applying the
+// plugin's defaults for pool and user. The secret is looked up in the
+// namespace of the claim unless the PV names one.
+func inTreeRBDVolume(pv *corev1.PersistentVolume) (*rbdVolume, error) {
+	source := pv.Spec.RBD
+	if source.RBDImage == "" {
+		return nil, fmt.Errorf("no RBD image in PV %s", pv.Name)
+	}
+	if len(source.CephMonitors) == 0 {
+		return nil, fmt.Errorf("no Ceph monitors in PV %s", pv.Name)
+	}
+
+	volume := &rbdVolume{
+		Pool:   source.RBDPool,
+		Image:  source.RBDImage,
+		InTree: true,
+		Connection: cephConnection{
+			Monitors: source.CephMonitors,
+			User:     source.RadosUser,
+		},
+	}
+	if volume.Pool == "" {
+		volume.Pool = "rbd"
+	}
+	if volume.Connection.User == "" {
+		volume.Connection.User = "admin"
+	}
+
+	if source.SecretRef != nil && source.SecretRef.Name != "" {
+		secret := *source.SecretRef
+		if secret.Namespace == "" && pv.Spec.ClaimRef != nil {
+			secret.Namespace = pv.Spec.ClaimRef.Namespace
+		}
+		volume.Connection.Secret = &secret
+	}
+
+	return volume, nil
+}
+
+// csiRBDVolume resolves a ceph-csi PV. Dynamically provisioned volumes name
+// pool and image in their attributes. Static volumes use the image name as
+// volume handle, and volumes whose attributes lack the image are found by
+// decoding the handle: the image is csi-vol-<uuid> in the pool with the
+// handle's ID.
+func csiRBDVolume(pv *corev1.PersistentVolume, poolName func(int64) (string, error)) (*rbdVolume, error) {
+	csi := pv.Spec.CSI
+	attributes := csi.VolumeAttributes
+
+	volume := &rbdVolume{
+		ClusterID:      attributes["clusterID"],
+		Pool:           attributes["pool"],
+		RadosNamespace: attributes["radosNamespace"],
+		Image:          attributes["imageName"],
+	}
+
+	if volume.Image == "" && attributes["staticVolume"] == "true" {
+		volume.Image = csi.VolumeHandle
+	}
+
+	if volume.Image == "" || volume.Pool == "" {
+		handle, err := parseCephCSIHandle(csi.VolumeHandle)
+		if err != nil {
+			return nil, fmt.Errorf("imageName not found in volume attributes for PV %s and volume handle cannot be decoded: %w", pv.Name, err)
+		}
+
+		if volume.ClusterID == "" {
+			volume.ClusterID = handle.ClusterID
+		}
+		if volume.Image == "" {
+			prefix := attributes["volumeNamePrefix"]
+			if prefix == "" {
+				prefix = "csi-vol-"
+			}
+			volume.Image = prefix + handle.UUID
+		}
+		if volume.Pool == "" {
+			if poolName == nil {
+				return nil, fmt.Errorf("pool not found in volume attributes for PV %s", pv.Name)
+			}
+			if volume.Pool, err = poolName(handle.PoolID); err != nil {
+				return nil, fmt.Errorf("failed to resolve pool of PV %s: %w", pv.Name, err)
+			}
+		}
+	}
+
+	return volume, nil
+}
+
+// rbdImageOfPV returns the pool, including its RADOS namespace, and the RBD
+// image backing a PV.
+func rbdImageOfPV(pv *corev1.PersistentVolume) (string, string, error) {
+	volume, err := rbdVolumeOfPV(pv, nil)
+	if err != nil {
+		return "", "", err
+	}
+	return poolSpec(volume.Pool, volume.RadosNamespace), volume.Image, nil
+}
+
+// connect points the worker's Ceph client at the cluster an in-tree volume
+// names. The key from the volume's secret is written to a file in
+// backup.temp_dir for the duration of the backup; the returned function
+// removes it.
+func (bs *BackupService) connect(image CephImage) (func(), error) {
+	conn := image.Connection
+	if conn.Secret == nil {
+		bs.cephClient = bs.cephClient.WithConnection(conn, "")
+		return func() {}, nil
+	}
+
+	secret, err := bs.k8sClient.CoreV1().Secrets(conn.Secret.Namespace).Get(context.TODO(), conn.Secret.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Ceph secret %s/%s: %w", conn.Secret.Namespace, conn.Secret.Name, err)
+	}
+	key, ok := secret.Data["key"]
+	if !ok {
+		return nil, fmt.Errorf("Ceph secret %s/%s has no key", conn.Secret.Namespace, conn.Secret.Name)
+	}
+
+	dir := viper.GetString("backup.temp_dir")
+	if dir == "" {
+		dir = "/tmp/k8s-ceph-backup"
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+
+	// CreateTemp creates the file readable by its owner only.
+	file, err := os.CreateTemp(dir, "keyfile-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key file: %w", err)
+	}
+	_, err = file.WriteString(strings.TrimSpace(string(key)))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, fmt.Errorf("failed to write key file: %w", err)
+	}
+
+	bs.cephClient = bs.cephClient.WithConnection(conn, file.Name())
+	return func() {
+		if err := os.Remove(file.Name()); err != nil {
+			bs.logger.Warnf("Failed to remove key file %s: %v", file.Name(), err)
+		}
+	}, nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+const resourcesSuffix = ".resources.yaml"
+
+// Annotations that only describe the state of objects in the cluster they
+// were read from and would get in the way of re-applying them.
+var droppedAnnotations = []string{
+	"kubectl.kubernetes.io/last-applied-configuration",
+	"pv.kubernetes.io/bind-completed",
+	"pv.kubernetes.io/bound-by-controller",
+	"volume.kubernetes.io/selected-node",
+}
+
+// KubeResources are the Kubernetes objects a backed up volume was used
+// through, stored next to the backup so a lost cluster can be rebuilt.
+type KubeResources struct {
+	PVC          *corev1.PersistentVolumeClaim
+	PV           *corev1.PersistentVolume
+	StorageClass *storagev1.StorageClass
+}
+
+// resourcesObjectName returns the key of the Kubernetes objects belonging to
+// a backup.
+func resourcesObjectName(objectName string) string {
+	return objectName + resourcesSuffix
+}
+
+// isResourcesObject reports whether objectName holds the Kubernetes objects
+// of a backup rather than backup data.
+func isResourcesObject(objectName string) bool {
+	return strings.HasSuffix(objectName, resourcesSuffix)
+}
+
+// captureResources returns sanitized copies of the PVC and PV of image and,
+// if it can be read, their StorageClass.
+func (bs *BackupService) captureResources(image CephImage) *KubeResources {
+	if image.pvc == nil || image.pv == nil {
+		return nil
+	}
+
+	resources := &KubeResources{
+		PVC: sanitizePVC(image.pvc.DeepCopy()),
+		PV:  sanitizePV(image.pv.DeepCopy()),
+	}
+
+	if className := image.pv.Spec.StorageClassName; className != "" {
+		class, err := bs.storageClasses.Get(className)
+		if err != nil {
+			bs.logger.Warnf("Failed to get StorageClass %s of PVC %s, not backing it up: %v", className, image.PVCName, err)
+		} else {
+			resources.StorageClass = sanitizeStorageClass(class.DeepCopy())
+		}
+	}
+
+	return resources
+}
+
+// storageClassCache reads every StorageClass at most once per run, however
+// many PVCs use it. Failures are cached as well.
+type storageClassCache struct {
+	k8sClient kubernetes.Interface
+
+	mu      sync.Mutex
+	classes map[string]*storagev1.StorageClass
+	errors  map[string]error
+}
+
+func newStorageClassCache(k8sClient kubernetes.Interface) *storageClassCache {
+	return &storageClassCache{
+		k8sClient: k8sClient,
+		classes:   make(map[string]*storagev1.StorageClass),
+		errors:    make(map[string]error),
+	}
+}
+
+// Get returns the named StorageClass. Callers must not modify it.
+func (c *storageClassCache) Get(name string) (*storagev1.StorageClass, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if class, ok := c.classes[name]; ok {
+		return class, nil
+	}
+	if err, ok := c.errors[name]; ok {
+		return nil, err
+	}
+
+	class, err := c.k8sClient.StorageV1().StorageClasses().Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		c.errors[name] = err
+		return nil, err
+	}
+	c.classes[name] = class
+	return class, nil
+}
+
+// sanitizeObjectMeta removes the fields the API server assigns.
+func sanitizeObjectMeta(meta *metav1.ObjectMeta) {
+	meta.UID = ""
+	meta.ResourceVersion = ""
+	meta.Generation = 0
+	meta.CreationTimestamp = metav1.Time{}
+	meta.DeletionTimestamp = nil
+	meta.DeletionGracePeriodSeconds = nil
+	meta.ManagedFields = nil
+	meta.OwnerReferences = nil
+	meta.Finalizers = nil
+
+	for _, key := range droppedAnnotations {
+		delete(meta.Annotations, key)
+	}
+	if len(meta.Annotations) == 0 {
+		meta.Annotations = nil
+	}
+}
+
+func sanitizePVC(pvc *corev1.PersistentVolumeClaim) *corev1.PersistentVolumeClaim {
+	pvc.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolumeClaim"}
+	sanitizeObjectMeta(&pvc.ObjectMeta)
+	pvc.Status = corev1.PersistentVolumeClaimStatus{}
+	return pvc
+}
+
+func sanitizePV(pv *corev1.PersistentVolume) *corev1.PersistentVolume {
+	pv.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolume"}
+	sanitizeObjectMeta(&pv.ObjectMeta)
+	pv.Spec.ClaimRef = nil
+	pv.Status = corev1.PersistentVolumeStatus{}
+	return pv
+}
+
+func sanitizeStorageClass(class *storagev1.StorageClass) *storagev1.StorageClass {
+	class.TypeMeta = metav1.TypeMeta{APIVersion: "storage.k8s.io/v1", Kind: "StorageClass"}
+	sanitizeObjectMeta(&class.ObjectMeta)
+	return class
+}
+
+// Marshal encodes the objects as a multi-document YAML stream in the order
+// they have to be applied in.
+func (r *KubeResources) Marshal() ([]byte, error) {
+	var objects []interface{}
+	if r.StorageClass != nil {
+		objects = append(objects, r.StorageClass)
+	}
+	if r.PV != nil {
+		objects = append(objects, r.PV)
+	}
+	if r.PVC != nil {
+		objects = append(objects, r.PVC)
+	}
+
+	var buf bytes.Buffer
+	for i, object := range objects {
+		data, err := yaml.Marshal(object)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode Kubernetes objects: %w", err)
+		}
+		if i > 0 {
+			buf.WriteString("---\n")
+		}
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
+
+// parseKubeResources decodes what Marshal wrote.
+func parseKubeResources(data []byte) (*KubeResources, error) {
+	resources := &KubeResources{}
+
+	for _, document := range strings.Split(string(data), "\n---\n") {
+		if strings.TrimSpace(document) == "" {
+			continue
+		}
+
+		var typeMeta metav1.TypeMeta
+		if err := yaml.Unmarshal([]byte(document), &typeMeta); err != nil {
+			return nil, fmt.Errorf("failed to decode Kubernetes object: %w", err)
+		}
+
+		var err error
+		switch typeMeta.Kind {
+		case "PersistentVolumeClaim":
+			resources.PVC = &corev1.PersistentVolumeClaim{}
+			err = yaml.Unmarshal([]byte(document), resources.PVC)
+		case "PersistentVolume":
+			resources.PV = &corev1.PersistentVolume{}
+			err = yaml.Unmarshal([]byte(document), resources.PV)
+		case "StorageClass":
+			resources.StorageClass = &storagev1.StorageClass{}
+			err = yaml.Unmarshal([]byte(document), resources.StorageClass)
+		default:
+			return nil, fmt.Errorf("unexpected Kubernetes object of kind %q", typeMeta.Kind)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", typeMeta.Kind, err)
+		}
+	}
+
+	return resources, nil
+}
+
+// writeResources uploads the Kubernetes objects of image next to the backup
+// and records their key in the manifest. They are only captured here, so
+// PVCs that are not due are not looked at.
+func (bs *BackupService) writeResources(image CephImage, manifest *BackupManifest) error {
+	resources := bs.captureResources(image)
+	if resources == nil {
+		return nil
+	}
+
+	data, err := resources.Marshal()
+	if err != nil {
+		return err
+	}
+
+	objectName := resourcesObjectName(manifest.Object)
+	if err := bs.minioClient.UploadBytes(objectName, data, "application/yaml"); err != nil {
+		return fmt.Errorf("failed to upload Kubernetes objects: %w", err)
+	}
+	manifest.Resources = objectName
+	manifest.ResourcesSHA256 = sha256Hex(data)
+	return nil
+}
+
+// loadKubeResources reads the Kubernetes objects stored with a backup.
+func loadKubeResources(minioClient *MinioClient, manifest *BackupManifest) (*KubeResources, error) {
+	if manifest == nil || manifest.Resources == "" {
+		return nil, fmt.Errorf("backup has no Kubernetes objects stored with it")
+	}
+
+	data, err := minioClient.DownloadBytes(manifest.Resources)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyChecksum("Kubernetes objects", manifest.ResourcesSHA256, sha256Hex(data)); err != nil {
+		return nil, err
+	}
+	return parseKubeResources(data)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCaptureResourcesReadsStorageClassOnce(t *testing.T) {
+	client := fake.NewSimpleClientset(&storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: "ceph-rbd", UID: "class-uid"},
+		Provisioner: "rbd.csi.ceph.com",
+	})
+	bs := &BackupService{
+		k8sClient:      client,
+		storageClasses: newStorageClassCache(client),
+		logger:         log.NewEntry(log.StandardLogger()),
+	}
+
+	newImage := func(name, className string) CephImage {
+		return CephImage{
+			Namespace: "production",
+			PVCName:   name,
+			pvc: &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "production", UID: "pvc-uid"},
+			},
+			pv: &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "pv-" + name},
+				Spec:       corev1.PersistentVolumeSpec{StorageClassName: className},
+			},
+		}
+	}
+
+	for _, name := range []string{"data", "logs", "cache"} {
+		resources := bs.captureResources(newImage(name, "ceph-rbd"))
+		if resources.StorageClass == nil || resources.StorageClass.Name != "ceph-rbd" {
+			t.Fatalf("%s: StorageClass not captured: %+v", name, resources.StorageClass)
+		}
+		if resources.StorageClass.UID != "" || resources.PVC.UID != "" {
+			t.Fatalf("%s: objects not sanitized", name)
+		}
+	}
+	for _, name := range []string{"a", "b"} {
+		if resources := bs.captureResources(newImage(name, "missing")); resources.StorageClass != nil {
+			t.Fatalf("%s: captured a missing StorageClass", name)
+		}
+	}
+
+	var gets int
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "get" && action.GetResource().Resource == "storageclasses" {
+			gets++
+		}
+	}
+	if gets != 2 {
+		t.Fatalf("read StorageClasses %d times, expected 2", gets)
+	}
+
+	// The cached object is shared and must not be sanitized in place.
+	class, err := bs.storageClasses.Get("ceph-rbd")
+	if err != nil || class.UID != "class-uid" {
+		t.Fatalf("cached StorageClass modified: %+v, %v", class, err)
+	}
+}
+
+func TestCaptureResourcesWithoutObjects(t *testing.T) {
+	bs := &BackupService{logger: log.NewEntry(log.StandardLogger())}
+	if resources := bs.captureResources(CephImage{PVCName: "data"}); resources != nil {
+		t.Fatalf("captured %+v", resources)
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	workloadDeployment  = "Deployment"
+	workloadStatefulSet = "StatefulSet"
+
+	eventComponent = "k8s-ceph-backup"
+)
+
+// workload is a Deployment or StatefulSet mounting the PVC being restored.
+type workload struct {
+	kind      string
+	name      string
+	replicas  int32
+	annotated bool
+}
+
+func (w workload) String() string {
+	return strings.ToLower(w.kind) + "/" + w.name
+}
+
+// RestoreInPlace restores chain over the image of an existing PVC. The
+// Deployments and StatefulSets mounting it are scaled to zero until the
+// volume is detached, the current image is renamed aside as a rollback
+// point, the backup is imported under the original name and the workloads
+// are scaled back up. Every step is recorded as an Event on the PVC.
+func (rs *RestoreService) RestoreInPlace(chain []BackupChainLink, namespace, name string) (err error) {
+	if rs.k8sClient == nil {
+		k8sClient, err := createK8sClient()
+		if err != nil {
+			return fmt.Errorf("failed to create Kubernetes client: %w", err)
+		}
+		rs.k8sClient = k8sClient
+	}
+
+	ctx := context.Background()
+
+	pvc, err := rs.k8sClient.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get PVC %s/%s: %w", namespace, name, err)
+	}
+	if pvc.Spec.VolumeName == "" {
+		return fmt.Errorf("PVC %s/%s is not bound", namespace, name)
+	}
+
+	pv, err := rs.k8sClient.CoreV1().PersistentVolumes().Get(ctx, pvc.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get PV %s: %w", pvc.Spec.VolumeName, err)
+	}
+
+	if isCephFSBackup(chain) || isCephFSPV(pv) {
+		return fmt.Errorf("in-place restores are only supported for RBD volumes, restore CephFS backups with --to-pvc")
+	}
+
+	pool, imageName, err := rbdImageOfPV(pv)
+	if err != nil {
+		return err
+	}
+
+	backup := chain[len(chain)-1].ObjectName
+	rs.recordEvent(pvc, corev1.EventTypeNormal, "RestoreStarted", "Restoring %s in place into %s/%s", backup, pool, imageName)
+	defer func() {
+		if err != nil {
+			rs.recordEvent(pvc, corev1.EventTypeWarning, "RestoreFailed", "In-place restore of %s failed: %v", backup, err)
+		}
+	}()
+
+	workloads, err := rs.findWorkloads(ctx, namespace, name)
+	if err != nil {
+		return err
+	}
+
+	// Workloads are scaled back up however the restore ends; after a
+	// failure they come back on the original image.
+	defer func() {
+		if scaleErr := rs.scaleUp(ctx, pvc, workloads); scaleErr != nil && err == nil {
+			err = scaleErr
+		}
+	}()
+	if err := rs.scaleDown(ctx, pvc, workloads); err != nil {
+		return err
+	}
+
+	if err := rs.waitForDetach(ctx, pvc, pv.Name); err != nil {
+		return err
+	}
+
+	aside := fmt.Sprintf("%s-pre-restore-%s", imageName, time.Now().UTC().Format("20060102T150405Z"))
+	if err := rs.cephClient.RenameImage(pool, imageName, aside); err != nil {
+		return err
+	}
+	rs.recordEvent(pvc, corev1.EventTypeNormal, "ImageRenamed", "Renamed current image %s/%s to %s as rollback point", pool, imageName, aside)
+
+	if err := rs.Restore(chain, pool, imageName, rs.importFeatures(chain, pool, aside)); err != nil {
+		rs.rollback(pvc, pool, imageName, aside)
+		return err
+	}
+	rs.recordEvent(pvc, corev1.EventTypeNormal, "BackupImported", "Imported %s into %s/%s", backup, pool, imageName)
+
+	rs.recordEvent(pvc, corev1.EventTypeNormal, "RestoreCompleted",
+		"Restored %s in place; previous data kept as %s/%s until removed with rbd rm", backup, pool, aside)
+	return nil
+}
+
+// rollback puts the renamed original image back after a failed import.
+func (rs *RestoreService) rollback(pvc *corev1.PersistentVolumeClaim, pool, imageName, aside string) {
+	exists, err := rs.cephClient.ImageExists(pool, imageName)
+	if err != nil {
+		log.Errorf("Failed to check for partially restored image %s/%s: %v", pool, imageName, err)
+		return
+	}
+	if exists {
+		// The partial import may carry replay snapshots, which rbd rm
+		// refuses, so it is moved aside as well.
+		failed := fmt.Sprintf("%s-failed-restore-%s", imageName, time.Now().UTC().Format("20060102T150405Z"))
+		if err := rs.cephClient.RenameImage(pool, imageName, failed); err != nil {
+			log.Errorf("Failed to move partially restored image aside, rename %s/%s back by hand: %v", pool, aside, err)
+			return
+		}
+	}
+
+	if err := rs.cephClient.RenameImage(pool, aside, imageName); err != nil {
+		log.Errorf("Failed to roll back, rename %s/%s back to %s by hand: %v", pool, aside, imageName, err)
+		return
+	}
+	rs.recordEvent(pvc, corev1.EventTypeWarning, "RestoreRolledBack", "Renamed %s/%s back to %s", pool, aside, imageName)
+}
+
+// findWorkloads returns the Deployments and StatefulSets whose pods mount
+// the PVC. Pods of any other kind cannot be quiesced and abort the restore.
+func (rs *RestoreService) findWorkloads(ctx context.Context, namespace, pvcName string) ([]workload, error) {
+	pods, err := podsUsingPVC(ctx, rs.k8sClient, namespace, pvcName)
+	if err != nil {
+		return nil, err
+	}
+
+	var workloads []workload
+	seen := make(map[string]bool)
+	var unsupported []string
+	for _, pod := range pods {
+		owner := metav1.GetControllerOf(&pod)
+
+		var found workload
+		switch {
+		case owner == nil:
+			unsupported = append(unsupported, "pod/"+pod.Name)
+			continue
+		case owner.Kind == workloadStatefulSet:
+			found = workload{kind: workloadStatefulSet, name: owner.Name}
+		case owner.Kind == "ReplicaSet":
+			replicaSet, err := rs.k8sClient.AppsV1().ReplicaSets(namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get ReplicaSet %s/%s: %w", namespace, owner.Name, err)
+			}
+			deployment := metav1.GetControllerOf(replicaSet)
+			if deployment == nil || deployment.Kind != workloadDeployment {
+				unsupported = append(unsupported, "replicaset/"+owner.Name)
+				continue
+			}
+			found = workload{kind: workloadDeployment, name: deployment.Name}
+		default:
+			unsupported = append(unsupported, strings.ToLower(owner.Kind)+"/"+owner.Name)
+			continue
+		}
+
+		if !seen[found.String()] {
+			seen[found.String()] = true
+			workloads = append(workloads, found)
+		}
+	}
+
+	if len(unsupported) > 0 {
+		return nil, fmt.Errorf("PVC %s/%s is used by %s, which cannot be scaled down; stop them and retry",
+			namespace, pvcName, strings.Join(unsupported, ", "))
+	}
+
+	return workloads, nil
+}
+
+// scaleDown records the replicas of each workload in an annotation and
+// scales it to zero.
+func (rs *RestoreService) scaleDown(ctx context.Context, pvc *corev1.PersistentVolumeClaim, workloads []workload) error {
+	for i := range workloads {
+		scale, err := rs.getScale(ctx, pvc.Namespace, workloads[i])
+		if err != nil {
+			return err
+		}
+		workloads[i].replicas = scale.Spec.Replicas
+
+		if err := rs.annotateReplicas(ctx, pvc.Namespace, workloads[i], strconv.Itoa(int(scale.Spec.Replicas))); err != nil {
+			return err
+		}
+		workloads[i].annotated = true
+
+		scale.Spec.Replicas = 0
+		if err := rs.updateScale(ctx, pvc.Namespace, workloads[i], scale); err != nil {
+			return err
+		}
+		rs.recordEvent(pvc, corev1.EventTypeNormal, "WorkloadScaledDown", "Scaled %s from %d to 0 replicas", workloads[i], workloads[i].replicas)
+	}
+	return nil
+}
+
+// scaleUp restores the replicas recorded by scaleDown. Workloads that were
+// never scaled down have no recorded replicas and are left alone; those that
+// already had zero replicas only lose the annotation.
+func (rs *RestoreService) scaleUp(ctx context.Context, pvc *corev1.PersistentVolumeClaim, workloads []workload) error {
+	var failed []string
+	for _, w := range workloads {
+		if !w.annotated {
+			continue
+		}
+		if w.replicas == 0 {
+			if err := rs.annotateReplicas(ctx, pvc.Namespace, w, ""); err != nil {
+				log.Warnf("Failed to remove %s annotation from %s: %v", annotationRestoreReplicas, w, err)
+			}
+			continue
+		}
+
+		scale, err := rs.getScale(ctx, pvc.Namespace, w)
+		if err == nil {
+			scale.Spec.Replicas = w.replicas
+			err = rs.updateScale(ctx, pvc.Namespace, w, scale)
+		}
+		if err != nil {
+			log.Errorf("Failed to scale %s back to %d replicas: %v", w, w.replicas, err)
+			failed = append(failed, w.String())
+			continue
+		}
+
+		if err := rs.annotateReplicas(ctx, pvc.Namespace, w, ""); err != nil {
+			log.Warnf("Failed to remove %s annotation from %s: %v", annotationRestoreReplicas, w, err)
+		}
+		rs.recordEvent(pvc, corev1.EventTypeNormal, "WorkloadScaledUp", "Scaled %s back to %d replicas", w, w.replicas)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to scale up %s, see their %s annotation", strings.Join(failed, ", "), annotationRestoreReplicas)
+	}
+	return nil
+}
+
+func (rs *RestoreService) getScale(ctx context.Context, namespace string, w workload) (*autoscalingv1.Scale, error) {
+	var scale *autoscalingv1.Scale
+	var err error
+	if w.kind == workloadDeployment {
+		scale, err = rs.k8sClient.AppsV1().Deployments(namespace).GetScale(ctx, w.name, metav1.GetOptions{})
+	} else {
+		scale, err = rs.k8sClient.AppsV1().StatefulSets(namespace).GetScale(ctx, w.name, metav1.GetOptions{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get scale of %s: %w", w, err)
+	}
+	return scale, nil
+}
+
+func (rs *RestoreService) updateScale(ctx context.Context, namespace string, w workload, scale *autoscalingv1.Scale) error {
+	var err error
+	if w.kind == workloadDeployment {
+		_, err = rs.k8sClient.AppsV1().Deployments(namespace).UpdateScale(ctx, w.name, scale, metav1.UpdateOptions{})
+	} else {
+		_, err = rs.k8sClient.AppsV1().StatefulSets(namespace).UpdateScale(ctx, w.name, scale, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to scale %s: %w", w, err)
+	}
+	return nil
+}
+
+// annotateReplicas sets the restore-replicas annotation of the workload, or
+// removes it if value is empty.
+func (rs *RestoreService) annotateReplicas(ctx context.Context, namespace string, w workload, value string) error {
+	var annotation interface{}
+	if value != "" {
+		annotation = value
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{annotationRestoreReplicas: annotation},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if w.kind == workloadDeployment {
+		_, err = rs.k8sClient.AppsV1().Deployments(namespace).Patch(ctx, w.name, types.MergePatchType, patch, metav1.PatchOptions{})
+	} else {
+		_, err = rs.k8sClient.AppsV1().StatefulSets(namespace).Patch(ctx, w.name, types.MergePatchType, patch, metav1.PatchOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to annotate %s: %w", w, err)
+	}
+	return nil
+}
+
+// waitForDetach waits until no pod mounts the PVC and no VolumeAttachment
+// references its PV, so nothing writes to the image while it is replaced.
+func (rs *RestoreService) waitForDetach(ctx context.Context, pvc *corev1.PersistentVolumeClaim, pvName string) error {
+	timeout := rs.quiesceTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Minute
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		pods, err := podsUsingPVC(ctx, rs.k8sClient, pvc.Namespace, pvc.Name)
+		if err != nil {
+			return err
+		}
+
+		attachments, err := rs.k8sClient.StorageV1().VolumeAttachments().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to list VolumeAttachments: %w", err)
+		}
+		var attachedTo []string
+		for _, attachment := range attachments.Items {
+			if source := attachment.Spec.Source.PersistentVolumeName; source != nil && *source == pvName {
+				attachedTo = append(attachedTo, attachment.Spec.NodeName)
+			}
+		}
+
+		if len(pods) == 0 && len(attachedTo) == 0 {
+			rs.recordEvent(pvc, corev1.EventTypeNormal, "VolumeDetached", "PV %s is no longer attached to any node", pvName)
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("PV %s still in use after %s (%d pod(s), attached to %v)", pvName, timeout, len(pods), attachedTo)
+		}
+
+		log.Debugf("Waiting for PV %s to be detached (%d pod(s), attached to %v)", pvName, len(pods), attachedTo)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// recordEvent logs message and records it as an Event on the PVC. Failing
+// to create the Event does not fail the restore.
+func (rs *RestoreService) recordEvent(pvc *corev1.PersistentVolumeClaim, eventType, reason, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if eventType == corev1.EventTypeWarning {
+		log.Warnf("%s: %s", reason, message)
+	} else {
+		log.Infof("%s: %s", reason, message)
+	}
+
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: pvc.Name + ".",
+			Namespace:    pvc.Namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion:      "v1",
+			Kind:            "PersistentVolumeClaim",
+			Namespace:       pvc.Namespace,
+			Name:            pvc.Name,
+			UID:             pvc.UID,
+			ResourceVersion: pvc.ResourceVersion,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         corev1.EventSource{Component: eventComponent},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	if _, err := rs.k8sClient.CoreV1().Events(pvc.Namespace).Create(context.Background(), event, metav1.CreateOptions{}); err != nil {
+		log.Warnf("Failed to record event %s on PVC %s/%s: %v", reason, pvc.Namespace, pvc.Name, err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestScaleUpRemovesAnnotationOfIdleWorkload(t *testing.T) {
+	annotated := func(name string) *appsv1.Deployment {
+		return &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "production",
+			Annotations: map[string]string{annotationRestoreReplicas: "0"},
+		}}
+	}
+	client := fake.NewSimpleClientset(annotated("idle"), annotated("untouched"))
+	rs := &RestoreService{k8sClient: client}
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "production"}}
+
+	// "untouched" was not reached by scaleDown, so its annotation is not
+	// ours to remove.
+	workloads := []workload{
+		{kind: workloadDeployment, name: "idle", annotated: true},
+		{kind: workloadDeployment, name: "untouched"},
+	}
+	if err := rs.scaleUp(context.Background(), pvc, workloads); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]bool{"idle": false, "untouched": true} {
+		deployment, err := client.AppsV1().Deployments("production").Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := deployment.Annotations[annotationRestoreReplicas]; ok != expected {
+			t.Errorf("%s: annotation present %v, expected %v", name, ok, expected)
+		}
+	}
+}
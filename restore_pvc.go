@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// pvcOverrides replaces values recorded in the manifest when creating the
+// PVC to restore into.
+type pvcOverrides struct {
+	storageClass string
+	size         string
+}
+
+// RestoreToNewPVC creates a PVC like the one chain was backed up from, waits
+// for ceph-csi to provision its RBD image and replaces that image with the
+// backup. The PVC is deleted again if the restore fails.
+func (rs *RestoreService) RestoreToNewPVC(chain []BackupChainLink, namespace, name string, overrides pvcOverrides) error {
+	if rs.k8sClient == nil {
+		k8sClient, err := createK8sClient()
+		if err != nil {
+			return fmt.Errorf("failed to create Kubernetes client: %w", err)
+		}
+		rs.k8sClient = k8sClient
+	}
+
+	pvc, err := newRestorePVC(chain[len(chain)-1], namespace, name, overrides)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	// A PVC of a WaitForFirstConsumer class is only provisioned once a pod
+	// uses it, which would then see the empty volume.
+	if className := pvc.Spec.StorageClassName; className != nil && *className != "" {
+		class, err := rs.k8sClient.StorageV1().StorageClasses().Get(ctx, *className, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get StorageClass %s: %w", *className, err)
+		}
+		if class.VolumeBindingMode != nil && *class.VolumeBindingMode == storagev1.VolumeBindingWaitForFirstConsumer {
+			return fmt.Errorf("StorageClass %s provisions volumes only for a consuming pod (WaitForFirstConsumer); use a class with Immediate binding (--storage-class) or restore into [target-pool] [target-image]", *className)
+		}
+	}
+
+	log.Infof("Creating PVC %s/%s (%s, %s)", namespace, name, storageClassName(pvc), pvc.Spec.Resources.Requests.Storage())
+	if _, err := rs.k8sClient.CoreV1().PersistentVolumeClaims(namespace).Create(ctx, pvc, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create PVC %s/%s: %w", namespace, name, err)
+	}
+
+	if err := rs.restoreIntoPVC(ctx, chain, namespace, name); err != nil {
+		log.Warnf("Deleting PVC %s/%s after failed restore", namespace, name)
+		if deleteErr := rs.k8sClient.CoreV1().PersistentVolumeClaims(namespace).Delete(ctx, name, metav1.DeleteOptions{}); deleteErr != nil {
+			log.Errorf("Failed to delete PVC %s/%s: %v", namespace, name, deleteErr)
+		}
+		return err
+	}
+
+	log.Infof("Restored %s into PVC %s/%s", chain[len(chain)-1].ObjectName, namespace, name)
+	return nil
+}
+
+func (rs *RestoreService) restoreIntoPVC(ctx context.Context, chain []BackupChainLink, namespace, name string) error {
+	pv, err := rs.waitForPVCBound(ctx, namespace, name)
+	if err != nil {
+		return err
+	}
+
+	if isCephFSBackup(chain) != isCephFSPV(pv) {
+		return fmt.Errorf("PV %s and the backup are of different volume types, choose a matching --storage-class", pv.Name)
+	}
+	if isCephFSPV(pv) {
+		volume, err := cephFSVolumeOfPV(pv)
+		if err != nil {
+			return err
+		}
+		dir, err := cephFSDir(volume.FSName, volume.SubvolumePath)
+		if err != nil {
+			return err
+		}
+		return rs.RestoreToDirectory(chain, dir)
+	}
+
+	pool, imageName, err := rbdImageOfPV(pv)
+	if err != nil {
+		return err
+	}
+
+	// rbd import only creates images, so the backup is imported next to the
+	// freshly provisioned and still unused image and only moved to the name
+	// ceph-csi knows once it is complete. Until then the PV keeps the image
+	// it was provisioned with.
+	staging := fmt.Sprintf("%s-restore-%s", imageName, time.Now().UTC().Format("20060102T150405Z"))
+	if err := rs.Restore(chain, pool, staging, rs.importFeatures(chain, pool, imageName)); err != nil {
+		rs.removeStagingImage(pool, staging)
+		return err
+	}
+	if err := rs.fitToPV(pool, staging, pv); err != nil {
+		rs.removeStagingImage(pool, staging)
+		return err
+	}
+
+	if err := rs.cephClient.RemoveImage(pool, imageName); err != nil {
+		rs.removeStagingImage(pool, staging)
+		return fmt.Errorf("failed to replace provisioned image: %w", err)
+	}
+	if err := rs.cephClient.RenameImage(pool, staging, imageName); err != nil {
+		return fmt.Errorf("failed to move restored image into place, rename %s/%s to %s by hand: %w", pool, staging, imageName, err)
+	}
+
+	return nil
+}
+
+// fitToPV grows the restored image to the capacity of the PV it goes into.
+// rbd import recreates the image at its backed up size, which only matches
+// the PV if the PVC was created with that size; an image larger than the PV
+// would not fit the size the PVC reports, so that restore fails.
+func (rs *RestoreService) fitToPV(pool, imageName string, pv *corev1.PersistentVolume) error {
+	info, err := rs.cephClient.ImageInfo(pool, imageName)
+	if err != nil {
+		return err
+	}
+
+	capacity := pv.Spec.Capacity[corev1.ResourceStorage]
+	switch size := int64(info.Size); {
+	case size > capacity.Value():
+		return fmt.Errorf("restored image is %d bytes, larger than PV %s with a capacity of %s; pass a larger --size", size, pv.Name, capacity.String())
+	case size < capacity.Value():
+		return rs.cephClient.ResizeImage(pool, imageName, uint64(capacity.Value()))
+	}
+	return nil
+}
+
+// removeStagingImage deletes what a failed restore imported under a
+// temporary name, including the snapshots rbd rm refuses to remove.
+func (rs *RestoreService) removeStagingImage(pool, imageName string) {
+	exists, err := rs.cephClient.ImageExists(pool, imageName)
+	if err != nil {
+		log.Errorf("Failed to check for partially restored image %s/%s: %v", pool, imageName, err)
+		return
+	}
+	if !exists {
+		return
+	}
+
+	snapshots, err := rs.cephClient.ListSnapshots(pool, imageName)
+	if err != nil {
+		log.Errorf("Failed to remove partially restored image %s/%s: %v", pool, imageName, err)
+		return
+	}
+	for _, snapshot := range snapshots {
+		if err := rs.cephClient.RemoveSnapshot(pool, imageName, snapshot.Name); err != nil {
+			log.Errorf("Failed to remove partially restored image %s/%s: %v", pool, imageName, err)
+			return
+		}
+	}
+	if err := rs.cephClient.RemoveImage(pool, imageName); err != nil {
+		log.Errorf("Failed to remove partially restored image: %v", err)
+	}
+}
+
+// waitForPVCBound waits until the PVC is bound and returns its PV.
+func (rs *RestoreService) waitForPVCBound(ctx context.Context, namespace, name string) (*corev1.PersistentVolume, error) {
+	timeout := rs.provisionTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Minute
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		pvc, err := rs.k8sClient.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get PVC %s/%s: %w", namespace, name, err)
+		}
+
+		if pvc.Status.Phase == corev1.ClaimBound && pvc.Spec.VolumeName != "" {
+			pv, err := rs.k8sClient.CoreV1().PersistentVolumes().Get(ctx, pvc.Spec.VolumeName, metav1.GetOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get PV %s: %w", pvc.Spec.VolumeName, err)
+			}
+			return pv, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("PVC %s/%s not bound after %s", namespace, name, timeout)
+		}
+
+		log.Debugf("Waiting for PVC %s/%s to be provisioned", namespace, name)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// newRestorePVC builds the PVC to restore link into from the StorageClass,
+// size, access modes and volume mode recorded in its manifest.
+func newRestorePVC(link BackupChainLink, namespace, name string, overrides pvcOverrides) (*corev1.PersistentVolumeClaim, error) {
+	var manifest BackupManifest
+	if link.Manifest != nil {
+		manifest = *link.Manifest
+	}
+
+	storageClass := manifest.StorageClass
+	if overrides.storageClass != "" {
+		storageClass = overrides.storageClass
+	}
+
+	size := manifest.Capacity
+	if overrides.size != "" {
+		size = overrides.size
+	}
+	if size == "" && manifest.ImageSize > 0 {
+		size = resource.NewQuantity(int64(manifest.ImageSize), resource.BinarySI).String()
+	}
+	if size == "" {
+		return nil, fmt.Errorf("backup %s records no size, pass --size", link.ObjectName)
+	}
+
+	quantity, err := resource.ParseQuantity(size)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PVC size %q: %w", size, err)
+	}
+
+	accessModes := []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}
+	if len(manifest.AccessModes) > 0 {
+		accessModes = nil
+		for _, mode := range manifest.AccessModes {
+			accessModes = append(accessModes, corev1.PersistentVolumeAccessMode(mode))
+		}
+	}
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Annotations: map[string]string{
+				annotationRestoredFrom: link.ObjectName,
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: accessModes,
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: quantity},
+			},
+		},
+	}
+
+	// Without a class the cluster's default StorageClass is used.
+	if storageClass != "" {
+		pvc.Spec.StorageClassName = &storageClass
+	}
+	if manifest.VolumeMode != "" {
+		volumeMode := corev1.PersistentVolumeMode(manifest.VolumeMode)
+		pvc.Spec.VolumeMode = &volumeMode
+	}
+
+	return pvc, nil
+}
+
+func storageClassName(pvc *corev1.PersistentVolumeClaim) string {
+	if pvc.Spec.StorageClassName == nil {
+		return "default StorageClass"
+	}
+	return "StorageClass " + *pvc.Spec.StorageClassName
+}
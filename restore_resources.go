@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// remap prepares the stored objects for re-applying: the PVC is moved to
+// namespace and both volumes to storageClass if given, and PV and PVC are
+// pre-bound to each other.
+func (r *KubeResources) remap(namespace, storageClass, backup string) error {
+	if r.PVC == nil || r.PV == nil {
+		return fmt.Errorf("backup is missing the PVC or PV object")
+	}
+
+	if namespace != "" {
+		r.PVC.Namespace = namespace
+	}
+	if storageClass != "" {
+		// The recorded class is replaced, so it is not re-applied either.
+		r.StorageClass = nil
+		r.PV.Spec.StorageClassName = storageClass
+		r.PVC.Spec.StorageClassName = &storageClass
+	}
+
+	r.PVC.Spec.VolumeName = r.PV.Name
+	r.PV.Spec.ClaimRef = &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "PersistentVolumeClaim",
+		Namespace:  r.PVC.Namespace,
+		Name:       r.PVC.Name,
+	}
+
+	if r.PVC.Annotations == nil {
+		r.PVC.Annotations = make(map[string]string)
+	}
+	r.PVC.Annotations[annotationRestoredFrom] = backup
+	return nil
+}
+
+// RestoreWithResources rebuilds a volume from the Kubernetes objects stored
+// with its backup: the StorageClass is created unless it exists, the backup
+// is imported into the RBD image named by the PV, and PV and PVC are created
+// bound to each other. The objects are expected to have been remapped.
+func (rs *RestoreService) RestoreWithResources(chain []BackupChainLink, resources *KubeResources) error {
+	if rs.k8sClient == nil {
+		k8sClient, err := createK8sClient()
+		if err != nil {
+			return fmt.Errorf("failed to create Kubernetes client: %w", err)
+		}
+		rs.k8sClient = k8sClient
+	}
+
+	if isCephFSBackup(chain) {
+		return fmt.Errorf("--apply-resources is only supported for RBD backups, restore CephFS backups with --to-pvc")
+	}
+
+	ctx := context.Background()
+	pv, pvc := resources.PV, resources.PVC
+
+	pool, imageName, err := rbdImageOfPV(pv)
+	if err != nil {
+		return err
+	}
+
+	// Check for conflicts before importing anything.
+	if _, err := rs.k8sClient.CoreV1().PersistentVolumes().Get(ctx, pv.Name, metav1.GetOptions{}); err == nil {
+		return fmt.Errorf("PV %s already exists", pv.Name)
+	} else if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get PV %s: %w", pv.Name, err)
+	}
+	if _, err := rs.k8sClient.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(ctx, pvc.Name, metav1.GetOptions{}); err == nil {
+		return fmt.Errorf("PVC %s/%s already exists", pvc.Namespace, pvc.Name)
+	} else if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get PVC %s/%s: %w", pvc.Namespace, pvc.Name, err)
+	}
+
+	if class := resources.StorageClass; class != nil {
+		_, err := rs.k8sClient.StorageV1().StorageClasses().Create(ctx, class, metav1.CreateOptions{})
+		switch {
+		case apierrors.IsAlreadyExists(err):
+			log.Infof("StorageClass %s already exists, keeping it", class.Name)
+		case err != nil:
+			return fmt.Errorf("failed to create StorageClass %s: %w", class.Name, err)
+		default:
+			log.Infof("Created StorageClass %s", class.Name)
+		}
+	}
+
+	if err := rs.Restore(chain, pool, imageName, rs.importFeatures(chain, pool, "")); err != nil {
+		return err
+	}
+
+	if _, err := rs.k8sClient.CoreV1().PersistentVolumes().Create(ctx, pv, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create PV %s for restored image %s/%s: %w", pv.Name, pool, imageName, err)
+	}
+	log.Infof("Created PV %s", pv.Name)
+
+	if _, err := rs.k8sClient.CoreV1().PersistentVolumeClaims(pvc.Namespace).Create(ctx, pvc, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create PVC %s/%s for PV %s: %w", pvc.Namespace, pvc.Name, pv.Name, err)
+	}
+	log.Infof("Created PVC %s/%s", pvc.Namespace, pvc.Name)
+
+	return nil
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// signatureSuffix is appended to the object name of a backup to store its
+// detached signature.
+const signatureSuffix = ".sig"
+
+// objectNotation binds OpenPGP signatures to the object they were made for,
+// so a signed backup cannot be passed off as another one.
+const objectNotation = "object@k8s-ceph-backup"
+
+// ed25519Context prefixes the object name and data hashed for ed25519
+// signatures, for the same reason.
+const ed25519Context = "k8s-ceph-backup signature v1\n"
+
+// signatureObjectName returns the key of the signature belonging to a
+// backup.
+func signatureObjectName(objectName string) string {
+	return objectName + signatureSuffix
+}
+
+// isSignatureObject reports whether objectName is a signature rather than
+// backup data.
+func isSignatureObject(objectName string) bool {
+	return strings.HasSuffix(objectName, signatureSuffix)
+}
+
+// Signer makes detached signatures of backup objects with an armored
+// OpenPGP private key or a PEM encoded ed25519 private key (openssl genpkey
+// -algorithm ed25519).
+type Signer struct {
+	entity  *openpgp.Entity
+	ed25519 ed25519.PrivateKey
+}
+
+func NewSigner() (*Signer, error) {
+	keyFile := viper.GetString("signing.private_key")
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+
+	if block, _ := pem.Decode(data); block != nil && block.Type == "PRIVATE KEY" {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse signing key %s: %w", keyFile, err)
+		}
+		private, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("signing key %s is a %T, expected an ed25519 key", keyFile, key)
+		}
+		return &Signer{ed25519: private}, nil
+	}
+
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key %s: %w", keyFile, err)
+	}
+	if len(entities) != 1 {
+		return nil, fmt.Errorf("signing key %s has to contain exactly one key, found %d", keyFile, len(entities))
+	}
+	entity := entities[0]
+	if entity.PrivateKey == nil {
+		return nil, fmt.Errorf("signing key %s is not a private key", keyFile)
+	}
+
+	passphrase := viper.GetString("signing.passphrase")
+	if passphraseFile := viper.GetString("signing.passphrase_file"); passphraseFile != "" {
+		data, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signing key passphrase file: %w", err)
+		}
+		passphrase = strings.TrimRight(string(data), "\r\n")
+	}
+	if entity.PrivateKey.Encrypted {
+		if passphrase == "" {
+			return nil, fmt.Errorf("signing key %s is protected, set signing.passphrase or signing.passphrase_file", fingerprint(entity))
+		}
+		if err := entity.DecryptPrivateKeys([]byte(passphrase)); err != nil {
+			return nil, fmt.Errorf("failed to unlock signing key %s: %w", fingerprint(entity), err)
+		}
+	}
+	if _, ok := entity.SigningKey(time.Now()); !ok {
+		return nil, fmt.Errorf("GPG key %s has no valid signing key", fingerprint(entity))
+	}
+
+	return &Signer{entity: entity}, nil
+}
+
+// KeyID identifies the signing key as recorded in manifests.
+func (s *Signer) KeyID() string {
+	if s.entity != nil {
+		return fingerprint(s.entity)
+	}
+	return ed25519KeyID(s.ed25519.Public().(ed25519.PublicKey))
+}
+
+// ContentType is the content type signatures are uploaded with.
+func (s *Signer) ContentType() string {
+	if s.entity != nil {
+		return "application/pgp-signature"
+	}
+	return "application/octet-stream"
+}
+
+// Start returns a writer taking the content of objectName. Its Sign method
+// returns the detached signature once all of it is written.
+func (s *Signer) Start(objectName string) *signatureWriter {
+	if s.ed25519 != nil {
+		h := ed25519Hash(objectName)
+		return &signatureWriter{Writer: h, finish: func() ([]byte, error) {
+			return s.ed25519.Sign(nil, h.Sum(nil), &ed25519.Options{Hash: crypto.SHA512})
+		}}
+	}
+
+	config := &packet.Config{
+		DefaultHash: crypto.SHA256,
+		SignatureNotations: []*packet.Notation{{
+			Name:            objectNotation,
+			Value:           []byte(objectName),
+			IsHumanReadable: true,
+		}},
+	}
+	var signature bytes.Buffer
+	return startPipe(func(signed io.Reader) error {
+		return openpgp.DetachSign(&signature, s.entity, signed, config)
+	}, func() ([]byte, error) {
+		return signature.Bytes(), nil
+	})
+}
+
+// Sign returns the detached signature of data, uploaded as objectName.
+func (s *Signer) Sign(objectName string, data []byte) ([]byte, error) {
+	signing := s.Start(objectName)
+	defer signing.Close()
+	if _, err := signing.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to sign %s: %w", objectName, err)
+	}
+	return signing.Sign()
+}
+
+// SignFile returns the detached signature of the file at path, uploaded as
+// objectName.
+func (s *Signer) SignFile(path, objectName string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file to sign: %w", err)
+	}
+	defer file.Close()
+
+	signing := s.Start(objectName)
+	defer signing.Close()
+	if _, err := io.Copy(signing, file); err != nil {
+		return nil, fmt.Errorf("failed to sign file: %w", err)
+	}
+	return signing.Sign()
+}
+
+// writeSignature uploads the detached signature of a backup and records it
+// in the manifest. Unsigned backups have none.
+func (bs *BackupService) writeSignature(manifest *BackupManifest, signature []byte) error {
+	if signature == nil {
+		return nil
+	}
+
+	objectName := signatureObjectName(manifest.Object)
+	if err := bs.minioClient.UploadBytes(objectName, signature, bs.signer.ContentType()); err != nil {
+		return fmt.Errorf("failed to upload signature: %w", err)
+	}
+	manifest.Signature = objectName
+	manifest.SignedBy = bs.signer.KeyID()
+	return nil
+}
+
+// uploadSigned uploads data as objectName together with its signature. The
+// signature goes first, so a signed object never appears without it. When
+// an existing object is rewritten and its upload fails, the previous
+// signature is put back so it keeps matching the object left in place.
+func uploadSigned(minioClient *MinioClient, signer *Signer, objectName string, data []byte, contentType string) error {
+	if signer == nil {
+		return minioClient.UploadBytes(objectName, data, contentType)
+	}
+
+	signature, err := signer.Sign(objectName, data)
+	if err != nil {
+		return err
+	}
+
+	signatureName := signatureObjectName(objectName)
+	previous, err := minioClient.StatObject(signatureName)
+	var previousSignature []byte
+	switch {
+	case err == nil:
+		if previousSignature, err = minioClient.DownloadBytes(signatureName); err != nil {
+			return fmt.Errorf("failed to read signature of %s: %w", objectName, err)
+		}
+	case !isNotFound(err):
+		return fmt.Errorf("failed to read signature of %s: %w", objectName, err)
+	}
+
+	if err := minioClient.UploadBytes(signatureName, signature, signer.ContentType()); err != nil {
+		return fmt.Errorf("failed to upload signature of %s: %w", objectName, err)
+	}
+	if err := minioClient.UploadBytes(objectName, data, contentType); err != nil {
+		if previousSignature != nil {
+			if restoreErr := minioClient.UploadBytes(signatureName, previousSignature, previous.ContentType); restoreErr != nil {
+				log.Errorf("Failed to restore the previous signature of %s, which no longer matches it: %v", objectName, restoreErr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// Verifier checks detached signatures of backup objects against trusted
+// OpenPGP and ed25519 public keys. Keys are loaded on first use.
+type Verifier struct {
+	trustedKeys       []string
+	trustedKeysSecret string
+
+	once     sync.Once
+	entities openpgp.EntityList
+	ed25519  []ed25519.PublicKey
+	err      error
+}
+
+func NewVerifier() *Verifier {
+	return &Verifier{
+		trustedKeys:       viper.GetStringSlice("signing.trusted_keys"),
+		trustedKeysSecret: viper.GetString("signing.trusted_keys_secret"),
+	}
+}
+
+// Start returns a writer taking the content of objectName. Its Verify
+// method checks signature against it once all of it is written and returns
+// the key that made it.
+func (v *Verifier) Start(objectName string, signature []byte) (*signatureWriter, error) {
+	if err := v.Validate(); err != nil {
+		return nil, err
+	}
+
+	// ed25519 signatures are stored raw, OpenPGP ones as packets which are
+	// never exactly that long.
+	if len(signature) == ed25519.SignatureSize && len(v.ed25519) > 0 {
+		h := ed25519Hash(objectName)
+		return &signatureWriter{Writer: h, finish: func() ([]byte, error) {
+			digest := h.Sum(nil)
+			for _, key := range v.ed25519 {
+				if ed25519.VerifyWithOptions(key, digest, signature, &ed25519.Options{Hash: crypto.SHA512}) == nil {
+					return []byte(ed25519KeyID(key)), nil
+				}
+			}
+			return nil, errors.New("signature does not match any trusted ed25519 key")
+		}}, nil
+	}
+
+	var signer string
+	return startPipe(func(signed io.Reader) error {
+		sig, entity, err := openpgp.VerifyDetachedSignature(v.entities, signed, bytes.NewReader(signature), nil)
+		if err != nil {
+			if errors.Is(err, pgperrors.ErrUnknownIssuer) {
+				return errors.New("signature was not made by a trusted key")
+			}
+			return err
+		}
+		if !hasNotation(sig, objectNotation, objectName) {
+			return fmt.Errorf("signature was made for another object")
+		}
+		signer = fingerprint(entity)
+		return nil
+	}, func() ([]byte, error) {
+		return []byte(signer), nil
+	}), nil
+}
+
+// verifySignatureOf fetches the signature stored next to objectName and
+// starts checking it. Objects without one are refused.
+func verifySignatureOf(minioClient *MinioClient, verifier *Verifier, objectName string) (*signatureWriter, error) {
+	signature, err := minioClient.DownloadBytes(signatureObjectName(objectName))
+	if err != nil {
+		if isNotFound(err) {
+			return nil, fmt.Errorf("%s is not signed, pass --insecure-skip-verify to accept it anyway", objectName)
+		}
+		return nil, fmt.Errorf("failed to download signature of %s: %w", objectName, err)
+	}
+	return verifier.Start(objectName, signature)
+}
+
+// loadVerifiedManifest reads the manifest of a backup and checks its
+// signature, and returns it with the key that signed it. Chain, checksums
+// and wrapped data key are only trusted from a verified manifest.
+func loadVerifiedManifest(minioClient *MinioClient, verifier *Verifier, objectName string) (*BackupManifest, string, error) {
+	name := manifestObjectName(objectName)
+	data, err := minioClient.DownloadBytes(name)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, "", fmt.Errorf("backup %s has no manifest to verify, pass --insecure-skip-verify to accept it anyway", objectName)
+		}
+		return nil, "", fmt.Errorf("failed to download manifest of %s: %w", objectName, err)
+	}
+
+	verifying, err := verifySignatureOf(minioClient, verifier, name)
+	if err != nil {
+		return nil, "", err
+	}
+	defer verifying.Close()
+	if _, err := verifying.Write(data); err != nil {
+		return nil, "", fmt.Errorf("failed to verify manifest of %s: %w", objectName, err)
+	}
+	signer, err := verifying.Verify()
+	if err != nil {
+		return nil, "", fmt.Errorf("refusing manifest of %s: %w", objectName, err)
+	}
+
+	var manifest BackupManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, "", fmt.Errorf("failed to decode manifest of %s: %w", objectName, err)
+	}
+	if manifest.Object != objectName {
+		return nil, "", fmt.Errorf("manifest of %s describes %s", objectName, manifest.Object)
+	}
+	if manifest.Resources != "" && manifest.ResourcesSHA256 == "" {
+		return nil, "", fmt.Errorf("manifest of %s records no checksum of its Kubernetes objects", objectName)
+	}
+	return &manifest, signer, nil
+}
+
+// verifyFileSignature checks the signature of the file at path.
+func verifyFileSignature(verifying *signatureWriter, path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file to verify: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(verifying, file); err != nil {
+		return "", fmt.Errorf("failed to verify signature: %w", err)
+	}
+	return verifying.Verify()
+}
+
+// Validate checks that trusted keys are configured and can be parsed.
+func (v *Verifier) Validate() error {
+	v.once.Do(func() {
+		v.err = v.load()
+	})
+	if v.err != nil {
+		return fmt.Errorf("failed to load trusted signing keys: %w", v.err)
+	}
+	if len(v.entities) == 0 && len(v.ed25519) == 0 {
+		return fmt.Errorf("no trusted signing keys configured, set signing.trusted_keys or signing.trusted_keys_secret")
+	}
+	return nil
+}
+
+func (v *Verifier) load() error {
+	for _, path := range v.trustedKeys {
+		files, err := keyFiles(path)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return fmt.Errorf("failed to read key file: %w", err)
+			}
+			if err := v.add(data); err != nil {
+				return fmt.Errorf("failed to parse key file %s: %w", file, err)
+			}
+		}
+	}
+
+	if v.trustedKeysSecret != "" {
+		data, err := readKeySecret(v.trustedKeysSecret)
+		if err != nil {
+			return err
+		}
+		for key, value := range data {
+			if err := v.add(value); err != nil {
+				return fmt.Errorf("failed to parse key %s of secret %s: %w", key, v.trustedKeysSecret, err)
+			}
+		}
+	}
+	return nil
+}
+
+// add parses a PEM encoded ed25519 public key or armored OpenPGP keys.
+func (v *Verifier) add(data []byte) error {
+	if block, _ := pem.Decode(data); block != nil && block.Type == "PUBLIC KEY" {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		public, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("public key is a %T, expected an ed25519 key", key)
+		}
+		v.ed25519 = append(v.ed25519, public)
+		return nil
+	}
+
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	v.entities = append(v.entities, entities...)
+	return nil
+}
+
+// signatureWriter consumes signed data; finish makes or checks the
+// signature once all of it is written.
+type signatureWriter struct {
+	io.Writer
+	finish func() ([]byte, error)
+
+	// pipe and done are set for signatures computed by a goroutine
+	// reading what is written.
+	pipe *io.PipeWriter
+	done chan error
+}
+
+// startPipe runs consume in a goroutine on everything written to the
+// returned writer.
+func startPipe(consume func(io.Reader) error, finish func() ([]byte, error)) *signatureWriter {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := consume(pr)
+		// Unblock the writer should consume stop reading early.
+		pr.CloseWithError(errors.New("signature check stopped reading"))
+		done <- err
+	}()
+	return &signatureWriter{Writer: pw, finish: finish, pipe: pw, done: done}
+}
+
+func (s *signatureWriter) wait() error {
+	if s.pipe == nil {
+		return nil
+	}
+	s.pipe.Close()
+	err := <-s.done
+	s.pipe = nil
+	return err
+}
+
+// Sign returns the signature of the data written.
+func (s *signatureWriter) Sign() ([]byte, error) {
+	if err := s.wait(); err != nil {
+		return nil, fmt.Errorf("failed to sign: %w", err)
+	}
+	return s.finish()
+}
+
+// Verify checks the signature against the data written and returns the key
+// that made it.
+func (s *signatureWriter) Verify() (string, error) {
+	if err := s.wait(); err != nil {
+		return "", fmt.Errorf("invalid signature: %w", err)
+	}
+	signer, err := s.finish()
+	if err != nil {
+		return "", fmt.Errorf("invalid signature: %w", err)
+	}
+	return string(signer), nil
+}
+
+// Close stops a signature that is not going to be finished.
+func (s *signatureWriter) Close() error {
+	if s.pipe != nil {
+		s.pipe.CloseWithError(errors.New("signature aborted"))
+		<-s.done
+		s.pipe = nil
+	}
+	return nil
+}
+
+// ed25519Hash returns the prehash of an ed25519ph signature of objectName,
+// fed with the context and the name before the data.
+func ed25519Hash(objectName string) hash.Hash {
+	h := sha512.New()
+	io.WriteString(h, ed25519Context)
+	io.WriteString(h, objectName+"\n")
+	return h
+}
+
+func ed25519KeyID(key ed25519.PublicKey) string {
+	return "ed25519:" + base64.StdEncoding.EncodeToString(key)
+}
+
+func hasNotation(sig *packet.Signature, name, value string) bool {
+	for _, notation := range sig.Notations {
+		if notation.Name == name && string(notation.Value) == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/spf13/viper"
+)
+
+// setConfig sets viper keys for the duration of the test.
+func setConfig(t *testing.T, values map[string]interface{}) {
+	t.Helper()
+	previous := map[string]interface{}{}
+	for key, value := range values {
+		previous[key] = viper.Get(key)
+		viper.Set(key, value)
+	}
+	t.Cleanup(func() {
+		for key, value := range previous {
+			viper.Set(key, value)
+		}
+	})
+}
+
+func writeFile(t *testing.T, path string, data []byte) string {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// generateEd25519Key writes a PEM private and public key and returns their
+// paths.
+func generateEd25519Key(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return writeFile(t, filepath.Join(dir, "ed25519.key"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER})),
+		writeFile(t, filepath.Join(dir, "ed25519.pub"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}))
+}
+
+// generatePGPKey writes an armored OpenPGP private and public key and
+// returns their paths.
+func generatePGPKey(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	entity, err := openpgp.NewEntity("Backup Test", "", "backup@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var private, public bytes.Buffer
+	w, err := armor.Encode(&private, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.SerializePrivate(w, nil); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	w, err = armor.Encode(&public, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	return writeFile(t, filepath.Join(dir, "pgp.key"), private.Bytes()),
+		writeFile(t, filepath.Join(dir, "pgp.asc"), public.Bytes())
+}
+
+func verifySignature(v *Verifier, objectName string, data, signature []byte) (string, error) {
+	verifying, err := v.Start(objectName, signature)
+	if err != nil {
+		return "", err
+	}
+	defer verifying.Close()
+	if _, err := verifying.Write(data); err != nil {
+		return "", err
+	}
+	return verifying.Verify()
+}
+
+func TestSignAndVerify(t *testing.T) {
+	const objectName = "production/data-2026-10-01T02-00-00Z.rbd.gz.gpg"
+	data := bytes.Repeat([]byte("backup data "), 100000)
+
+	for name, generate := range map[string]func(*testing.T, string) (string, string){
+		"ed25519": generateEd25519Key,
+		"openpgp": generatePGPKey,
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			privateKey, publicKey := generate(t, dir)
+			setConfig(t, map[string]interface{}{
+				"signing.private_key":  privateKey,
+				"signing.trusted_keys": []string{publicKey},
+			})
+
+			signer, err := NewSigner()
+			if err != nil {
+				t.Fatal(err)
+			}
+			signature, err := signer.Sign(objectName, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifier := NewVerifier()
+
+			t.Run("round trip", func(t *testing.T) {
+				signedBy, err := verifySignature(verifier, objectName, data, signature)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if signedBy != signer.KeyID() {
+					t.Fatalf("signed by %q, expected %q", signedBy, signer.KeyID())
+				}
+			})
+
+			t.Run("file", func(t *testing.T) {
+				path := writeFile(t, filepath.Join(dir, "backup"), data)
+				fileSignature, err := signer.SignFile(path, objectName)
+				if err != nil {
+					t.Fatal(err)
+				}
+				verifying, err := verifier.Start(objectName, fileSignature)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := verifyFileSignature(verifying, path); err != nil {
+					t.Fatal(err)
+				}
+			})
+
+			t.Run("tampered data", func(t *testing.T) {
+				tampered := append([]byte{}, data...)
+				tampered[len(tampered)/2] ^= 1
+				if _, err := verifySignature(verifier, objectName, tampered, signature); err == nil {
+					t.Fatal("tampered data verified")
+				}
+			})
+
+			t.Run("truncated data", func(t *testing.T) {
+				if _, err := verifySignature(verifier, objectName, data[:len(data)-1], signature); err == nil {
+					t.Fatal("truncated data verified")
+				}
+			})
+
+			t.Run("wrong object name", func(t *testing.T) {
+				if _, err := verifySignature(verifier, "production/data-2026-09-01T02-00-00Z.rbd.gz.gpg", data, signature); err == nil {
+					t.Fatal("signature verified for another object")
+				}
+			})
+
+			t.Run("aborted", func(t *testing.T) {
+				verifying, err := verifier.Start(objectName, signature)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := verifying.Write(data[:10]); err != nil {
+					t.Fatal(err)
+				}
+				verifying.Close()
+			})
+		})
+	}
+}
+
+func TestVerifyUntrustedKey(t *testing.T) {
+	dir := t.TempDir()
+	pgpKey, _ := generatePGPKey(t, dir)
+	edKey, _ := generateEd25519Key(t, dir)
+
+	// Trust freshly generated keys of both kinds, not the signing ones.
+	trustedDir := t.TempDir()
+	_, trustedPGP := generatePGPKey(t, trustedDir)
+	_, trustedEd := generateEd25519Key(t, trustedDir)
+	setConfig(t, map[string]interface{}{"signing.trusted_keys": []string{trustedPGP, trustedEd}})
+	verifier := NewVerifier()
+
+	for _, key := range []string{pgpKey, edKey} {
+		setConfig(t, map[string]interface{}{"signing.private_key": key})
+		signer, err := NewSigner()
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature, err := signer.Sign("object", []byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := verifySignature(verifier, "object", []byte("data"), signature); err == nil {
+			t.Fatalf("signature of untrusted key %s verified", signer.KeyID())
+		}
+	}
+}
+
+func TestVerifyWithoutTrustedKeys(t *testing.T) {
+	if _, err := NewVerifier().Start("object", make([]byte, ed25519.SignatureSize)); err == nil {
+		t.Fatal("verification without trusted keys succeeded")
+	}
+}
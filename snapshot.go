@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// backupSnapshotPrefix marks RBD and CephFS snapshots created by this tool. Snapshots
+// without it are never touched.
+const backupSnapshotPrefix = "k8s-ceph-backup-"
+
+func backupSnapshotName(isoDate string) string {
+	return backupSnapshotPrefix + isoDate
+}
+
+// snapshotsToKeep is the configured number of snapshots to retain, raised
+// to one in incremental mode so the next run has a snapshot to diff from.
+// NewBackupService rejects negative numbers.
+func (bs *BackupService) snapshotsToKeep() int {
+	if bs.incremental && bs.keepSnapshots < 1 {
+		return 1
+	}
+	return bs.keepSnapshots
+}
+
+// pruneBackupSnapshots removes the tool's snapshots of image so that only
+// the newest snapshotsToKeep remain. The snapshot of the current run is
+// removed when the backup failed, since nothing refers to it. Leftovers of
+// crashed runs have no backup in the bucket; they are removed here on the
+// next run instead of taking the place of a retained snapshot.
+func (bs *BackupService) pruneBackupSnapshots(image CephImage, current string, succeeded bool) {
+	snapshots, err := bs.listSnapshots(image)
+	if err != nil {
+		bs.logger.Warnf("Failed to list snapshots of %s: %v", image.describe(), err)
+		return
+	}
+
+	backedUp, err := bs.backedUpSnapshots(image)
+	if err != nil {
+		bs.logger.Warnf("Failed to list backups of PVC %s, keeping snapshots without a backup: %v", image.PVCName, err)
+	}
+
+	var ours, remove []string
+	for _, snap := range snapshots {
+		if !strings.HasPrefix(snap, backupSnapshotPrefix) {
+			continue
+		}
+		switch {
+		case snap == current && !succeeded:
+			remove = append(remove, snap)
+		case snap == current, backedUp == nil, backedUp[snap]:
+			ours = append(ours, snap)
+		default:
+			bs.logger.Infof("Removing backup snapshot %s@%s of a failed run", image.describe(), snap)
+			remove = append(remove, snap)
+		}
+	}
+
+	// The timestamp suffix sorts chronologically.
+	sort.Strings(ours)
+	if keep := bs.snapshotsToKeep(); len(ours) > keep {
+		for _, snapshot := range ours[:len(ours)-keep] {
+			bs.logger.Infof("Removing stale backup snapshot %s@%s", image.describe(), snapshot)
+			remove = append(remove, snapshot)
+		}
+	}
+
+	for _, snapshot := range remove {
+		if err := bs.removeSnapshot(image, snapshot); err != nil {
+			bs.logger.Warnf("Failed to remove snapshot %s@%s: %v", image.describe(), snapshot, err)
+		}
+	}
+}
+
+// backedUpSnapshots returns the names of the backup snapshots of image that
+// a backup in the bucket was taken from.
+func (bs *BackupService) backedUpSnapshots(image CephImage) (map[string]bool, error) {
+	snapshots := map[string]bool{}
+	for _, keyNamespace := range backupKeyNamespaces(image.Namespace) {
+		objects, err := bs.minioClient.ListObjects(backupObjectPrefix(keyNamespace, image.PVCName))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range objects {
+			parsed, ok := parseBackupObjectName(object)
+			if ok && parsed.Namespace == keyNamespace && parsed.PVCName == image.PVCName {
+				snapshots[backupSnapshotName(parsed.Time.Format("2006-01-02T15-04-05Z"))] = true
+			}
+		}
+	}
+	return snapshots, nil
+}
+
+// listSnapshots returns the names of the RBD snapshots or CephFS subvolume
+// snapshots of image.
+func (bs *BackupService) listSnapshots(image CephImage) ([]string, error) {
+	if image.VolumeType == volumeTypeCephFS {
+		return bs.cephClient.ListSubvolumeSnapshots(image.cephFSVolume())
+	}
+
+	snapshots, err := bs.cephClient.ListSnapshots(image.rbdPool(), image.ImageName)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		names = append(names, snapshot.Name)
+	}
+	return names, nil
+}
+
+func (bs *BackupService) removeSnapshot(image CephImage, snapshot string) error {
+	if image.VolumeType == volumeTypeCephFS {
+		return bs.cephClient.RemoveSubvolumeSnapshot(image.cephFSVolume(), snapshot)
+	}
+	return bs.cephClient.RemoveSnapshot(image.rbdPool(), image.ImageName, snapshot)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+)
+
+// commandReader exposes the stdout of a running command as an io.ReadCloser.
+// Close waits for the command to exit and reports its failure, if any.
+type commandReader struct {
+	io.ReadCloser
+	cmd  *exec.Cmd
+	name string
+
+	once sync.Once
+	err  error
+}
+
+func startCommandReader(cmd *exec.Cmd, name string) (*commandReader, error) {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s stdout: %w", name, err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %w", name, err)
+	}
+
+	return &commandReader{ReadCloser: stdout, cmd: cmd, name: name}, nil
+}
+
+func (r *commandReader) Close() error {
+	r.once.Do(func() {
+		// Closing our end first makes a command that is still writing exit
+		// with EPIPE instead of blocking Wait forever.
+		r.ReadCloser.Close()
+		if err := r.cmd.Wait(); err != nil {
+			r.err = fmt.Errorf("%s failed: %w", r.name, err)
+		}
+	})
+	return r.err
+}
+
+// commandWriter exposes the stdin of a running command as an io.WriteCloser.
+// Close signals EOF to the command, waits for it to exit and reports its
+// failure, if any.
+type commandWriter struct {
+	io.WriteCloser
+	cmd  *exec.Cmd
+	name string
+
+	once sync.Once
+	err  error
+}
+
+func startCommandWriter(cmd *exec.Cmd, name string) (*commandWriter, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s stdin: %w", name, err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %w", name, err)
+	}
+
+	return &commandWriter{WriteCloser: stdin, cmd: cmd, name: name}, nil
+}
+
+func (w *commandWriter) Close() error {
+	w.once.Do(func() {
+		w.WriteCloser.Close()
+		if err := w.cmd.Wait(); err != nil {
+			w.err = fmt.Errorf("%s failed: %w", w.name, err)
+		}
+	})
+	return w.err
+}
+
+// firstError keeps the first error reported by any stage of a pipeline.
+// Once one stage fails the others are cancelled and usually fail as well;
+// those follow-up errors only describe the teardown, not the cause.
+type firstError struct {
+	once sync.Once
+	err  error
+}
+
+func (f *firstError) set(err error) {
+	if err == nil {
+		return
+	}
+	f.once.Do(func() {
+		f.err = err
+	})
+}
+
+func (f *firstError) get() error {
+	return f.err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// errorRecordingReader remembers the last read error other than io.EOF, so
+// a failed io.Copy can be blamed on the reading or the writing side.
+type errorRecordingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errorRecordingReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF {
+		e.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	resultSucceeded = "succeeded"
+	resultFailed    = "failed"
+	resultSkipped   = "skipped"
+)
+
+// BackupResult is the outcome of one PVC in a backup run.
+type BackupResult struct {
+	Namespace string        `json:"namespace"`
+	PVC       string        `json:"pvc"`
+	Pool      string        `json:"pool,omitempty"`
+	Image     string        `json:"image,omitempty"`
+	Status    string        `json:"status"`
+	Type      string        `json:"type,omitempty"`
+	Object    string        `json:"object,omitempty"`
+	Size      int64         `json:"size_bytes"`
+	Duration  time.Duration `json:"-"`
+	Stage     string        `json:"failed_stage,omitempty"`
+	Error     string        `json:"error,omitempty"`
+
+	ExportedBytes   int64 `json:"exported_bytes"`
+	CompressedBytes int64 `json:"compressed_bytes"`
+
+	// LastSuccess is the time of the newest successful backup of the PVC,
+	// whether or not it was taken in this run.
+	LastSuccess time.Time `json:"last_success"`
+}
+
+// MarshalJSON reports the duration in seconds instead of nanoseconds.
+func (r BackupResult) MarshalJSON() ([]byte, error) {
+	type plain BackupResult
+	return json.Marshal(struct {
+		plain
+		DurationSeconds float64 `json:"duration_seconds"`
+	}{plain(r), r.Duration.Seconds()})
+}
+
+// RunSummary collects the results of a whole backup run.
+type RunSummary struct {
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+	Results  []BackupResult `json:"results"`
+}
+
+func (s *RunSummary) count(status string) int {
+	n := 0
+	for _, result := range s.Results {
+		if result.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// Err returns a *BackupFailedError if any PVC failed, nil otherwise.
+func (s *RunSummary) Err() error {
+	failed := s.count(resultFailed)
+	if failed == 0 {
+		return nil
+	}
+	return &BackupFailedError{
+		Failed:    failed,
+		Attempted: failed + s.count(resultSucceeded),
+	}
+}
+
+// PrintTable writes a human readable table of all results to w.
+func (s *RunSummary) PrintTable(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tPVC\tSTATUS\tTYPE\tDURATION\tSIZE\tOBJECT / ERROR")
+	for _, result := range s.Results {
+		detail := result.Object
+		if result.Error != "" {
+			detail = result.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", result.Namespace, result.PVC, result.Status,
+			result.Type, result.Duration.Round(time.Second), result.Size, detail)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d succeeded, %d failed, %d skipped in %s\n", s.count(resultSucceeded),
+		s.count(resultFailed), s.count(resultSkipped), s.Finished.Sub(s.Started).Round(time.Second))
+}
+
+// WriteJSON writes the summary as JSON to path.
+func (s *RunSummary) WriteJSON(path string) error {
+	data, err := json.MarshalIndent(struct {
+		*RunSummary
+		Status          string  `json:"status"`
+		DurationSeconds float64 `json:"duration_seconds"`
+		Succeeded       int     `json:"succeeded"`
+		Failed          int     `json:"failed"`
+		Skipped         int     `json:"skipped"`
+	}{
+		RunSummary:      s,
+		Status:          s.status(),
+		DurationSeconds: s.Finished.Sub(s.Started).Seconds(),
+		Succeeded:       s.count(resultSucceeded),
+		Failed:          s.count(resultFailed),
+		Skipped:         s.count(resultSkipped),
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode summary: %w", err)
+	}
+
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write summary file: %w", err)
+	}
+	return nil
+}
+
+func (s *RunSummary) status() string {
+	switch {
+	case s.count(resultFailed) == 0:
+		return resultSucceeded
+	case s.count(resultSucceeded) == 0:
+		return resultFailed
+	default:
+		return "partial"
+	}
+}
+
+// BackupFailedError reports that some or all PVCs of a run failed.
+type BackupFailedError struct {
+	Failed    int
+	Attempted int
+}
+
+func (e *BackupFailedError) Error() string {
+	return fmt.Sprintf("%d of %d PVC backups failed", e.Failed, e.Attempted)
+}
+
+// Total reports whether every attempted backup failed.
+func (e *BackupFailedError) Total() bool {
+	return e.Failed == e.Attempted
+}
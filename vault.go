@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// VaultTransit wraps data keys with a key of HashiCorp Vault's Transit
+// secrets engine. The token is read from vault.token_file on every request,
+// so a file kept fresh by Vault Agent can be used.
+type VaultTransit struct {
+	address   string
+	token     string
+	tokenFile string
+	namespace string
+	mount     string
+	keyName   string
+
+	httpClient *http.Client
+}
+
+func NewVaultTransit() (*VaultTransit, error) {
+	// Environment variables take precedence over config file, as for the
+	// vault CLI.
+	address := os.Getenv("VAULT_ADDR")
+	if address == "" {
+		address = viper.GetString("vault.address")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		token = viper.GetString("vault.token")
+	}
+
+	v := &VaultTransit{
+		address:   strings.TrimSuffix(address, "/"),
+		token:     token,
+		tokenFile: viper.GetString("vault.token_file"),
+		namespace: viper.GetString("vault.namespace"),
+		mount:     strings.Trim(viper.GetString("vault.transit_mount"), "/"),
+		keyName:   viper.GetString("vault.key_name"),
+	}
+	if v.mount == "" {
+		v.mount = "transit"
+	}
+	if v.address == "" {
+		return nil, fmt.Errorf("Vault address not configured, set vault.address or VAULT_ADDR")
+	}
+	if v.keyName == "" {
+		return nil, fmt.Errorf("Vault Transit key not configured, set vault.key_name")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caCert := viper.GetString("vault.ca_cert"); caCert != "" {
+		pem, err := os.ReadFile(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Vault CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caCert)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	v.httpClient = &http.Client{Transport: transport, Timeout: 30 * time.Second}
+
+	return v, nil
+}
+
+func (v *VaultTransit) Name() string {
+	return keyProviderVault
+}
+
+// KeyID returns the Transit key as <mount>/<key name>.
+func (v *VaultTransit) KeyID() string {
+	return v.mount + "/" + v.keyName
+}
+
+// Wrap encrypts key with the newest version of the Transit key. The
+// ciphertext names the key version, vault:v<n>:...
+func (v *VaultTransit) Wrap(ctx context.Context, key []byte) (EnvelopeKey, error) {
+	var response struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	request := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(key)}
+	if err := v.call(ctx, "encrypt", v.KeyID(), request, &response); err != nil {
+		return EnvelopeKey{}, err
+	}
+
+	return EnvelopeKey{KeyProvider: keyProviderVault, KeyID: v.KeyID(), WrappedKey: response.Ciphertext}, nil
+}
+
+// Unwrap decrypts the data key with the Transit key it was wrapped with,
+// which need not be the configured one.
+func (v *VaultTransit) Unwrap(ctx context.Context, wrapped EnvelopeKey) ([]byte, error) {
+	var response struct {
+		Plaintext string `json:"plaintext"`
+	}
+	request := map[string]string{"ciphertext": wrapped.WrappedKey}
+	if err := v.call(ctx, "decrypt", wrapped.KeyID, request, &response); err != nil {
+		return nil, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(response.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode data key from Vault: %w", err)
+	}
+	return key, nil
+}
+
+// Rewrap re-encrypts the data key with the newest version of the Transit
+// key inside Vault. Keys wrapped with another Transit key are unwrapped and
+// wrapped with the configured one.
+func (v *VaultTransit) Rewrap(ctx context.Context, wrapped EnvelopeKey) (EnvelopeKey, error) {
+	if wrapped.KeyID != v.KeyID() {
+		key, err := v.Unwrap(ctx, wrapped)
+		if err != nil {
+			return EnvelopeKey{}, err
+		}
+		return v.Wrap(ctx, key)
+	}
+
+	var response struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	request := map[string]string{"ciphertext": wrapped.WrappedKey}
+	if err := v.call(ctx, "rewrap", wrapped.KeyID, request, &response); err != nil {
+		return EnvelopeKey{}, err
+	}
+
+	return EnvelopeKey{KeyProvider: keyProviderVault, KeyID: v.KeyID(), WrappedKey: response.Ciphertext}, nil
+}
+
+// call posts request to the Transit operation on keyID, <mount>/<key name>,
+// and decodes the data of the response into response.
+func (v *VaultTransit) call(ctx context.Context, operation, keyID string, request, response interface{}) error {
+	mount, keyName, found := strings.Cut(keyID, "/")
+	if !found {
+		return fmt.Errorf("invalid Vault Transit key %q", keyID)
+	}
+
+	token := v.token
+	if v.tokenFile != "" {
+		data, err := os.ReadFile(v.tokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read Vault token file: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token == "" {
+		return fmt.Errorf("Vault token not configured, set vault.token, vault.token_file or VAULT_TOKEN")
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("%s/v1/%s/%s/%s", v.address, mount, operation, url.PathEscape(keyName))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create Vault request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Vault Transit %s failed: %w", operation, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("failed to read Vault response: %w", err)
+	}
+
+	if resp.StatusCode/100 != 2 {
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(data, &failure) == nil && len(failure.Errors) > 0 {
+			return fmt.Errorf("Vault Transit %s with key %s failed: %s", operation, keyID, strings.Join(failure.Errors, "; "))
+		}
+		return fmt.Errorf("Vault Transit %s with key %s failed: %s", operation, keyID, resp.Status)
+	}
+
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return fmt.Errorf("failed to decode Vault response: %w", err)
+	}
+	if err := json.Unmarshal(envelope.Data, response); err != nil {
+		return fmt.Errorf("failed to decode Vault response: %w", err)
+	}
+	return nil
+}
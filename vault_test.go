@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const vaultTestToken = "s.test-token"
+
+// vaultStub implements the encrypt, decrypt and rewrap endpoints of a
+// Transit secrets engine mounted at transit, remembering the plaintext of
+// every ciphertext it returned.
+type vaultStub struct {
+	mu          sync.Mutex
+	version     int
+	plaintexts  map[string]string
+	requests    []string
+	namespaces  []string
+	ciphertexts int
+}
+
+func newVaultStub(t *testing.T) (*vaultStub, *httptest.Server) {
+	t.Helper()
+
+	stub := &vaultStub{version: 1, plaintexts: map[string]string{}}
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+
+	t.Setenv("VAULT_ADDR", "")
+	t.Setenv("VAULT_TOKEN", "")
+	setConfig(t, map[string]interface{}{
+		"vault.address":  server.URL,
+		"vault.token":    vaultTestToken,
+		"vault.key_name": "backup",
+	})
+	return stub, server
+}
+
+func (s *vaultStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	s.namespaces = append(s.namespaces, r.Header.Get("X-Vault-Namespace"))
+
+	fail := func(status int, message string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string][]string{"errors": {message}})
+	}
+	if r.Header.Get("X-Vault-Token") != vaultTestToken {
+		fail(http.StatusForbidden, "permission denied")
+		return
+	}
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+		fail(http.StatusMethodNotAllowed, "unsupported request")
+		return
+	}
+
+	var request struct {
+		Plaintext  string `json:"plaintext"`
+		Ciphertext string `json:"ciphertext"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var data map[string]string
+	switch r.URL.Path {
+	case "/v1/transit/encrypt/backup":
+		data = map[string]string{"ciphertext": s.encrypt(request.Plaintext)}
+	case "/v1/transit/decrypt/backup":
+		plaintext, ok := s.plaintexts[request.Ciphertext]
+		if !ok {
+			fail(http.StatusBadRequest, "invalid ciphertext")
+			return
+		}
+		data = map[string]string{"plaintext": plaintext}
+	case "/v1/transit/rewrap/backup":
+		plaintext, ok := s.plaintexts[request.Ciphertext]
+		if !ok {
+			fail(http.StatusBadRequest, "invalid ciphertext")
+			return
+		}
+		data = map[string]string{"ciphertext": s.encrypt(plaintext)}
+	default:
+		fail(http.StatusNotFound, "no handler for route")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+}
+
+func (s *vaultStub) encrypt(plaintext string) string {
+	s.ciphertexts++
+	ciphertext := fmt.Sprintf("vault:v%d:ciphertext-%d", s.version, s.ciphertexts)
+	s.plaintexts[ciphertext] = plaintext
+	return ciphertext
+}
+
+func TestVaultTransitWrapAndUnwrap(t *testing.T) {
+	stub, _ := newVaultStub(t)
+	setConfig(t, map[string]interface{}{"vault.namespace": "team"})
+
+	vault, err := NewVaultTransit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := bytes.Repeat([]byte{7}, dataKeySize)
+
+	wrapped, err := vault.Wrap(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrapped.KeyProvider != keyProviderVault || wrapped.KeyID != "transit/backup" || !strings.HasPrefix(wrapped.WrappedKey, "vault:v1:") {
+		t.Fatalf("unexpected wrapped key %+v", wrapped)
+	}
+
+	unwrapped, err := vault.Unwrap(context.Background(), wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, key) {
+		t.Fatal("unwrapped key differs")
+	}
+
+	for _, namespace := range stub.namespaces {
+		if namespace != "team" {
+			t.Fatalf("request sent to namespace %q", namespace)
+		}
+	}
+}
+
+func TestVaultTransitRewrap(t *testing.T) {
+	stub, _ := newVaultStub(t)
+	vault, err := NewVaultTransit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := bytes.Repeat([]byte{9}, dataKeySize)
+
+	wrapped, err := vault.Wrap(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.version = 2
+
+	rewrapped, err := rewrapDataKey(context.Background(), vault, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(rewrapped.WrappedKey, "vault:v2:") || rewrapped.Rewrapped.IsZero() {
+		t.Fatalf("unexpected rewrapped key %+v", rewrapped)
+	}
+	if last := stub.requests[len(stub.requests)-1]; last != "POST /v1/transit/rewrap/backup" {
+		t.Fatalf("key rewrapped with %s", last)
+	}
+
+	unwrapped, err := vault.Unwrap(context.Background(), rewrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, key) {
+		t.Fatal("unwrapped key differs")
+	}
+}
+
+func TestVaultTransitErrors(t *testing.T) {
+	newVaultStub(t)
+
+	t.Run("permission denied", func(t *testing.T) {
+		setConfig(t, map[string]interface{}{"vault.token": "s.wrong"})
+		vault, err := NewVaultTransit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = vault.Wrap(context.Background(), make([]byte, dataKeySize))
+		if err == nil || !strings.Contains(err.Error(), "permission denied") {
+			t.Fatalf("expected the Vault error, got %v", err)
+		}
+	})
+
+	t.Run("invalid ciphertext", func(t *testing.T) {
+		vault, err := NewVaultTransit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = vault.Unwrap(context.Background(), EnvelopeKey{KeyID: "transit/backup", WrappedKey: "vault:v1:forged"})
+		if err == nil || !strings.Contains(err.Error(), "invalid ciphertext") {
+			t.Fatalf("expected the Vault error, got %v", err)
+		}
+	})
+
+	t.Run("token file", func(t *testing.T) {
+		tokenFile := writeFile(t, filepath.Join(t.TempDir(), "token"), []byte(vaultTestToken+"\n"))
+		setConfig(t, map[string]interface{}{"vault.token": "", "vault.token_file": tokenFile})
+		vault, err := NewVaultTransit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := vault.Wrap(context.Background(), make([]byte, dataKeySize)); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestEnvelopeWithVault(t *testing.T) {
+	newVaultStub(t)
+	setConfig(t, map[string]interface{}{"envelope.key_provider": keyProviderVault})
+
+	manifest := &BackupManifest{}
+	encryptor, err := NewEnvelopeClient().ForBackup(context.Background(), manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Envelope == nil || manifest.Envelope.Algorithm != envelopeAlgorithm {
+		t.Fatalf("no wrapped data key recorded: %+v", manifest.Envelope)
+	}
+	ciphertext := envelopeEncrypt(t, encryptor.(*EnvelopeClient), []byte("backup data"))
+
+	decryptor, err := NewEnvelopeClient().ForRestore(context.Background(), manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := envelopeDecrypt(decryptor.(*EnvelopeClient), ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "backup data" {
+		t.Fatalf("got %q", plaintext)
+	}
+}